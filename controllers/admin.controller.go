@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type AdminController struct {
+	userService    services.UserService
+	authService    services.AuthService
+	productService services.ProductService
+	auditService   services.AuditService
+}
+
+func NewAdminController(userService services.UserService, authService services.AuthService, productService services.ProductService, auditService services.AuditService) AdminController {
+	return AdminController{
+		userService:    userService,
+		authService:    authService,
+		productService: productService,
+		auditService:   auditService,
+	}
+}
+
+func (adc *AdminController) GetAllUsers(ctx *gin.Context) {
+	users, err := adc.userService.GetAllUsers()
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": users})
+}
+
+func (adc *AdminController) SetUserRoles(ctx *gin.Context) {
+	var request models.SetRolesRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrInvalidRole.Error()})
+		return
+	}
+	for _, role := range request.Roles {
+		if !role.IsValid() {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrInvalidRole.Error()})
+			return
+		}
+	}
+
+	userId := ctx.Param("id")
+	err := adc.userService.SetRoles(&userId, request.Roles)
+	if err != nil {
+		switch err {
+		case utils.ErrNotExists:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Roles were updated"})
+}
+
+func (adc *AdminController) DeleteUser(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	userId := ctx.Param("id")
+	err := adc.authService.DeleteAccount(principal, &userId, GetRequestInfo(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusNoContent, nil)
+}
+
+func (adc *AdminController) Impersonate(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	userId := ctx.Param("id")
+	impersonationToken, err := adc.authService.Impersonate(principal, &userId, GetRequestInfo(ctx))
+	if err != nil {
+		switch err {
+		case utils.ErrCannotImpersonate:
+			ctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		case utils.ErrNotExists:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": impersonationToken})
+}
+
+func (adc *AdminController) DeleteProduct(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	productId := ctx.Param("id")
+	err := adc.productService.DeleteProduct(&productId)
+	event := &models.AuditEvent{Type: models.AuditProductDelete, ActorID: principal.UserID, TargetID: productId}
+	adc.auditService.Record(event, GetRequestInfo(ctx), err)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "product with id " + productId + " is deleted"})
+}
+
+func (adc *AdminController) UnlockAccount(ctx *gin.Context) {
+	var request models.UnlockAccountRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidCredentialsFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	err := adc.authService.UnlockAccount(&request)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Account was unlocked"})
+}
+
+func (adc *AdminController) GetAuditEvents(ctx *gin.Context) {
+	var query models.AuditEventQuery
+	if err := ctx.ShouldBindQuery(&query); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&query); err != nil {
+		err = utils.ErrInvalidAuditQuery
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	events, err := adc.auditService.GetEvents(&query)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": events})
+}
+
+func (adc *AdminController) RegisterAdminRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
+	adminRoute := rg.Group("/admin", authMiddleware.RequireAuth(), ForbidImpersonation(), RequireRoles(models.RoleAdmin))
+	adminRoute.GET("/users", adc.GetAllUsers)
+	adminRoute.PUT("/users/:id/roles", adc.SetUserRoles)
+	adminRoute.DELETE("/users/:id", adc.DeleteUser)
+	adminRoute.POST("/users/:id/impersonate", adc.Impersonate)
+	adminRoute.DELETE("/products/:id", adc.DeleteProduct)
+	adminRoute.POST("/unlock", adc.UnlockAccount)
+	adminRoute.GET("/audit_events", adc.GetAuditEvents)
+}
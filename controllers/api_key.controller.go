@@ -0,0 +1,131 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyController struct {
+	apiKeyService services.APIKeyService
+}
+
+func NewAPIKeyController(apiKeyService services.APIKeyService) APIKeyController {
+	return APIKeyController{
+		apiKeyService: apiKeyService,
+	}
+}
+
+func (akc *APIKeyController) CreateAPIKey(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.APIKeyRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidAPIKeyFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	createdAPIKey, err := akc.apiKeyService.CreateAPIKey(&principal.UserID, &request)
+	if err != nil {
+		switch err {
+		case utils.ErrInvalidAPIKeyFormat:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": createdAPIKey})
+}
+
+func (akc *APIKeyController) GetAPIKeys(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	apiKeys, err := akc.apiKeyService.GetAPIKeysOfUser(&principal.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": apiKeys})
+}
+
+func (akc *APIKeyController) GetAPIKey(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	apiKeyId := ctx.Param("id")
+	apiKey, err := akc.apiKeyService.GetAPIKey(&principal.UserID, &apiKeyId)
+	if err != nil {
+		switch err {
+		case utils.ErrNotExists:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": apiKey})
+}
+
+func (akc *APIKeyController) UpdateAPIKey(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.APIKeyRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidAPIKeyFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	apiKeyId := ctx.Param("id")
+	err := akc.apiKeyService.UpdateAPIKey(&principal.UserID, &apiKeyId, &request)
+	if err != nil {
+		switch err {
+		case utils.ErrInvalidAPIKeyFormat:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case utils.ErrNotExists:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "updated"})
+}
+
+func (akc *APIKeyController) DeleteAPIKey(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	apiKeyId := ctx.Param("id")
+	err := akc.apiKeyService.DeleteAPIKey(&principal.UserID, &apiKeyId)
+	if err != nil {
+		switch err {
+		case utils.ErrNoMatchedDocumentFoundForDelete:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusNoContent, nil)
+}
+
+func (akc *APIKeyController) RegisterAPIKeyRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
+	apiKeyRoute := rg.Group("/auth/api_keys", authMiddleware.RequireAuth(), ForbidImpersonation())
+	apiKeyRoute.POST("", akc.CreateAPIKey)
+	apiKeyRoute.GET("", akc.GetAPIKeys)
+	apiKeyRoute.GET("/:id", akc.GetAPIKey)
+	apiKeyRoute.PUT("/:id", akc.UpdateAPIKey)
+	apiKeyRoute.DELETE("/:id", akc.DeleteAPIKey)
+}
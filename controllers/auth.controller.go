@@ -8,7 +8,6 @@ import (
 	"github.com/akunsecured/emezen_api/security"
 	"github.com/akunsecured/emezen_api/services"
 	"github.com/akunsecured/emezen_api/utils"
-	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator"
 )
@@ -25,18 +24,19 @@ func NewAuthController(authService services.AuthService) AuthController {
 	}
 }
 
-func (ac *AuthController) CheckHeaderAuthorization(ctx *gin.Context) (*jwt.MapClaims, error) {
-	tokenStr := ctx.GetHeader("Authorization")
-	if tokenStr == "" {
-		return nil, utils.ErrMissingAuthToken
-	}
-
-	claims, err := security.ParseToken(tokenStr)
-	if err != nil {
-		return nil, err
+// respondWithPasswordPolicyError will respond with every failed rule if the error comes from
+// the password policy, and tell whether it did.
+func respondWithPasswordPolicyError(ctx *gin.Context, err error) bool {
+	policyErr, ok := err.(*security.PasswordPolicyError)
+	if !ok {
+		return false
 	}
+	ctx.JSON(http.StatusBadRequest, gin.H{"message": policyErr.Error(), "failures": policyErr.Failures})
+	return true
+}
 
-	return claims, nil
+func (ac *AuthController) GetPasswordPolicy(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"message": ac.authService.GetPasswordPolicy()})
 }
 
 func (ac *AuthController) Register(ctx *gin.Context) {
@@ -51,8 +51,11 @@ func (ac *AuthController) Register(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	wrappedToken, err := ac.authService.Register(&userDataWithCredentials)
+	wrappedToken, err := ac.authService.Register(&userDataWithCredentials, GetRequestInfo(ctx))
 	if err != nil {
+		if respondWithPasswordPolicyError(ctx, err) {
+			return
+		}
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
@@ -70,35 +73,75 @@ func (ac *AuthController) Login(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	wrappedToken, err := ac.authService.Login(&credentials)
+	wrappedToken, challenge, err := ac.authService.Login(&credentials, GetRequestInfo(ctx))
 	if err != nil {
 		switch err {
-		case utils.ErrInvalidPassword:
+		case utils.ErrInvalidCredentials:
 			ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		case utils.ErrNoAccountWithThisEmail:
-			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		case utils.ErrTooManyLoginAttempts:
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
 		default:
 			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		}
 		return
 	}
+	if challenge != nil {
+		ctx.JSON(http.StatusOK, gin.H{"message": challenge})
+		return
+	}
 	ctx.JSON(http.StatusOK, gin.H{"message": wrappedToken})
 }
 
-func (ac *AuthController) Update(ctx *gin.Context) {
-	var credentials models.UserCredentials
-	if err := ctx.ShouldBindJSON(&credentials); err != nil {
+func (ac *AuthController) VerifyTwoFactorLogin(ctx *gin.Context) {
+	var request models.TwoFactorLoginRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	if err := validate.Struct(&credentials); err != nil {
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidTwoFactorCode
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	wrappedToken, err := ac.authService.VerifyTwoFactorLogin(&request, GetRequestInfo(ctx))
+	if err != nil {
+		switch err {
+		case utils.ErrInvalidLoginChallenge, utils.ErrInvalidTwoFactorCode, utils.ErrTwoFactorNotEnabled:
+			ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case utils.ErrTooManyLoginAttempts:
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": wrappedToken})
+}
+
+func (ac *AuthController) ChangePassword(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.ChangePasswordRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
 		err = utils.ErrInvalidCredentialsFormat
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	err := ac.authService.Update(&credentials)
+
+	err := ac.authService.ChangePassword(principal, &request, GetRequestInfo(ctx))
 	if err != nil {
+		if respondWithPasswordPolicyError(ctx, err) {
+			return
+		}
 		switch err {
+		case utils.ErrWrongCurrentPassword:
+			ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case utils.ErrTooManyLoginAttempts:
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
 		case utils.ErrNotExists:
 			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
 		default:
@@ -106,17 +149,48 @@ func (ac *AuthController) Update(ctx *gin.Context) {
 		}
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": "Successfully updated"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "Password was changed successfully"})
 }
 
-func (ac *AuthController) RefreshToken(ctx *gin.Context) {
-	claims, err := ac.CheckHeaderAuthorization(ctx)
+func (ac *AuthController) ChangeEmail(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.ChangeEmailRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidCredentialsFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	err := ac.authService.ChangeEmail(principal, &request, GetRequestInfo(ctx))
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		switch err {
+		case utils.ErrWrongCurrentPassword:
+			ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		case utils.ErrTooManyLoginAttempts:
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+		case utils.ErrEmailIsAlreadyInUse:
+			ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		case utils.ErrEmailIsUnchanged:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case utils.ErrNotExists:
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Verification link was sent to the new email address"})
+}
 
-	newToken, err := ac.authService.NewAccessToken(claims)
+func (ac *AuthController) RefreshToken(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	newToken, err := ac.authService.NewAccessToken(principal, GetRequestInfo(ctx))
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
@@ -125,41 +199,206 @@ func (ac *AuthController) RefreshToken(ctx *gin.Context) {
 }
 
 func (ac *AuthController) CurrentUser(ctx *gin.Context) {
-	claims, err := ac.CheckHeaderAuthorization(ctx)
+	principal := GetPrincipal(ctx)
+
+	currentUser, err := ac.authService.CurrentUser(principal)
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
+	ctx.JSON(http.StatusOK, gin.H{"message": currentUser})
+}
+
+func (ac *AuthController) DeleteUser(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
 
-	currentUser, err := ac.authService.CurrentUser(claims)
+	err := ac.authService.DeleteUser(principal, GetRequestInfo(ctx))
 	if err != nil {
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": currentUser})
+	ctx.JSON(http.StatusNoContent, nil)
 }
 
-func (ac *AuthController) DeleteUser(ctx *gin.Context) {
-	claims, err := ac.CheckHeaderAuthorization(ctx)
+func (ac *AuthController) ForgotPassword(ctx *gin.Context) {
+	var request models.ForgotPasswordRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidCredentialsFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	err := ac.authService.ForgotPassword(&request)
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		log.Print(err)
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "If an account exists with this email, a reset link has been sent to it"})
+}
+
+func (ac *AuthController) ResetPassword(ctx *gin.Context) {
+	var request models.ResetPasswordRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidCredentialsFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	err := ac.authService.ResetPassword(&request, GetRequestInfo(ctx))
+	if err != nil {
+		if respondWithPasswordPolicyError(ctx, err) {
+			return
+		}
+		switch err {
+		case utils.ErrInvalidResetToken:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Password was reset successfully"})
+}
 
-	err = ac.authService.DeleteUser(claims)
+func (ac *AuthController) VerifyEmail(ctx *gin.Context) {
+	var request models.VerifyEmailRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidVerificationToken
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	err := ac.authService.VerifyEmail(&request)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		switch err {
+		case utils.ErrInvalidVerificationToken:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case utils.ErrEmailIsAlreadyInUse:
+			ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
-	ctx.JSON(http.StatusNoContent, nil)
+	ctx.JSON(http.StatusOK, gin.H{"message": "Email address was verified successfully"})
+}
+
+func (ac *AuthController) ResendEmailVerification(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	err := ac.authService.ResendEmailVerification(principal)
+	if err != nil {
+		switch err {
+		case utils.ErrEmailIsAlreadyVerified:
+			ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Verification link was sent"})
+}
+
+func (ac *AuthController) EnrollTwoFactor(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	enrollment, err := ac.authService.EnrollTwoFactor(principal)
+	if err != nil {
+		switch err {
+		case utils.ErrTwoFactorAlreadyEnabled:
+			ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": enrollment})
+}
+
+func (ac *AuthController) ConfirmTwoFactor(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidTwoFactorCode
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	recoveryCodes, err := ac.authService.ConfirmTwoFactor(principal, &request, GetRequestInfo(ctx))
+	if err != nil {
+		switch err {
+		case utils.ErrTwoFactorAlreadyEnabled:
+			ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+		case utils.ErrTwoFactorNotEnrolled, utils.ErrInvalidTwoFactorCode:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": gin.H{"recovery_codes": recoveryCodes}})
 }
 
-func (ac *AuthController) RegisterAuthRoutes(rg *gin.RouterGroup) {
+func (ac *AuthController) DisableTwoFactor(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.TwoFactorCodeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidTwoFactorCode
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	err := ac.authService.DisableTwoFactor(principal, &request, GetRequestInfo(ctx))
+	if err != nil {
+		switch err {
+		case utils.ErrTwoFactorNotEnabled, utils.ErrInvalidTwoFactorCode:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "Two-factor authentication was disabled"})
+}
+
+func (ac *AuthController) RegisterAuthRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
 	authRoute := rg.Group("/auth")
 	authRoute.POST("/register", ac.Register)
 	authRoute.POST("/login", ac.Login)
-	authRoute.PUT("/update", ac.Update)
-	authRoute.GET("/refresh", ac.RefreshToken)
-	authRoute.GET("/current", ac.CurrentUser)
-	authRoute.DELETE("/delete", ac.DeleteUser)
+	authRoute.POST("/login/2fa", ac.VerifyTwoFactorLogin)
+	authRoute.POST("/password/forgot", ac.ForgotPassword)
+	authRoute.POST("/password/reset", ac.ResetPassword)
+	authRoute.GET("/password/policy", ac.GetPasswordPolicy)
+	authRoute.POST("/email/verify", ac.VerifyEmail)
+
+	refreshRoute := authRoute.Group("", authMiddleware.RequireToken(security.RefreshTokenType))
+	refreshRoute.GET("/refresh", ac.RefreshToken)
+
+	protectedRoute := authRoute.Group("", authMiddleware.RequireAuth())
+	protectedRoute.PUT("/password", ForbidImpersonation(), ac.ChangePassword)
+	protectedRoute.PUT("/email", ForbidImpersonation(), ac.ChangeEmail)
+	protectedRoute.GET("/current", ac.CurrentUser)
+	protectedRoute.DELETE("/delete", ForbidImpersonation(), ac.DeleteUser)
+	protectedRoute.POST("/email/resend", ac.ResendEmailVerification)
+	protectedRoute.POST("/2fa/enroll", ForbidImpersonation(), ac.EnrollTwoFactor)
+	protectedRoute.POST("/2fa/confirm", ForbidImpersonation(), ac.ConfirmTwoFactor)
+	protectedRoute.POST("/2fa/disable", ForbidImpersonation(), ac.DisableTwoFactor)
 }
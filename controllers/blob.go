@@ -0,0 +1,163 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+// productImageURL returns the absolute link of the product image with the given storage key.
+func productImageURL(policy models.AssetURLPolicy, key string) string {
+	if policy.CDNBaseURL != "" {
+		return strings.TrimSuffix(policy.CDNBaseURL, "/") + "/" + key
+	}
+	return strings.TrimSuffix(policy.PublicBaseURL, "/") + "/product/image/" + path.Base(key)
+}
+
+// profilePictureURL returns the absolute link of the profile picture of the user. It is
+// always served by the API, which generates a default one if the user has not uploaded any.
+func profilePictureURL(policy models.AssetURLPolicy, userId string) string {
+	return strings.TrimSuffix(policy.PublicBaseURL, "/") + "/user/image/" + userId
+}
+
+// withImageURLs returns a copy of the product which has the links of its images instead of
+// their storage keys, so the stored product is not changed.
+func withImageURLs(policy models.AssetURLPolicy, product *models.Product) *models.Product {
+	result := *product
+	result.Images = make([]string, len(product.Images))
+	for index, key := range product.Images {
+		result.Images[index] = productImageURL(policy, key)
+	}
+	return &result
+}
+
+// The Cache-Control values of the served files. Files whose key is derived from their
+// content never change, the others have to be revalidated with their ETag.
+const (
+	immutableCacheControl  = "public, max-age=31536000, immutable"
+	revalidateCacheControl = "public, no-cache"
+)
+
+// serveBlob will stream the file with the given key from the blob store. Conditional and
+// range requests are handled by http.ServeContent, based on the ETag derived from the hash
+// of the content and the modification time.
+func serveBlob(ctx *gin.Context, blobStore services.BlobStore, key string, cacheControl string) {
+	reader, info, err := services.OpenBlob(blobStore, key)
+	if err != nil {
+		switch err {
+		case utils.ErrBlobNotFound, utils.ErrInvalidBlobKey:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": utils.ErrBlobNotFound.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	defer reader.Close()
+
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", info.ContentType)
+	header.Set("Cache-Control", cacheControl)
+	if info.Hash != "" {
+		header.Set("ETag", `"`+info.Hash+`"`)
+	}
+	http.ServeContent(ctx.Writer, ctx.Request, "", info.ModTime, reader)
+}
+
+// serveBytes will respond with the given generated content the same way as serveBlob does
+// with stored files.
+func serveBytes(ctx *gin.Context, data []byte, contentType string, cacheControl string) {
+	hash := sha256.Sum256(data)
+
+	header := ctx.Writer.Header()
+	header.Set("Content-Type", contentType)
+	header.Set("Cache-Control", cacheControl)
+	header.Set("ETag", `"`+hex.EncodeToString(hash[:])+`"`)
+	http.ServeContent(ctx.Writer, ctx.Request, "", time.Time{}, bytes.NewReader(data))
+}
+
+// multipartFiles will return the files uploaded in the given field of the multipart form. If
+// the form cannot be read or there are no files, it responds with the error itself.
+func multipartFiles(ctx *gin.Context, field string) ([]*multipart.FileHeader, bool) {
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": utils.ErrRequestTooLarge.Error()})
+			return nil, false
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return nil, false
+	}
+
+	files := form.File[field]
+	if len(files) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrNoFilesUploaded.Error()})
+		return nil, false
+	}
+	return files, true
+}
+
+// uploadSize returns the total size of the uploaded files, as sent by the client.
+func uploadSize(files []*multipart.FileHeader) int64 {
+	var size int64
+	for _, file := range files {
+		size += file.Size
+	}
+	return size
+}
+
+// reserveUpload will count the given number of files against the upload rate of the user,
+// and reserve the bytes in the quota of the user. It returns the number of bytes reserved,
+// which have to be released with recordUploads or releaseUpload. If the upload is not
+// allowed, it responds with the error itself, and with the current usage if the quota is
+// exceeded.
+func reserveUpload(ctx *gin.Context, storageService services.StorageService, userId string, files int, size int64, replacedKeys ...string) (int64, bool) {
+	var reserved int64
+	err := storageService.ReserveUploads(userId, files)
+	if err == nil {
+		reserved, err = storageService.ReserveQuota(userId, size, replacedKeys...)
+	}
+	switch err {
+	case nil:
+		return reserved, true
+	case utils.ErrTooManyUploads:
+		ctx.JSON(http.StatusTooManyRequests, gin.H{"message": err.Error()})
+	case utils.ErrStorageQuotaExceeded:
+		usage, _ := storageService.GetUsage(userId)
+		ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": err.Error(), "usage": usage})
+	default:
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+	}
+	return 0, false
+}
+
+// releaseUpload will give back the bytes reserved for an upload which stored nothing. The
+// response is sent already, so failures are only logged.
+func releaseUpload(storageService services.StorageService, userId string, reserved int64) {
+	if err := storageService.ReleaseQuota(userId, reserved); err != nil {
+		log.Print(err)
+	}
+}
+
+// recordUploads will charge the user for the stored images instead of the reserved bytes. The
+// images are stored already, so failures are only logged.
+func recordUploads(storageService services.StorageService, userId string, reserved int64, storedImages []*models.StoredImage) {
+	for _, storedImage := range storedImages {
+		if err := storageService.SetUsage(userId, storedImage.Key, storedImage.Size); err != nil {
+			log.Print(err)
+		}
+	}
+	releaseUpload(storageService, userId, reserved)
+}
@@ -0,0 +1,137 @@
+package controllers
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type MediaController struct {
+	blobStore      services.BlobStore
+	imageService   services.ImageService
+	storageService services.StorageService
+	assetURLPolicy models.AssetURLPolicy
+}
+
+func NewMediaController(blobStore services.BlobStore, imageService services.ImageService, storageService services.StorageService, assetURLPolicy models.AssetURLPolicy) MediaController {
+	return MediaController{
+		blobStore:      blobStore,
+		imageService:   imageService,
+		storageService: storageService,
+		assetURLPolicy: assetURLPolicy,
+	}
+}
+
+// signedURL returns a link to the file with the given key which expires after the given
+// lifetime. Private files are always served by the API, since only it can check the
+// signature.
+func (mc *MediaController) signedURL(key string, lifetime time.Duration) *models.SignedMediaURL {
+	expiresAt := time.Now().Add(lifetime)
+	expires, signature := security.SignMediaKey(key, expiresAt)
+	query := url.Values{}
+	query.Set("expires", expires)
+	query.Set("signature", signature)
+
+	return &models.SignedMediaURL{
+		URL:       strings.TrimSuffix(mc.assetURLPolicy.PublicBaseURL, "/") + "/media/file/" + key + "?" + query.Encode(),
+		ExpiresAt: time.Unix(expiresAt.Unix(), 0).UTC(),
+	}
+}
+
+// GetMedia serves the stored file with the given key. Private files are only served if the
+// link is signed and has not expired, and they are not kept in shared caches.
+func (mc *MediaController) GetMedia(ctx *gin.Context) {
+	key := strings.TrimPrefix(ctx.Param("key"), "/")
+
+	cacheControl := revalidateCacheControl
+	if models.IsPrivateMediaKey(key) {
+		expires := ctx.Query("expires")
+		if err := security.VerifyMediaSignature(key, expires, ctx.Query("signature")); err != nil {
+			ctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+			return
+		}
+		expiresAt, _ := strconv.ParseInt(expires, 10, 64)
+		cacheControl = "private, max-age=" + strconv.FormatInt(expiresAt-time.Now().Unix(), 10)
+	}
+
+	serveBlob(ctx, mc.blobStore, key, cacheControl)
+}
+
+// GetMediaURL returns a signed link to the file given in the key query parameter. The
+// lifetime of the link can be set in seconds with the expires_in query parameter.
+func (mc *MediaController) GetMediaURL(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	key := ctx.Query("key")
+	if !security.CanAccessMedia(principal, key) {
+		ctx.JSON(http.StatusForbidden, gin.H{"message": utils.ErrForbidden.Error()})
+		return
+	}
+
+	lifetime := security.MediaURLLifetime
+	if expiresIn := ctx.Query("expires_in"); expiresIn != "" {
+		seconds, err := strconv.Atoi(expiresIn)
+		if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > security.MaxMediaURLLifetime {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrInvalidMediaURLLifetime.Error()})
+			return
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	}
+
+	if _, err := mc.blobStore.Stat(key); err != nil {
+		switch err {
+		case utils.ErrBlobNotFound, utils.ErrInvalidBlobKey:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": utils.ErrBlobNotFound.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": mc.signedURL(key, lifetime)})
+}
+
+// UploadPrivateMedia stores images which only the uploader and admins can access, e.g.
+// photos of a return request or documents for seller verification.
+func (mc *MediaController) UploadPrivateMedia(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	files, ok := multipartFiles(ctx, "media")
+	if !ok {
+		return
+	}
+	reserved, ok := reserveUpload(ctx, mc.storageService, principal.UserID, len(files), uploadSize(files))
+	if !ok {
+		return
+	}
+
+	result := mc.imageService.SaveImages(models.PrivateMediaPrefix+principal.UserID+"/", files, nil, 0)
+	if len(result.Stored) == 0 {
+		releaseUpload(mc.storageService, principal.UserID, reserved)
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": result})
+		return
+	}
+	recordUploads(mc.storageService, principal.UserID, reserved, result.Stored)
+	for _, storedImage := range result.Stored {
+		storedImage.URL = mc.signedURL(storedImage.Key, security.MediaURLLifetime).URL
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": result})
+}
+
+func (mc *MediaController) RegisterMediaRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
+	mediaRoute := rg.Group("/media")
+	mediaRoute.GET("/file/*key", mc.GetMedia)
+
+	protectedRoute := mediaRoute.Group("", authMiddleware.RequireAuth())
+	protectedRoute.GET("/url", mc.GetMediaURL)
+	protectedRoute.POST("/upload", LimitRequestBody(mc.imageService.GetPolicy().MaxRequestSize), mc.UploadPrivateMedia)
+}
@@ -0,0 +1,255 @@
+package controllers
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	principalKey    = "principal"
+	requestIDKey    = "request_id"
+	requestIDHeader = "X-Request-ID"
+	maxRequestIDLen = 64
+)
+
+type AuthMiddleware struct {
+	sessionService services.SessionService
+	userService    services.UserService
+	apiKeyService  services.APIKeyService
+	oauthService   services.OAuthService
+	auditService   services.AuditService
+}
+
+func NewAuthMiddleware(sessionService services.SessionService, userService services.UserService, apiKeyService services.APIKeyService, oauthService services.OAuthService, auditService services.AuditService) AuthMiddleware {
+	return AuthMiddleware{
+		sessionService: sessionService,
+		userService:    userService,
+		apiKeyService:  apiKeyService,
+		oauthService:   oauthService,
+		auditService:   auditService,
+	}
+}
+
+// RequireAuth returns a middleware which only lets the request through with a valid access
+// token of an active session in the Authorization header. If scopes are given, API keys and
+// access tokens of third-party clients having all of them are accepted as well, otherwise the
+// route is only available to user sessions.
+func (am *AuthMiddleware) RequireAuth(scopes ...models.Scope) gin.HandlerFunc {
+	requireToken := am.RequireToken(security.AccessTokenType)
+	return func(ctx *gin.Context) {
+		tokenStr := ctx.GetHeader("Authorization")
+
+		var principal *models.Principal
+		var err error
+		if strings.HasPrefix(tokenStr, "Bearer "+services.APIKeyPrefix) {
+			if len(scopes) == 0 {
+				ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": utils.ErrScopedTokenNotAllowed.Error()})
+				return
+			}
+			principal, err = am.apiKeyPrincipal(tokenStr)
+		} else if claims, parseErr := security.ParseToken(tokenStr); parseErr == nil && (*claims)["token_type"] == security.OAuthAccessTokenType {
+			principal, err = am.oauthPrincipal(claims)
+		} else {
+			requireToken(ctx)
+			return
+		}
+
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+		if len(scopes) == 0 {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": utils.ErrScopedTokenNotAllowed.Error()})
+			return
+		}
+		if !principal.HasScopes(scopes...) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": utils.ErrMissingScope.Error()})
+			return
+		}
+
+		ctx.Set(principalKey, principal)
+		ctx.Next()
+	}
+}
+
+func (am *AuthMiddleware) apiKeyPrincipal(tokenStr string) (*models.Principal, error) {
+	apiKey, err := am.apiKeyService.Authenticate(strings.TrimPrefix(tokenStr, "Bearer "))
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Principal{
+		UserID:   apiKey.UserID,
+		APIKeyID: apiKey.ID.Hex(),
+		Scopes:   apiKey.Scopes,
+	}, nil
+}
+
+// oauthPrincipal builds the principal from the stored record of the token, so revoked tokens
+// are rejected and the granted scopes cannot be altered by the client.
+func (am *AuthMiddleware) oauthPrincipal(claims *jwt.MapClaims) (*models.Principal, error) {
+	tokenId, _ := (*claims)["jti"].(string)
+	token, err := am.oauthService.ValidateAccessToken(tokenId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.Principal{
+		UserID:   token.UserID,
+		ClientID: token.ClientID,
+		Scopes:   token.Scopes,
+	}, nil
+}
+
+// RequireToken returns a middleware which parses the bearer token once, checks that it is of
+// the given type and its session is still active, and stores the principal in the context.
+// The roles are loaded from the user, so a role taken away is gone with the next request.
+// Every request made while impersonating a user is recorded in the audit log.
+func (am *AuthMiddleware) RequireToken(tokenType string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		tokenStr := ctx.GetHeader("Authorization")
+		if tokenStr == "" {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": utils.ErrMissingAuthToken.Error()})
+			return
+		}
+
+		claims, err := security.ParseToken(tokenStr)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+
+		principal, err := security.PrincipalFromClaims(claims, tokenType)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+
+		session, err := am.sessionService.GetSession(&principal.SessionID)
+		if err == nil && (session.UserID != principal.UserID || session.ActorID != principal.ActorID) {
+			err = utils.ErrSessionRevoked
+		}
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+
+		user, err := am.userService.GetUser(&principal.UserID)
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+			return
+		}
+		principal.Roles = user.GetRoles()
+
+		ctx.Set(principalKey, principal)
+		ctx.Next()
+
+		if principal.IsImpersonated() {
+			am.auditImpersonatedRequest(ctx, principal)
+		}
+	}
+}
+
+func (am *AuthMiddleware) auditImpersonatedRequest(ctx *gin.Context, principal *models.Principal) {
+	event := &models.AuditEvent{
+		Type:     models.AuditImpersonated,
+		Outcome:  models.AuditOutcomeSuccess,
+		ActorID:  principal.ActorID,
+		TargetID: principal.UserID,
+		Method:   ctx.Request.Method,
+		Path:     ctx.Request.URL.Path,
+		Status:   ctx.Writer.Status(),
+	}
+	switch {
+	case event.Status == http.StatusForbidden:
+		event.Outcome = models.AuditOutcomeDenied
+	case event.Status >= http.StatusBadRequest:
+		event.Outcome = models.AuditOutcomeFailure
+	}
+	am.auditService.Record(event, GetRequestInfo(ctx), nil)
+}
+
+// ForbidImpersonation returns a middleware which blocks sensitive operations, like changing
+// the credentials or deleting the account, while an admin impersonates the user. It has to
+// run after RequireAuth.
+func ForbidImpersonation() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		principal := GetPrincipal(ctx)
+		if principal != nil && principal.IsImpersonated() {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": utils.ErrImpersonationNotAllowed.Error()})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// RequireRoles returns a middleware which only lets the request through if the principal has
+// at least one of the given roles. Admins pass every check. It has to run after RequireAuth.
+func RequireRoles(roles ...models.Role) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		principal := GetPrincipal(ctx)
+		if principal == nil {
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"message": utils.ErrMissingAuthToken.Error()})
+			return
+		}
+
+		if !principal.HasRole(roles...) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"message": utils.ErrForbidden.Error()})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// GetPrincipal returns the principal stored by the authentication middleware, or nil on
+// public routes.
+func GetPrincipal(ctx *gin.Context) *models.Principal {
+	value, exists := ctx.Get(principalKey)
+	if !exists {
+		return nil
+	}
+	principal, _ := value.(*models.Principal)
+	return principal
+}
+
+// RequestID returns a middleware which gives every request an ID, so the audit log and the
+// logs of proxies can be matched. The ID of the proxy is kept if there is one.
+func RequestID() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		requestId := ctx.GetHeader(requestIDHeader)
+		if requestId == "" || len(requestId) > maxRequestIDLen {
+			requestId, _ = security.NewRandomToken(16)
+		}
+
+		ctx.Set(requestIDKey, requestId)
+		ctx.Header(requestIDHeader, requestId)
+		ctx.Next()
+	}
+}
+
+// GetRequestInfo returns what the audit log records about the request.
+func GetRequestInfo(ctx *gin.Context) *models.RequestInfo {
+	return &models.RequestInfo{
+		IP:        ctx.ClientIP(),
+		UserAgent: ctx.Request.UserAgent(),
+		RequestID: ctx.GetString(requestIDKey),
+	}
+}
+
+// LimitRequestBody returns a middleware which fails reading the body of the request once it
+// is larger than the given number of bytes.
+func LimitRequestBody(limit int64) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		ctx.Request.Body = http.MaxBytesReader(ctx.Writer, ctx.Request.Body, limit)
+		ctx.Next()
+	}
+}
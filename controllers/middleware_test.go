@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/form3tech-oss/jwt-go"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestRequireTokenLoadsRolesFromUser(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name     string
+		roles    []models.Role
+		expected int
+	}{
+		{"forged admin role", nil, http.StatusForbidden},
+		{"admin", []models.Role{models.RoleAdmin}, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			gin.SetMode(gin.TestMode)
+			s := &oauthTestServer{mt: mt}
+			database := mt.Client.Database(oauthTestDatabase)
+			authMiddleware := NewAuthMiddleware(services.NewSessionService(database.Collection("sessions"), context.Background()), services.NewUserService(database.Collection("users"), context.Background()), nil, nil, nil)
+
+			router := gin.New()
+			router.GET("/admin", authMiddleware.RequireAuth(), RequireRoles(models.RoleAdmin), func(ctx *gin.Context) {
+				ctx.Status(http.StatusOK)
+			})
+
+			// The token claims the admin role, whatever the stored user has
+			user := models.User{ID: primitive.NewObjectID(), Roles: test.roles}
+			session := models.Session{ID: primitive.NewObjectID(), UserID: user.ID.Hex(), ExpiresAt: time.Now().Add(time.Hour)}
+			claims := security.JwtUserClaims{
+				User:      user,
+				Roles:     []models.Role{models.RoleAdmin},
+				TokenType: security.AccessTokenType,
+				StandardClaims: jwt.StandardClaims{
+					Id:        session.ID.Hex(),
+					Subject:   user.ID.Hex(),
+					ExpiresAt: time.Now().Add(time.Hour).Unix(),
+				},
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(security.JwtSecretKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mt.AddMockResponses(
+				s.found("sessions", session),
+				s.found("users", user),
+			)
+
+			request := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			request.Header.Set("Authorization", "Bearer "+token)
+			recorder := httptest.NewRecorder()
+			router.ServeHTTP(recorder, request)
+			if recorder.Code != test.expected {
+				t.Errorf("status = %d, want %d", recorder.Code, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,220 @@
+package controllers
+
+import (
+	"net/http"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/gin-gonic/gin"
+)
+
+type OAuthController struct {
+	oauthService services.OAuthService
+}
+
+func NewOAuthController(oauthService services.OAuthService) OAuthController {
+	return OAuthController{
+		oauthService: oauthService,
+	}
+}
+
+// oauthErrorStatus maps the errors of the OAuth endpoints to the status codes of RFC 6749.
+func oauthErrorStatus(err error) int {
+	switch err {
+	case utils.ErrOAuthInvalidClient:
+		return http.StatusUnauthorized
+	case utils.ErrOAuthInvalidRequest, utils.ErrOAuthInvalidGrant, utils.ErrOAuthUnauthorizedClient,
+		utils.ErrOAuthUnsupportedGrantType, utils.ErrOAuthUnsupportedResponse, utils.ErrOAuthInvalidScope:
+		return http.StatusBadRequest
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// clientCredentials reads the credentials of the client from the Basic Authorization header,
+// or from the form if the header is missing.
+func clientCredentials(ctx *gin.Context) (string, string) {
+	if clientId, clientSecret, ok := ctx.Request.BasicAuth(); ok {
+		return clientId, clientSecret
+	}
+	return ctx.PostForm("client_id"), ctx.PostForm("client_secret")
+}
+
+func (oc *OAuthController) RegisterClient(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.OAuthClientRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&request); err != nil {
+		err = utils.ErrInvalidOAuthClientFormat
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	createdClient, err := oc.oauthService.RegisterClient(&principal.UserID, &request)
+	if err != nil {
+		switch err {
+		case utils.ErrInvalidOAuthClientFormat:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": createdClient})
+}
+
+func (oc *OAuthController) GetClients(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	clients, err := oc.oauthService.GetClientsOfUser(&principal.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": clients})
+}
+
+func (oc *OAuthController) DeleteClient(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	clientId := ctx.Param("id")
+	err := oc.oauthService.DeleteClient(&principal.UserID, &clientId)
+	if err != nil {
+		switch err {
+		case utils.ErrNoMatchedDocumentFoundForDelete:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusNoContent, nil)
+}
+
+func (oc *OAuthController) GetAuthorizeInfo(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.OAuthAuthorizeRequest
+	if err := ctx.ShouldBindQuery(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	info, err := oc.oauthService.GetAuthorizeInfo(&principal.UserID, &request)
+	if err != nil {
+		ctx.JSON(oauthErrorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": info})
+}
+
+// Authorize returns the URI the user has to be redirected to instead of redirecting, since
+// the decision is posted by the frontend of the consent screen.
+func (oc *OAuthController) Authorize(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	var request models.OAuthAuthorizeRequest
+	if err := ctx.ShouldBindJSON(&request); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	redirectURI, err := oc.oauthService.Authorize(&principal.UserID, &request)
+	if err != nil {
+		ctx.JSON(oauthErrorStatus(err), gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": redirectURI})
+}
+
+// Token is called by the clients, so its responses follow RFC 6749 instead of the usual
+// message wrapper.
+func (oc *OAuthController) Token(ctx *gin.Context) {
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Pragma", "no-cache")
+
+	var request models.OAuthTokenRequest
+	if err := ctx.ShouldBind(&request); err != nil || request.GrantType == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": utils.ErrOAuthInvalidRequest.Error()})
+		return
+	}
+	request.ClientID, request.ClientSecret = clientCredentials(ctx)
+
+	response, err := oc.oauthService.Exchange(&request)
+	if err != nil {
+		ctx.JSON(oauthErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+func (oc *OAuthController) Introspect(ctx *gin.Context) {
+	clientId, clientSecret := clientCredentials(ctx)
+
+	introspection, err := oc.oauthService.Introspect(clientId, clientSecret, ctx.PostForm("token"))
+	if err != nil {
+		ctx.JSON(oauthErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, introspection)
+}
+
+func (oc *OAuthController) Revoke(ctx *gin.Context) {
+	clientId, clientSecret := clientCredentials(ctx)
+
+	err := oc.oauthService.Revoke(clientId, clientSecret, ctx.PostForm("token"))
+	if err != nil {
+		ctx.JSON(oauthErrorStatus(err), gin.H{"error": err.Error()})
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (oc *OAuthController) GetConsents(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	consents, err := oc.oauthService.GetConsentsOfUser(&principal.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": consents})
+}
+
+func (oc *OAuthController) RevokeConsent(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
+	clientId := ctx.Param("client_id")
+	err := oc.oauthService.RevokeConsent(&principal.UserID, &clientId)
+	if err != nil {
+		switch err {
+		case utils.ErrNoMatchedDocumentFoundForDelete:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusNoContent, nil)
+}
+
+func (oc *OAuthController) RegisterOAuthRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
+	oauthRoute := rg.Group("/oauth")
+	oauthRoute.POST("/token", oc.Token)
+	oauthRoute.POST("/introspect", oc.Introspect)
+	oauthRoute.POST("/revoke", oc.Revoke)
+
+	protectedRoute := oauthRoute.Group("", authMiddleware.RequireAuth(), ForbidImpersonation())
+	protectedRoute.POST("/clients", oc.RegisterClient)
+	protectedRoute.GET("/clients", oc.GetClients)
+	protectedRoute.DELETE("/clients/:id", oc.DeleteClient)
+	protectedRoute.GET("/authorize", oc.GetAuthorizeInfo)
+	protectedRoute.POST("/authorize", oc.Authorize)
+	protectedRoute.GET("/consents", oc.GetConsents)
+	protectedRoute.DELETE("/consents/:client_id", oc.RevokeConsent)
+}
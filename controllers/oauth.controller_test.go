@@ -0,0 +1,647 @@
+package controllers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/services"
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// The OAuth tests run the real controller and service in an HTTP server. The database is
+// the mock deployment of the driver, which answers the commands with the queued responses,
+// and records them, so the tests can check what would have been stored.
+
+const (
+	oauthTestDatabase     = "emezen_test"
+	oauthTestUserID       = "6350f2b1c7a3d0a1b2c3d4e5"
+	oauthTestRedirectURI  = "https://app.example.com/callback"
+	oauthTestClientSecret = "confidential-client-secret"
+	oauthTestCodeVerifier = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+var (
+	oauthPublicClient = models.OAuthClient{
+		ID:           primitive.NewObjectID(),
+		ClientID:     "public-client",
+		OwnerUserID:  oauthTestUserID,
+		Name:         "Public app",
+		RedirectURIs: []string{oauthTestRedirectURI},
+		Scopes:       []models.Scope{models.ScopeProductsRead, models.ScopeOrdersRead},
+	}
+	oauthConfidentialClient = models.OAuthClient{
+		ID:               primitive.NewObjectID(),
+		ClientID:         "confidential-client",
+		ClientSecretHash: security.HashToken(oauthTestClientSecret),
+		OwnerUserID:      oauthTestUserID,
+		Name:             "Confidential app",
+		RedirectURIs:     []string{oauthTestRedirectURI},
+		Scopes:           []models.Scope{models.ScopeProductsRead},
+		Confidential:     true,
+	}
+)
+
+type oauthTestServer struct {
+	mt     *mtest.T
+	server *httptest.Server
+}
+
+func newOAuthTestServer(mt *mtest.T) *oauthTestServer {
+	gin.SetMode(gin.TestMode)
+
+	database := mt.Client.Database(oauthTestDatabase)
+	oauthService := services.NewOAuthService(database.Collection("oauth_clients"), database.Collection("oauth_codes"), database.Collection("oauth_tokens"), database.Collection("oauth_consents"), context.Background())
+	oauthController := NewOAuthController(oauthService)
+
+	// The routes of RegisterOAuthRoutes, with the user signed in instead of the session check
+	router := gin.New()
+	oauthRoute := router.Group("/api/v1/oauth")
+	oauthRoute.POST("/token", oauthController.Token)
+	oauthRoute.POST("/introspect", oauthController.Introspect)
+	oauthRoute.POST("/revoke", oauthController.Revoke)
+	protectedRoute := oauthRoute.Group("", func(ctx *gin.Context) {
+		ctx.Set(principalKey, &models.Principal{UserID: oauthTestUserID})
+	})
+	protectedRoute.POST("/authorize", oauthController.Authorize)
+
+	server := httptest.NewServer(router)
+	mt.Cleanup(server.Close)
+	return &oauthTestServer{mt: mt, server: server}
+}
+
+// document converts the value to the document the database would return.
+func (s *oauthTestServer) document(value interface{}) bson.D {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		s.mt.Fatal(err)
+	}
+	var document bson.D
+	if err := bson.Unmarshal(data, &document); err != nil {
+		s.mt.Fatal(err)
+	}
+	return document
+}
+
+func (s *oauthTestServer) found(collection string, documents ...interface{}) bson.D {
+	batch := make([]bson.D, len(documents))
+	for i, document := range documents {
+		batch[i] = s.document(document)
+	}
+	return mtest.CreateCursorResponse(0, oauthTestDatabase+"."+collection, mtest.FirstBatch, batch...)
+}
+
+func (s *oauthTestServer) written() bson.D {
+	return mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1})
+}
+
+func (s *oauthTestServer) modified(document interface{}) bson.D {
+	if document == nil {
+		return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: nil})
+	}
+	return mtest.CreateSuccessResponse(bson.E{Key: "value", Value: s.document(document)})
+}
+
+// command returns the first recorded command with the given name on the given collection.
+func (s *oauthTestServer) command(name string, collection string) bson.Raw {
+	for _, started := range s.mt.GetAllStartedEvents() {
+		if started.CommandName != name {
+			continue
+		}
+		if value, err := started.Command.LookupErr(name); err == nil && value.StringValue() == collection {
+			return started.Command
+		}
+	}
+	return nil
+}
+
+// inserted returns the document the last request inserted into the given collection.
+func (s *oauthTestServer) inserted(collection string, value interface{}) {
+	command := s.command("insert", collection)
+	if command == nil {
+		s.mt.Fatalf("nothing was inserted into %s", collection)
+	}
+	documents, err := command.Lookup("documents").Array().Values()
+	if err != nil || len(documents) != 1 {
+		s.mt.Fatalf("unexpected insert into %s: %v", collection, command)
+	}
+	if err := documents[0].Unmarshal(value); err != nil {
+		s.mt.Fatal(err)
+	}
+}
+
+func (s *oauthTestServer) do(request *http.Request, responses ...bson.D) (int, map[string]interface{}) {
+	s.mt.ClearEvents()
+	s.mt.ClearMockResponses()
+	s.mt.AddMockResponses(responses...)
+
+	response, err := s.server.Client().Do(request)
+	if err != nil {
+		s.mt.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	body := map[string]interface{}{}
+	if err := json.NewDecoder(response.Body).Decode(&body); err != nil && response.ContentLength != 0 {
+		s.mt.Fatalf("%s %s returned invalid JSON: %v", request.Method, request.URL.Path, err)
+	}
+	return response.StatusCode, body
+}
+
+func (s *oauthTestServer) postJSON(path string, value interface{}, responses ...bson.D) (int, map[string]interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		s.mt.Fatal(err)
+	}
+	request, _ := http.NewRequest(http.MethodPost, s.server.URL+"/api/v1/oauth"+path, strings.NewReader(string(data)))
+	request.Header.Set("Content-Type", "application/json")
+	return s.do(request, responses...)
+}
+
+// postForm sends the form as a client would. The client authenticates with Basic
+// authentication if it has a secret.
+func (s *oauthTestServer) postForm(path string, client models.OAuthClient, secret string, form url.Values, responses ...bson.D) (int, map[string]interface{}) {
+	if secret == "" {
+		form.Set("client_id", client.ClientID)
+	}
+	request, _ := http.NewRequest(http.MethodPost, s.server.URL+"/api/v1/oauth"+path, strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if secret != "" {
+		request.SetBasicAuth(client.ClientID, secret)
+	}
+	return s.do(request, responses...)
+}
+
+func pkceChallenge(verifier string) string {
+	hashed := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hashed[:])
+}
+
+func oauthAuthorizeRequest(client models.OAuthClient) *models.OAuthAuthorizeRequest {
+	return &models.OAuthAuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            client.ClientID,
+		RedirectURI:         oauthTestRedirectURI,
+		Scope:               string(models.ScopeProductsRead),
+		State:               "af0ifjsldkj",
+		CodeChallenge:       pkceChallenge(oauthTestCodeVerifier),
+		CodeChallengeMethod: security.PKCEMethodS256,
+		Approve:             true,
+	}
+}
+
+// authorize approves the request and returns the redirect URI and the stored code.
+func (s *oauthTestServer) authorize(client models.OAuthClient, request *models.OAuthAuthorizeRequest) (*url.URL, *models.OAuthAuthorizationCode) {
+	status, body := s.postJSON("/authorize", request, s.found("oauth_clients", client), s.written(), s.written())
+	if status != http.StatusOK {
+		s.mt.Fatalf("authorize returned %d: %v", status, body)
+	}
+	redirectURI, err := url.Parse(body["message"].(string))
+	if err != nil {
+		s.mt.Fatal(err)
+	}
+
+	var code models.OAuthAuthorizationCode
+	s.inserted("oauth_codes", &code)
+	return redirectURI, &code
+}
+
+// exchangeCode posts the authorization code to the token endpoint. The stored code is
+// returned if it is still unused, otherwise the database finds nothing.
+func (s *oauthTestServer) exchangeCode(client models.OAuthClient, form url.Values, stored *models.OAuthAuthorizationCode) (int, map[string]interface{}) {
+	form.Set("grant_type", services.GrantTypeAuthorizationCode)
+	var storedCode interface{}
+	if stored != nil {
+		storedCode = stored
+	}
+	return s.postForm("/token", client, "", form, s.found("oauth_clients", client), s.modified(storedCode), s.written())
+}
+
+func TestOAuthAuthorizationCodeWithPKCE(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("exchange", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		redirectURI, storedCode := s.authorize(oauthPublicClient, oauthAuthorizeRequest(oauthPublicClient))
+		if got := redirectURI.Scheme + "://" + redirectURI.Host + redirectURI.Path; got != oauthTestRedirectURI {
+			t.Errorf("redirected to %s, want %s", got, oauthTestRedirectURI)
+		}
+		if state := redirectURI.Query().Get("state"); state != "af0ifjsldkj" {
+			t.Errorf("state = %q, want the one of the request", state)
+		}
+		code := redirectURI.Query().Get("code")
+		if code == "" {
+			t.Fatalf("no code in %s", redirectURI)
+		}
+
+		// Only the hash of the code is stored, together with the challenge
+		if storedCode.CodeHash != security.HashToken(code) {
+			t.Error("the stored code hash does not match the issued code")
+		}
+		if storedCode.CodeChallenge != pkceChallenge(oauthTestCodeVerifier) || storedCode.CodeChallengeMethod != security.PKCEMethodS256 {
+			t.Errorf("stored challenge = %q %q", storedCode.CodeChallenge, storedCode.CodeChallengeMethod)
+		}
+		if !storedCode.ExpiresAt.After(time.Now()) {
+			t.Error("the stored code has already expired")
+		}
+
+		form := url.Values{}
+		form.Set("code", code)
+		form.Set("redirect_uri", oauthTestRedirectURI)
+		form.Set("code_verifier", oauthTestCodeVerifier)
+		status, body := s.exchangeCode(oauthPublicClient, form, storedCode)
+		if status != http.StatusOK {
+			t.Fatalf("token returned %d: %v", status, body)
+		}
+		if body["token_type"] != "Bearer" || body["scope"] != string(models.ScopeProductsRead) {
+			t.Errorf("unexpected token response: %v", body)
+		}
+
+		claims, err := security.ParseRawToken(body["access_token"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (*claims)["client_id"] != oauthPublicClient.ClientID || (*claims)["sub"] != oauthTestUserID {
+			t.Errorf("unexpected access token claims: %v", *claims)
+		}
+
+		// The code is used up in the same query which looks it up, so it works only once
+		// and only until it expires
+		command := s.command("findAndModify", "oauth_codes")
+		if command == nil {
+			t.Fatal("the code was not looked up")
+		}
+		query := command.Lookup("query").Document()
+		if query.Lookup("code_hash").StringValue() != security.HashToken(code) {
+			t.Error("the code was not looked up by its hash")
+		}
+		if query.Lookup("used_at").Type != bsontype.Null {
+			t.Error("used codes are not excluded")
+		}
+		if _, err := query.LookupErr("expires_at", "$gt"); err != nil {
+			t.Error("expired codes are not excluded")
+		}
+		if _, err := command.LookupErr("update", "$set", "used_at"); err != nil {
+			t.Error("the code is not marked as used")
+		}
+	})
+}
+
+func TestOAuthAuthorizationCodeRejected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name     string
+		stored   bool
+		form     map[string]string
+		wantCode string
+	}{
+		{
+			name:     "used or expired code",
+			stored:   false,
+			form:     map[string]string{"redirect_uri": oauthTestRedirectURI, "code_verifier": oauthTestCodeVerifier},
+			wantCode: "invalid_grant",
+		},
+		{
+			name:     "redirect uri mismatch",
+			stored:   true,
+			form:     map[string]string{"redirect_uri": "https://app.example.com/other", "code_verifier": oauthTestCodeVerifier},
+			wantCode: "invalid_grant",
+		},
+		{
+			name:     "missing code verifier",
+			stored:   true,
+			form:     map[string]string{"redirect_uri": oauthTestRedirectURI},
+			wantCode: "invalid_grant",
+		},
+		{
+			name:     "wrong code verifier",
+			stored:   true,
+			form:     map[string]string{"redirect_uri": oauthTestRedirectURI, "code_verifier": strings.Repeat("a", 43)},
+			wantCode: "invalid_grant",
+		},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			s := newOAuthTestServer(mt)
+
+			redirectURI, storedCode := s.authorize(oauthPublicClient, oauthAuthorizeRequest(oauthPublicClient))
+			form := url.Values{}
+			form.Set("code", redirectURI.Query().Get("code"))
+			for key, value := range test.form {
+				form.Set(key, value)
+			}
+			if !test.stored {
+				storedCode = nil
+			}
+
+			status, body := s.exchangeCode(oauthPublicClient, form, storedCode)
+			if status != http.StatusBadRequest || body["error"] != test.wantCode {
+				t.Errorf("token returned %d %v, want %d %s", status, body, http.StatusBadRequest, test.wantCode)
+			}
+			if s.command("insert", "oauth_tokens") != nil {
+				t.Error("a token was issued")
+			}
+		})
+	}
+}
+
+func TestOAuthAuthorizationCodeDefaultRedirectURI(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name          string
+		authorizeURI  string
+		tokenURI      string
+		wantStatus    int
+		wantDefaulted bool
+	}{
+		{"left out in both requests", "", "", http.StatusOK, true},
+		{"left out when authorizing", "", oauthTestRedirectURI, http.StatusOK, true},
+		{"other uri when exchanging", "", "https://app.example.com/other", http.StatusBadRequest, true},
+		{"left out when exchanging", oauthTestRedirectURI, "", http.StatusBadRequest, false},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			s := newOAuthTestServer(mt)
+
+			request := oauthAuthorizeRequest(oauthPublicClient)
+			request.RedirectURI = test.authorizeURI
+			redirectURI, storedCode := s.authorize(oauthPublicClient, request)
+			if storedCode.RedirectURI != oauthTestRedirectURI || storedCode.RedirectURIDefaulted != test.wantDefaulted {
+				t.Errorf("stored redirect uri = %q, defaulted %v", storedCode.RedirectURI, storedCode.RedirectURIDefaulted)
+			}
+
+			form := url.Values{}
+			form.Set("code", redirectURI.Query().Get("code"))
+			form.Set("code_verifier", oauthTestCodeVerifier)
+			if test.tokenURI != "" {
+				form.Set("redirect_uri", test.tokenURI)
+			}
+			status, body := s.exchangeCode(oauthPublicClient, form, storedCode)
+			if status != test.wantStatus {
+				t.Errorf("token returned %d %v, want %d", status, body, test.wantStatus)
+			}
+		})
+	}
+}
+
+func TestOAuthAuthorizeRejected(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("redirect uri mismatch", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		// The user must not be redirected to an unregistered URI, not even with an error
+		request := oauthAuthorizeRequest(oauthPublicClient)
+		request.RedirectURI = "https://attacker.example.com/callback"
+		status, body := s.postJSON("/authorize", request, s.found("oauth_clients", oauthPublicClient))
+		if status != http.StatusBadRequest || body["message"] != "invalid_request" {
+			t.Errorf("authorize returned %d %v, want %d invalid_request", status, body, http.StatusBadRequest)
+		}
+		if s.command("insert", "oauth_codes") != nil {
+			t.Error("a code was issued")
+		}
+	})
+
+	mt.Run("public client without pkce", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		request := oauthAuthorizeRequest(oauthPublicClient)
+		request.CodeChallenge = ""
+		request.CodeChallengeMethod = ""
+		status, body := s.postJSON("/authorize", request, s.found("oauth_clients", oauthPublicClient))
+		if status != http.StatusOK {
+			t.Fatalf("authorize returned %d: %v", status, body)
+		}
+		redirectURI, err := url.Parse(body["message"].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if redirectURI.Query().Get("error") != "invalid_request" || redirectURI.Query().Get("code") != "" {
+			t.Errorf("redirected to %s, want an invalid_request error", redirectURI)
+		}
+		if s.command("insert", "oauth_codes") != nil {
+			t.Error("a code was issued")
+		}
+	})
+
+	mt.Run("plain pkce method", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		request := oauthAuthorizeRequest(oauthPublicClient)
+		request.CodeChallenge = oauthTestCodeVerifier
+		request.CodeChallengeMethod = "plain"
+		status, body := s.postJSON("/authorize", request, s.found("oauth_clients", oauthPublicClient))
+		if status != http.StatusOK {
+			t.Fatalf("authorize returned %d: %v", status, body)
+		}
+		redirectURI, _ := url.Parse(body["message"].(string))
+		if redirectURI.Query().Get("error") != "invalid_request" {
+			t.Errorf("redirected to %s, want an invalid_request error", redirectURI)
+		}
+	})
+}
+
+// issueClientCredentialsToken returns the access token and the stored record of it.
+func (s *oauthTestServer) issueClientCredentialsToken() (string, *models.OAuthToken) {
+	form := url.Values{}
+	form.Set("grant_type", services.GrantTypeClientCredentials)
+	status, body := s.postForm("/token", oauthConfidentialClient, oauthTestClientSecret, form, s.found("oauth_clients", oauthConfidentialClient), s.written())
+	if status != http.StatusOK {
+		s.mt.Fatalf("token returned %d: %v", status, body)
+	}
+
+	var token models.OAuthToken
+	s.inserted("oauth_tokens", &token)
+	return body["access_token"].(string), &token
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("confidential client", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		accessToken, token := s.issueClientCredentialsToken()
+		if token.ClientID != oauthConfidentialClient.ClientID || token.UserID != oauthTestUserID || token.GrantType != services.GrantTypeClientCredentials {
+			t.Errorf("unexpected stored token: %+v", token)
+		}
+		claims, err := security.ParseRawToken(accessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (*claims)["jti"] != token.ID.Hex() || (*claims)["scope"] != string(models.ScopeProductsRead) {
+			t.Errorf("unexpected access token claims: %v", *claims)
+		}
+	})
+
+	mt.Run("wrong secret", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		form := url.Values{}
+		form.Set("grant_type", services.GrantTypeClientCredentials)
+		status, body := s.postForm("/token", oauthConfidentialClient, "wrong-secret", form, s.found("oauth_clients", oauthConfidentialClient))
+		if status != http.StatusUnauthorized || body["error"] != "invalid_client" {
+			t.Errorf("token returned %d %v, want %d invalid_client", status, body, http.StatusUnauthorized)
+		}
+	})
+
+	mt.Run("public client", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		form := url.Values{}
+		form.Set("grant_type", services.GrantTypeClientCredentials)
+		status, body := s.postForm("/token", oauthPublicClient, "", form, s.found("oauth_clients", oauthPublicClient))
+		if status != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+			t.Errorf("token returned %d %v, want %d unauthorized_client", status, body, http.StatusBadRequest)
+		}
+	})
+
+	mt.Run("scope not allowed", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		form := url.Values{}
+		form.Set("grant_type", services.GrantTypeClientCredentials)
+		form.Set("scope", string(models.ScopeOrdersRead))
+		status, body := s.postForm("/token", oauthConfidentialClient, oauthTestClientSecret, form, s.found("oauth_clients", oauthConfidentialClient))
+		if status != http.StatusBadRequest || body["error"] != "invalid_scope" {
+			t.Errorf("token returned %d %v, want %d invalid_scope", status, body, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestOAuthIntrospectAndRevoke(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("introspect and revoke", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+		accessToken, token := s.issueClientCredentialsToken()
+
+		form := url.Values{}
+		form.Set("token", accessToken)
+		status, body := s.postForm("/introspect", oauthConfidentialClient, oauthTestClientSecret, form, s.found("oauth_clients", oauthConfidentialClient), s.found("oauth_tokens", token))
+		if status != http.StatusOK || body["active"] != true {
+			t.Fatalf("introspect returned %d %v, want an active token", status, body)
+		}
+		if body["client_id"] != oauthConfidentialClient.ClientID || body["sub"] != oauthTestUserID || body["scope"] != string(models.ScopeProductsRead) {
+			t.Errorf("unexpected introspection: %v", body)
+		}
+
+		status, body = s.postForm("/revoke", oauthConfidentialClient, oauthTestClientSecret, form, s.found("oauth_clients", oauthConfidentialClient), s.found("oauth_tokens", token), s.written())
+		if status != http.StatusOK {
+			t.Fatalf("revoke returned %d: %v", status, body)
+		}
+		command := s.command("update", "oauth_tokens")
+		if command == nil {
+			t.Fatal("the token was not revoked")
+		}
+		update := command.Lookup("updates").Array().Index(0).Value().Document()
+		if id, ok := update.Lookup("q", "_id").ObjectIDOK(); !ok || id != token.ID {
+			t.Errorf("revoked %v, want the token %s", update.Lookup("q"), token.ID.Hex())
+		}
+		if _, err := update.LookupErr("u", "$set", "revoked_at"); err != nil {
+			t.Error("revoked_at is not set")
+		}
+
+		revokedAt := time.Now()
+		token.RevokedAt = &revokedAt
+		status, body = s.postForm("/introspect", oauthConfidentialClient, oauthTestClientSecret, form, s.found("oauth_clients", oauthConfidentialClient), s.found("oauth_tokens", token))
+		if status != http.StatusOK || body["active"] != false || len(body) != 1 {
+			t.Errorf("introspect returned %d %v, want only an inactive token", status, body)
+		}
+	})
+
+	mt.Run("token of another client", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+		accessToken, token := s.issueClientCredentialsToken()
+
+		otherClient := oauthConfidentialClient
+		otherClient.ClientID = "other-client"
+		form := url.Values{}
+		form.Set("token", accessToken)
+		status, body := s.postForm("/introspect", otherClient, oauthTestClientSecret, form, s.found("oauth_clients", otherClient), s.found("oauth_tokens", token))
+		if status != http.StatusOK || body["active"] != false {
+			t.Errorf("introspect returned %d %v, want an inactive token", status, body)
+		}
+
+		// Revoking an unknown token is not an error, but nothing is revoked
+		status, _ = s.postForm("/revoke", otherClient, oauthTestClientSecret, form, s.found("oauth_clients", otherClient), s.found("oauth_tokens", token))
+		if status != http.StatusOK {
+			t.Errorf("revoke returned %d, want %d", status, http.StatusOK)
+		}
+		if s.command("update", "oauth_tokens") != nil {
+			t.Error("the token of another client was revoked")
+		}
+	})
+
+	mt.Run("public client cannot introspect", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+
+		form := url.Values{}
+		form.Set("token", "anything")
+		status, body := s.postForm("/introspect", oauthPublicClient, "", form, s.found("oauth_clients", oauthPublicClient))
+		if status != http.StatusBadRequest || body["error"] != "unauthorized_client" {
+			t.Errorf("introspect returned %d %v, want %d unauthorized_client", status, body, http.StatusBadRequest)
+		}
+	})
+}
+
+func TestOAuthRevokeGrantsOfUser(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("deleted account", func(mt *mtest.T) {
+		s := newOAuthTestServer(mt)
+		database := mt.Client.Database(oauthTestDatabase)
+		oauthService := services.NewOAuthService(database.Collection("oauth_clients"), database.Collection("oauth_codes"), database.Collection("oauth_tokens"), database.Collection("oauth_consents"), context.Background())
+
+		mt.ClearEvents()
+		mt.AddMockResponses(
+			s.written(), s.written(), s.written(),
+			s.found("oauth_clients", oauthConfidentialClient),
+			s.written(), s.written(), s.written(),
+		)
+		userId := oauthTestUserID
+		if err := oauthService.RevokeGrantsOfUser(&userId); err != nil {
+			t.Fatal(err)
+		}
+
+		// The tokens of the user are revoked, whichever client they were issued to
+		command := s.command("update", "oauth_tokens")
+		if command == nil {
+			t.Fatal("the tokens of the user were not revoked")
+		}
+		update := command.Lookup("updates").Array().Index(0).Value().Document()
+		if userIdValue, ok := update.Lookup("q", "user_id").StringValueOK(); !ok || userIdValue != oauthTestUserID {
+			t.Errorf("revoked %v, want the tokens of the user", update.Lookup("q"))
+		}
+		for _, collection := range []string{"oauth_consents", "oauth_codes", "oauth_clients"} {
+			if s.command("delete", collection) == nil {
+				t.Errorf("nothing was deleted from %s", collection)
+			}
+		}
+	})
+}
@@ -1,10 +1,7 @@
 package controllers
 
 import (
-	"fmt"
-	"io"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -12,41 +9,54 @@ import (
 	"github.com/akunsecured/emezen_api/security"
 	"github.com/akunsecured/emezen_api/services"
 	"github.com/akunsecured/emezen_api/utils"
-	"github.com/form3tech-oss/jwt-go"
 	"github.com/gin-gonic/gin"
 )
 
 type ProductController struct {
 	productService services.ProductService
+	auditService   services.AuditService
+	blobStore      services.BlobStore
+	imageService   services.ImageService
+	storageService services.StorageService
+	assetURLPolicy models.AssetURLPolicy
 }
 
-func NewProductController(productService services.ProductService) ProductController {
+func NewProductController(productService services.ProductService, auditService services.AuditService, blobStore services.BlobStore, imageService services.ImageService, storageService services.StorageService, assetURLPolicy models.AssetURLPolicy) ProductController {
 	return ProductController{
 		productService: productService,
+		auditService:   auditService,
+		blobStore:      blobStore,
+		imageService:   imageService,
+		storageService: storageService,
+		assetURLPolicy: assetURLPolicy,
 	}
 }
 
-func (pc *ProductController) CheckHeaderAuthorization(ctx *gin.Context) (*jwt.MapClaims, error) {
-	tokenStr := ctx.GetHeader("Authorization")
-	if tokenStr == "" {
-		return nil, utils.ErrMissingAuthToken
+// auditOwnershipCheck will record the outcome of the ownership check of the product in the
+// audit log, so attempts to change other people's products can be found.
+func (pc *ProductController) auditOwnershipCheck(ctx *gin.Context, eventType string, productId string, allowed bool) {
+	var err error
+	if !allowed {
+		err = utils.ErrForbidden
 	}
-
-	claims, err := security.ParseToken(tokenStr)
-	if err != nil {
-		return nil, err
-	}
-
-	return claims, nil
+	event := &models.AuditEvent{Type: eventType, ActorID: GetPrincipal(ctx).UserID, TargetID: productId}
+	pc.auditService.Record(event, GetRequestInfo(ctx), err)
 }
 
 func (pc *ProductController) CreateProduct(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
+
 	var product models.Product
 	if err := ctx.ShouldBindJSON(&product); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
 
+	// The seller is always the authenticated user, whatever the client sent. Images can only
+	// be added by uploading them, so they are charged to the seller and checked.
+	product.SellerID = principal.UserID
+	product.Images = nil
+
 	if err := validate.Struct(&product); err != nil {
 		err = utils.ErrInvalidProductFormat
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
@@ -55,7 +65,12 @@ func (pc *ProductController) CreateProduct(ctx *gin.Context) {
 
 	productId, err := pc.productService.AddProduct(&product)
 	if err != nil {
-		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		switch err {
+		case utils.ErrEmailIsNotVerified, utils.ErrSellerRoleRequired:
+			ctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
 
@@ -63,19 +78,13 @@ func (pc *ProductController) CreateProduct(ctx *gin.Context) {
 }
 
 func (pc *ProductController) GetProduct(ctx *gin.Context) {
-	_, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
-
 	productId := ctx.Param("id")
 	product, err := pc.productService.GetProduct(&productId)
 	if err != nil {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": product})
+	ctx.JSON(http.StatusOK, gin.H{"message": withImageURLs(pc.assetURLPolicy, product)})
 }
 
 func containsInt(s []int64, e int64) bool {
@@ -87,13 +96,16 @@ func containsInt(s []int64, e int64) bool {
 	return false
 }
 
-func (pc *ProductController) GetAllProducts(ctx *gin.Context) {
-	_, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
+func containsString(s []string, e string) bool {
+	for _, a := range s {
+		if a == e {
+			return true
+		}
 	}
+	return false
+}
 
+func (pc *ProductController) GetAllProducts(ctx *gin.Context) {
 	nameFilter := ctx.Query("name")
 
 	categoryQuery := ctx.Query("categories")
@@ -107,6 +119,7 @@ func (pc *ProductController) GetAllProducts(ctx *gin.Context) {
 		}
 	}
 
+	var err error
 	priceFromQuery := ctx.Query("price_from")
 	priceFromFilter := 0.0
 	if priceFromQuery != "" {
@@ -138,11 +151,11 @@ func (pc *ProductController) GetAllProducts(ctx *gin.Context) {
 		if strings.Contains(product.Name, nameFilter) {
 			if product.Price >= float32(priceFromFilter) && product.Price <= float32(priceToFilter) {
 				if len(categoryFilter) == 0 {
-					results = append(results, product)
+					results = append(results, withImageURLs(pc.assetURLPolicy, product))
 				} else {
 					for _, category := range categoryFilter {
 						if product.Category == models.Category(category) {
-							results = append(results, product)
+							results = append(results, withImageURLs(pc.assetURLPolicy, product))
 						}
 					}
 				}
@@ -154,11 +167,7 @@ func (pc *ProductController) GetAllProducts(ctx *gin.Context) {
 }
 
 func (pc *ProductController) UpdateProduct(ctx *gin.Context) {
-	claims, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
 	productId := ctx.Param("id")
 	oldProduct, err := pc.productService.GetProduct(&productId)
@@ -166,9 +175,9 @@ func (pc *ProductController) UpdateProduct(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-	userId := (*claims)["sub"].(string)
-
-	if oldProduct.SellerID != userId {
+	allowed := security.CanUpdateProduct(principal, oldProduct)
+	pc.auditOwnershipCheck(ctx, models.AuditProductUpdate, productId, allowed)
+	if !allowed {
 		ctx.JSON(http.StatusUnauthorized, gin.H{"message": "tried to update other people's product"})
 		return
 	}
@@ -186,6 +195,9 @@ func (pc *ProductController) UpdateProduct(ctx *gin.Context) {
 	}
 
 	product.ID = oldProduct.ID
+	product.SellerID = oldProduct.SellerID
+	// The images are managed by the image endpoints, so unused files can be deleted
+	product.Images = oldProduct.Images
 
 	err = pc.productService.UpdateProduct(&product)
 	if err != nil {
@@ -197,11 +209,7 @@ func (pc *ProductController) UpdateProduct(ctx *gin.Context) {
 }
 
 func (pc *ProductController) DeleteProduct(ctx *gin.Context) {
-	claims, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
 	productId := ctx.Param("id")
 	product, err := pc.productService.GetProduct(&productId)
@@ -209,9 +217,9 @@ func (pc *ProductController) DeleteProduct(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-	userId := (*claims)["sub"].(string)
-
-	if product.SellerID != userId {
+	allowed := security.CanDeleteProduct(principal, product)
+	pc.auditOwnershipCheck(ctx, models.AuditProductDelete, productId, allowed)
+	if !allowed {
 		ctx.JSON(http.StatusUnauthorized, gin.H{"message": "tried to delete other people's product"})
 		return
 	}
@@ -226,11 +234,7 @@ func (pc *ProductController) DeleteProduct(ctx *gin.Context) {
 }
 
 func (pc *ProductController) UploadProductImages(ctx *gin.Context) {
-	claims, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
 	productId := ctx.Param("id")
 	product, err := pc.productService.GetProduct(&productId)
@@ -238,112 +242,212 @@ func (pc *ProductController) UploadProductImages(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-	userId := (*claims)["sub"].(string)
-
-	if product.SellerID != userId {
+	allowed := security.CanUpdateProduct(principal, product)
+	pc.auditOwnershipCheck(ctx, models.AuditProductUpdate, productId, allowed)
+	if !allowed {
 		ctx.JSON(http.StatusUnauthorized, gin.H{"message": "tried to update other people's product"})
 		return
 	}
 
-	form, err := ctx.MultipartForm()
+	images, ok := multipartFiles(ctx, "product_pictures")
+	if !ok {
+		return
+	}
+
+	// Only the accepted images take a place, the ones over the limit are rejected one by one
+	maxImages := pc.storageService.GetPolicy().MaxImagesPerProduct
+	if maxImages > 0 && len(product.Images) >= maxImages {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrTooManyProductImages.Error()})
+		return
+	}
+	// The images are charged to the seller, even if an admin uploads them
+	reserved, ok := reserveUpload(ctx, pc.storageService, product.SellerID, len(images), uploadSize(images))
+	if !ok {
+		return
+	}
+
+	result := pc.imageService.SaveImages(models.ProductPicturesPrefix, images, product.Images, maxImages)
+	if len(result.Stored) == 0 {
+		releaseUpload(pc.storageService, product.SellerID, reserved)
+		ctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": result})
+		return
+	}
+
+	for _, storedImage := range result.Stored {
+		storedImage.URL = productImageURL(pc.assetURLPolicy, storedImage.Key)
+		// The same file always gets the same key, so uploading it again must not list it
+		// twice, otherwise the images could not be reordered anymore
+		if !containsString(product.Images, storedImage.Key) {
+			product.Images = append(product.Images, storedImage.Key)
+		}
+	}
+	err = pc.productService.UpdateProduct(product)
 	if err != nil {
+		releaseUpload(pc.storageService, product.SellerID, reserved)
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
+	recordUploads(pc.storageService, product.SellerID, reserved, result.Stored)
+	for _, storedImage := range result.Stored {
+		pc.imageService.GenerateVariants(storedImage.Key)
+	}
 
-	images := form.File["product_pictures"]
-	if len(images) == 0 {
-		ctx.JSON(http.StatusNotFound, gin.H{"message": "No pictures were uploaded"})
+	ctx.JSON(http.StatusOK, gin.H{"message": result})
+}
+
+// productForImageUpdate will return the product with the ID in the path if the principal can
+// update it. Otherwise it responds with the error itself.
+func (pc *ProductController) productForImageUpdate(ctx *gin.Context) (*models.Product, bool) {
+	principal := GetPrincipal(ctx)
+
+	productId := ctx.Param("id")
+	product, err := pc.productService.GetProduct(&productId)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return nil, false
+	}
+	allowed := security.CanUpdateProduct(principal, product)
+	pc.auditOwnershipCheck(ctx, models.AuditProductUpdate, productId, allowed)
+	if !allowed {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"message": "tried to update other people's product"})
+		return nil, false
+	}
+	return product, true
+}
+
+func respondWithProductImageError(ctx *gin.Context, err error) {
+	switch err {
+	case utils.ErrProductImageNotFound:
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+	case utils.ErrInvalidImageOrder:
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+	default:
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+	}
+}
+
+func (pc *ProductController) DeleteProductImage(ctx *gin.Context) {
+	product, ok := pc.productForImageUpdate(ctx)
+	if !ok {
 		return
 	}
 
-	fileNames := make([]string, len(images))
-	for i, image := range images {
-		fileName := image.Filename
-		fileNames[i] = "http://localhost:8080/api/v1/product/image/" + fileName
+	fileName := ctx.Param("filename")
+	if err := pc.productService.DeleteProductImage(product, &fileName); err != nil {
+		respondWithProductImageError(ctx, err)
+		return
+	}
 
-		fmt.Println("File with name " + fileName + " is arrived.")
-		filePath := "images/product_pictures/" + fileName
+	ctx.JSON(http.StatusOK, gin.H{"message": withImageURLs(pc.assetURLPolicy, product).Images})
+}
 
-		file, err := image.Open()
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
-			return
-		}
+func (pc *ProductController) ReorderProductImages(ctx *gin.Context) {
+	product, ok := pc.productForImageUpdate(ctx)
+	if !ok {
+		return
+	}
 
-		out, err := os.Create(filePath)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
-			return
-		}
+	var order models.ProductImageOrder
+	if err := ctx.ShouldBindJSON(&order); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if err := validate.Struct(&order); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": utils.ErrInvalidImageOrder.Error()})
+		return
+	}
 
-		defer out.Close()
+	if err := pc.productService.ReorderProductImages(product, &order); err != nil {
+		respondWithProductImageError(ctx, err)
+		return
+	}
 
-		_, err = io.Copy(out, file)
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
-			return
-		}
+	ctx.JSON(http.StatusOK, gin.H{"message": withImageURLs(pc.assetURLPolicy, product).Images})
+}
+
+func (pc *ProductController) SetPrimaryProductImage(ctx *gin.Context) {
+	product, ok := pc.productForImageUpdate(ctx)
+	if !ok {
+		return
 	}
 
-	product.Images = append(product.Images, fileNames...)
-	pc.productService.UpdateProduct(product)
+	fileName := ctx.Param("filename")
+	if err := pc.productService.SetPrimaryProductImage(product, &fileName); err != nil {
+		respondWithProductImageError(ctx, err)
+		return
+	}
 
-	ctx.JSON(http.StatusOK, gin.H{"message": true})
+	ctx.JSON(http.StatusOK, gin.H{"message": withImageURLs(pc.assetURLPolicy, product).Images})
 }
 
+// GetProductImage serves a resized variant of the image if the size query parameter is
+// given, in WebP if the format query parameter asks for it. Until the variant is generated,
+// the original image is served, which must not be cached as the variant.
 func (pc *ProductController) GetProductImage(ctx *gin.Context) {
 	filename := ctx.Param("filename")
 
-	ctx.File("images/product_pictures/" + filename)
-}
-
-func (pc *ProductController) GetAllProductsOfUser(ctx *gin.Context) {
-	_, err := pc.CheckHeaderAuthorization(ctx)
+	key, final, err := pc.imageService.GetVariantKey(models.ProductPicturesPrefix+filename, ctx.Query("size"), ctx.Query("format"))
 	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		switch err {
+		case utils.ErrUnknownImageSize, utils.ErrUnknownImageFormat:
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		case utils.ErrInvalidBlobKey:
+			ctx.JSON(http.StatusNotFound, gin.H{"message": utils.ErrBlobNotFound.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
 
+	cacheControl := immutableCacheControl
+	if !final {
+		cacheControl = revalidateCacheControl
+	}
+	serveBlob(ctx, pc.blobStore, key, cacheControl)
+}
+
+func (pc *ProductController) GetAllProductsOfUser(ctx *gin.Context) {
 	userId := ctx.Param("id")
 	products, err := pc.productService.GetAllProductsOfUser(&userId)
 	if err != nil {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-	ctx.JSON(http.StatusOK, gin.H{"message": products})
+
+	var results []*models.Product
+	for _, product := range products {
+		results = append(results, withImageURLs(pc.assetURLPolicy, product))
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": results})
 }
 
 func (pc *ProductController) BuyProducts(ctx *gin.Context) {
-	claims, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
 	var cart *map[string]int32
 	if err := ctx.ShouldBindJSON(&cart); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
 		return
 	}
-	userId := (*claims)["sub"].(string)
+	userId := principal.UserID
 
-	err = pc.productService.BuyProducts(cart, &userId)
+	err := pc.productService.BuyProducts(cart, &userId)
 	if err != nil {
-		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		switch err {
+		case utils.ErrEmailIsNotVerified:
+			ctx.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
 	ctx.JSON(http.StatusOK, gin.H{"message": "Products were bought successfully"})
 }
 
 func (pc *ProductController) GetProductObserverOfUser(ctx *gin.Context) {
-	claims, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
-	userId := (*claims)["sub"].(string)
+	userId := principal.UserID
 
 	productObserver, err := pc.productService.GetProductObserverOfUser(&userId)
 	if err != nil {
@@ -354,12 +458,6 @@ func (pc *ProductController) GetProductObserverOfUser(ctx *gin.Context) {
 }
 
 func (pc *ProductController) UpdateProductObserver(ctx *gin.Context) {
-	_, err := pc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
-
 	var productObserver *models.ProductObserver
 	if err := ctx.ShouldBindJSON(&productObserver); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
@@ -375,17 +473,26 @@ func (pc *ProductController) UpdateProductObserver(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": updatedProductObserver})
 }
 
-func (pc *ProductController) RegisterProductRoutes(rg *gin.RouterGroup) {
+func (pc *ProductController) RegisterProductRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
 	productRoute := rg.Group("/product")
-	productRoute.POST("/create", pc.CreateProduct)
-	productRoute.GET("/get/:id", pc.GetProduct)
-	productRoute.GET("/get_all", pc.GetAllProducts)
-	productRoute.PUT("/update/:id", pc.UpdateProduct)
-	productRoute.DELETE("/delete/:id", pc.DeleteProduct)
-	productRoute.POST("/image/:id", pc.UploadProductImages)
 	productRoute.GET("/image/:filename", pc.GetProductImage)
-	productRoute.GET("/get_all/:id", pc.GetAllProductsOfUser)
-	productRoute.POST("/buy", pc.BuyProducts)
-	productRoute.GET("/observer", pc.GetProductObserverOfUser)
-	productRoute.PUT("/observer", pc.UpdateProductObserver)
+
+	readRoute := productRoute.Group("", authMiddleware.RequireAuth(models.ScopeProductsRead))
+	readRoute.GET("/get/:id", pc.GetProduct)
+	readRoute.GET("/get_all", pc.GetAllProducts)
+	readRoute.GET("/get_all/:id", pc.GetAllProductsOfUser)
+
+	writeRoute := productRoute.Group("", authMiddleware.RequireAuth(models.ScopeProductsWrite))
+	writeRoute.POST("/create", pc.CreateProduct)
+	writeRoute.PUT("/update/:id", pc.UpdateProduct)
+	writeRoute.DELETE("/delete/:id", pc.DeleteProduct)
+	writeRoute.POST("/image/:id", LimitRequestBody(pc.imageService.GetPolicy().MaxRequestSize), pc.UploadProductImages)
+	writeRoute.DELETE("/image/:id/:filename", pc.DeleteProductImage)
+	writeRoute.PUT("/image/:id/order", pc.ReorderProductImages)
+	writeRoute.PUT("/image/:id/primary/:filename", pc.SetPrimaryProductImage)
+
+	protectedRoute := productRoute.Group("", authMiddleware.RequireAuth())
+	protectedRoute.POST("/buy", ForbidImpersonation(), pc.BuyProducts)
+	protectedRoute.GET("/observer", pc.GetProductObserverOfUser)
+	protectedRoute.PUT("/observer", pc.UpdateProductObserver)
 }
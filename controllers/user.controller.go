@@ -1,66 +1,48 @@
 package controllers
 
 import (
-	"fmt"
-	"io"
 	"net/http"
-	"os"
-
-	"github.com/akunsecured/emezen_api/security"
-	"github.com/akunsecured/emezen_api/utils"
-	"github.com/form3tech-oss/jwt-go"
 
 	"github.com/akunsecured/emezen_api/models"
 	"github.com/akunsecured/emezen_api/services"
+	"github.com/akunsecured/emezen_api/utils"
 	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 type UserController struct {
-	userService services.UserService
+	userService    services.UserService
+	authService    services.AuthService
+	blobStore      services.BlobStore
+	imageService   services.ImageService
+	storageService services.StorageService
+	assetURLPolicy models.AssetURLPolicy
 }
 
-func NewUserController(userService services.UserService) UserController {
+func NewUserController(userService services.UserService, authService services.AuthService, blobStore services.BlobStore, imageService services.ImageService, storageService services.StorageService, assetURLPolicy models.AssetURLPolicy) UserController {
 	return UserController{
-		userService: userService,
-	}
-}
-
-func (uc *UserController) CheckHeaderAuthorization(ctx *gin.Context) (*jwt.MapClaims, error) {
-	tokenStr := ctx.GetHeader("Authorization")
-	if tokenStr == "" {
-		return nil, utils.ErrMissingAuthToken
-	}
-
-	claims, err := security.ParseToken(tokenStr)
-	if err != nil {
-		return nil, err
+		userService:    userService,
+		authService:    authService,
+		blobStore:      blobStore,
+		imageService:   imageService,
+		storageService: storageService,
+		assetURLPolicy: assetURLPolicy,
 	}
-
-	return claims, nil
 }
 
 func (uc *UserController) GetUser(ctx *gin.Context) {
-	_, err := uc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
-
 	userId := ctx.Param("id")
 	user, err := uc.userService.GetUser(&userId)
 	if err != nil {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
+	user.ProfilePicture = profilePictureURL(uc.assetURLPolicy, userId)
 	ctx.JSON(http.StatusOK, gin.H{"message": user})
 }
 
 func (uc *UserController) UpdateUser(ctx *gin.Context) {
-	_, err := uc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
 	var user models.User
 	if err := ctx.ShouldBindJSON(&user); err != nil {
@@ -68,6 +50,14 @@ func (uc *UserController) UpdateUser(ctx *gin.Context) {
 		return
 	}
 
+	// Users can only update their own profile
+	userId, err := primitive.ObjectIDFromHex(principal.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+	user.ID = userId
+
 	err = uc.userService.UpdateUser(&user)
 	if err != nil {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
@@ -76,15 +66,12 @@ func (uc *UserController) UpdateUser(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"message": "Success"})
 }
 
+// DeleteUser deletes the account of the authenticated user the same way as the route of the
+// auth controller does, together with the credentials, sessions and API keys.
 func (uc *UserController) DeleteUser(ctx *gin.Context) {
-	claims, err := uc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
-		return
-	}
+	principal := GetPrincipal(ctx)
 
-	userId := (*claims)["sub"].(string)
-	err = uc.userService.DeleteUser(&userId)
+	err := uc.authService.DeleteUser(principal, GetRequestInfo(ctx))
 	if err != nil {
 		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
@@ -92,57 +79,95 @@ func (uc *UserController) DeleteUser(ctx *gin.Context) {
 	ctx.JSON(http.StatusNoContent, nil)
 }
 
+// UploadProfilePicture will replace the profile picture of the authenticated user with the
+// first uploaded image.
 func (uc *UserController) UploadProfilePicture(ctx *gin.Context) {
-	_, err := uc.CheckHeaderAuthorization(ctx)
-	if err != nil {
-		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+	principal := GetPrincipal(ctx)
+
+	images, ok := multipartFiles(ctx, "profile_picture")
+	if !ok {
 		return
 	}
 
-	file, header, err := ctx.Request.FormFile("profile_picture")
+	reserved, ok := reserveUpload(ctx, uc.storageService, principal.UserID, 1, images[0].Size, models.ProfilePictureKey(principal.UserID))
+	if !ok {
+		return
+	}
+
+	storedImage, err := uc.imageService.SaveProfilePicture(principal.UserID, images[0])
 	if err != nil {
-		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		releaseUpload(uc.storageService, principal.UserID, reserved)
+		switch err {
+		case utils.ErrFileTooLarge, utils.ErrImageTooLarge:
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": err.Error()})
+		case utils.ErrUnsupportedImageType, utils.ErrInvalidImage:
+			ctx.JSON(http.StatusUnprocessableEntity, gin.H{"message": err.Error()})
+		default:
+			ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		}
 		return
 	}
 
-	if file == nil || header == nil {
-		ctx.JSON(http.StatusBadGateway, gin.H{"message": "No files were uploaded."})
+	err = uc.userService.SetProfilePicture(&principal.UserID, storedImage.Key)
+	if err != nil {
+		releaseUpload(uc.storageService, principal.UserID, reserved)
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
+	recordUploads(uc.storageService, principal.UserID, reserved, []*models.StoredImage{storedImage})
+	storedImage.URL = profilePictureURL(uc.assetURLPolicy, principal.UserID)
 
-	fileName := header.Filename
-	fmt.Println("File with name " + fileName + " is arrived.")
+	ctx.JSON(http.StatusOK, gin.H{"message": storedImage})
+}
 
-	filePath := "images/profile_pictures/" + fileName
+// GetProfilePicture serves the uploaded profile picture of the user, or a generated one if
+// the user has not uploaded any.
+func (uc *UserController) GetProfilePicture(ctx *gin.Context) {
+	userId := ctx.Param("id")
+	key := models.ProfilePictureKey(userId)
 
-	out, err := os.Create(filePath)
-	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+	_, err := uc.blobStore.Stat(key)
+	if err == nil {
+		serveBlob(ctx, uc.blobStore, key, revalidateCacheControl)
+		return
+	}
+	if err != utils.ErrBlobNotFound && err != utils.ErrInvalidBlobKey {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
 
-	defer out.Close()
-
-	_, err = io.Copy(out, file)
+	if _, err := uc.userService.GetUser(&userId); err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": utils.ErrBlobNotFound.Error()})
+		return
+	}
+	avatar, err := uc.imageService.DefaultAvatar(userId)
 	if err != nil {
-		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
 		return
 	}
-
-	ctx.JSON(http.StatusOK, gin.H{"message": true})
+	serveBytes(ctx, avatar, "image/png", revalidateCacheControl)
 }
 
-func (uc *UserController) GetProfilePicture(ctx *gin.Context) {
-	userId := ctx.Param("id")
+// GetStorageUsage returns how much of the storage quota the authenticated user has used.
+func (uc *UserController) GetStorageUsage(ctx *gin.Context) {
+	principal := GetPrincipal(ctx)
 
-	ctx.File("images/profile_pictures/" + userId + ".png")
+	usage, err := uc.storageService.GetUsage(principal.UserID)
+	if err != nil {
+		ctx.JSON(http.StatusBadGateway, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": usage})
 }
 
-func (uc *UserController) RegisterUserRoutes(rg *gin.RouterGroup) {
+func (uc *UserController) RegisterUserRoutes(rg *gin.RouterGroup, authMiddleware *AuthMiddleware) {
 	userRoute := rg.Group("/user")
-	userRoute.GET("/get/:id", uc.GetUser)
-	userRoute.PUT("/update", uc.UpdateUser)
-	userRoute.DELETE("/delete", uc.DeleteUser)
-	userRoute.POST("/image/upload", uc.UploadProfilePicture)
 	userRoute.GET("/image/:id", uc.GetProfilePicture)
+
+	protectedRoute := userRoute.Group("", authMiddleware.RequireAuth())
+	protectedRoute.GET("/get/:id", uc.GetUser)
+	protectedRoute.GET("/storage", uc.GetStorageUsage)
+	protectedRoute.PUT("/update", uc.UpdateUser)
+	protectedRoute.DELETE("/delete", ForbidImpersonation(), uc.DeleteUser)
+	protectedRoute.POST("/image/upload", LimitRequestBody(uc.imageService.GetPolicy().MaxRequestSize), uc.UploadProfilePicture)
 }
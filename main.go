@@ -5,9 +5,13 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/akunsecured/emezen_api/controllers"
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
 	"github.com/akunsecured/emezen_api/services"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
@@ -26,18 +30,68 @@ var (
 	userCollection            *mongo.Collection
 	userService               services.UserService
 	userController            controllers.UserController
+	sessionCollection         *mongo.Collection
+	sessionService            services.SessionService
+	outboxCollection          *mongo.Collection
+	mailService               services.MailService
+	loginAttemptCollection    *mongo.Collection
+	loginAttemptService       services.LoginAttemptService
 	authCollection            *mongo.Collection
+	passwordResetCollection   *mongo.Collection
+	emailVerifyCollection     *mongo.Collection
+	loginChallengeCollection  *mongo.Collection
 	authService               services.AuthService
 	authController            controllers.AuthController
 	productCollection         *mongo.Collection
 	productObserverCollection *mongo.Collection
 	productService            services.ProductService
 	productController         controllers.ProductController
+	adminController           controllers.AdminController
+	mediaController           controllers.MediaController
+	authMiddleware            controllers.AuthMiddleware
+	apiKeyCollection          *mongo.Collection
+	apiKeyService             services.APIKeyService
+	apiKeyController          controllers.APIKeyController
+	oauthClientCollection     *mongo.Collection
+	oauthCodeCollection       *mongo.Collection
+	oauthTokenCollection      *mongo.Collection
+	oauthConsentCollection    *mongo.Collection
+	oauthService              services.OAuthService
+	oauthController           controllers.OAuthController
+	auditCollection           *mongo.Collection
+	auditService              services.AuditService
 	err                       error
 	envMap                    map[string]string
 	bucket                    *gridfs.Bucket
+	blobStore                 services.BlobStore
+	imageService              services.ImageService
+	storageCollection         *mongo.Collection
+	storageTotalCollection    *mongo.Collection
+	uploadCounterCollection   *mongo.Collection
+	storageService            services.StorageService
 )
 
+// envInt returns the numeric value of the given key, or the fallback if it is missing or
+// not a number.
+func envInt(key string, fallback int) int {
+	value, err := strconv.Atoi(envMap[key])
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// envList returns the comma separated values of the given key, or nil if it is missing.
+func envList(key string) []string {
+	var values []string
+	for _, value := range strings.Split(envMap[key], ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
 // This function runs before the main()
 func init() {
 	fmt.Println("Connecting to MongoDB...")
@@ -47,6 +101,20 @@ func init() {
 		log.Fatal(err)
 	}
 
+	// Anyone could sign media links with a key from the source code, so there is no default
+	mediaURLSecret := envMap["MEDIA_URL_SECRET"]
+	if mediaURLSecret == "" {
+		log.Fatal("MEDIA_URL_SECRET is not set")
+	}
+	security.MediaURLSecretKey = []byte(mediaURLSecret)
+
+	// The same goes for the tokens, which could be signed with any roles otherwise
+	jwtSecret := envMap["JWT_SECRET"]
+	if jwtSecret == "" {
+		log.Fatal("JWT_SECRET is not set")
+	}
+	security.JwtSecretKey = []byte(jwtSecret)
+
 	dbUri := envMap["DB_CONNECTION"]
 	dbName := envMap["DATABASE_NAME"]
 
@@ -66,20 +134,184 @@ func init() {
 
 	mongoDatabase = mongoClient.Database(dbName)
 
+	// Files are kept on the local disk unless GridFS is configured, which has to be used when
+	// more than one API instance is running
+	switch envMap["BLOB_STORE"] {
+	case "gridfs":
+		bucketName := envMap["BLOB_STORE_BUCKET"]
+		if bucketName == "" {
+			bucketName = "images"
+		}
+		bucket, err = gridfs.NewBucket(mongoDatabase, options.GridFSBucket().SetName(bucketName))
+		if err != nil {
+			log.Fatal(err)
+		}
+		blobStore = services.NewGridFSBlobStore(bucket, ctx)
+	default:
+		root := envMap["BLOB_STORE_ROOT"]
+		if root == "" {
+			root = "images"
+		}
+		blobStore = services.NewFilesystemBlobStore(root)
+	}
+
+	imagePolicy := models.ImageUploadPolicy{
+		MaxFileSize:    int64(envInt("IMAGE_MAX_FILE_SIZE", 5<<20)),
+		MaxRequestSize: int64(envInt("IMAGE_MAX_REQUEST_SIZE", 25<<20)),
+		MaxFiles:       envInt("IMAGE_MAX_FILES", 10),
+		MaxPixels:      envInt("IMAGE_MAX_PIXELS", 40_000_000),
+	}
+
+	// The links of the stored files are built from these when responding, so the stored
+	// documents do not depend on where the API is deployed
+	assetURLPolicy := models.AssetURLPolicy{
+		PublicBaseURL: envMap["PUBLIC_BASE_URL"],
+		CDNBaseURL:    envMap["ASSET_CDN_URL"],
+	}
+	if assetURLPolicy.PublicBaseURL == "" {
+		assetURLPolicy.PublicBaseURL = "http://localhost:8080/api/v1"
+	}
+
+	storagePolicy := models.StoragePolicy{
+		QuotaBytes:          int64(envInt("STORAGE_QUOTA_BYTES", 500<<20)),
+		MaxImagesPerProduct: envInt("STORAGE_MAX_IMAGES_PER_PRODUCT", 20),
+		MaxUploadsPerHour:   envInt("STORAGE_MAX_UPLOADS_PER_HOUR", 100),
+	}
+	storageCollection = mongoDatabase.Collection("storage_usage")
+	storageTotalCollection = mongoDatabase.Collection("storage_totals")
+	uploadCounterCollection = mongoDatabase.Collection("upload_counters")
+	storageService = services.NewStorageService(storageCollection, storageTotalCollection, uploadCounterCollection, storagePolicy, ctx)
+	err = storageService.EnsureIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	countedUsers, err := storageService.MigrateTotals()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if countedUsers > 0 {
+		log.Printf("counted the storage usage of %d users", countedUsers)
+	}
+
+	imageService = services.NewImageService(blobStore, storageService, imagePolicy)
+
 	userCollection = mongoDatabase.Collection("users")
 	userService = services.NewUserService(userCollection, ctx)
-	userController = controllers.NewUserController(userService)
+
+	sessionCollection = mongoDatabase.Collection("sessions")
+	sessionService = services.NewSessionService(sessionCollection, ctx)
+
+	apiKeyCollection = mongoDatabase.Collection("api_keys")
+	apiKeyService = services.NewAPIKeyService(apiKeyCollection, ctx)
+	apiKeyController = controllers.NewAPIKeyController(apiKeyService)
+
+	oauthClientCollection = mongoDatabase.Collection("oauth_clients")
+	oauthCodeCollection = mongoDatabase.Collection("oauth_codes")
+	oauthTokenCollection = mongoDatabase.Collection("oauth_tokens")
+	oauthConsentCollection = mongoDatabase.Collection("oauth_consents")
+	oauthService = services.NewOAuthService(oauthClientCollection, oauthCodeCollection, oauthTokenCollection, oauthConsentCollection, ctx)
+	oauthController = controllers.NewOAuthController(oauthService)
+
+	auditCollection = mongoDatabase.Collection("audit_events")
+	auditService = services.NewAuditService(auditCollection, ctx)
+	err = auditService.EnsureRetention(time.Duration(envInt("AUDIT_RETENTION_DAYS", 90)) * 24 * time.Hour)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	authMiddleware = controllers.NewAuthMiddleware(sessionService, userService, apiKeyService, oauthService, auditService)
+
+	outboxCollection = mongoDatabase.Collection("outbox")
+	mailService = services.NewMailService(outboxCollection, ctx)
+
+	loginAttemptCollection = mongoDatabase.Collection("login_attempts")
+	loginAttemptService = services.NewLoginAttemptService(loginAttemptCollection, ctx)
+	err = loginAttemptService.EnsureIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	authCollection = mongoDatabase.Collection("credentials")
-	authService = services.NewAuthService(authCollection, userService, ctx)
+	passwordResetCollection = mongoDatabase.Collection("password_resets")
+	emailVerifyCollection = mongoDatabase.Collection("email_verifications")
+	loginChallengeCollection = mongoDatabase.Collection("login_challenges")
+	passwordPolicy := models.PasswordPolicy{
+		MinLength:           envInt("PASSWORD_MIN_LENGTH", 8),
+		MaxLength:           envInt("PASSWORD_MAX_LENGTH", 64),
+		RequireUppercase:    envMap["PASSWORD_REQUIRE_UPPERCASE"] == "true",
+		RequireLowercase:    envMap["PASSWORD_REQUIRE_LOWERCASE"] == "true",
+		RequireDigit:        envMap["PASSWORD_REQUIRE_DIGIT"] == "true",
+		RequireSymbol:       envMap["PASSWORD_REQUIRE_SYMBOL"] == "true",
+		RejectPersonalInfo:  envMap["PASSWORD_ALLOW_PERSONAL_INFO"] != "true",
+		RejectCommon:        envMap["PASSWORD_ALLOW_COMMON"] != "true",
+		CommonPasswordsFile: envMap["PASSWORD_COMMON_LIST_FILE"],
+	}
+	var passwordPolicyChecker *security.PasswordPolicyChecker
+	passwordPolicyChecker, err = security.NewPasswordPolicyChecker(passwordPolicy)
+	if err != nil {
+		log.Fatal(err)
+	}
+	authService = services.NewAuthService(authCollection, passwordResetCollection, emailVerifyCollection, loginChallengeCollection, userService, sessionService, mailService, loginAttemptService, apiKeyService, oauthService, auditService, passwordPolicyChecker, envMap["APP_URL"], ctx)
+	// The index goes first, so addresses which differ only in casing are found while migrating
+	err = authService.EnsureIndexes()
+	if err != nil {
+		log.Fatal(err)
+	}
+	normalizedEmails, conflictingEmails, err := authService.MigrateEmails()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if normalizedEmails > 0 {
+		log.Printf("normalized the email addresses of %d accounts", normalizedEmails)
+	}
+	for _, userId := range conflictingEmails {
+		log.Printf("the email address of user %s is used by another account in a different casing", userId)
+	}
+	userController = controllers.NewUserController(userService, authService, blobStore, imageService, storageService, assetURLPolicy)
 	authController = controllers.NewAuthController(authService)
 
 	productCollection = mongoDatabase.Collection("products")
 	productObserverCollection = mongoDatabase.Collection("product_observers")
-	productService = services.NewProductService(productCollection, productObserverCollection, userService, ctx)
-	productController = controllers.NewProductController(productService)
+	tradingPolicy := models.TradingPolicy{
+		VerifiedEmailToBuy:  envMap["REQUIRE_VERIFIED_EMAIL_TO_BUY"] == "true",
+		VerifiedEmailToSell: envMap["REQUIRE_VERIFIED_EMAIL_TO_SELL"] == "true",
+		SellerRoleToSell:    envMap["REQUIRE_SELLER_ROLE_TO_SELL"] == "true",
+	}
+	productService = services.NewProductService(productCollection, productObserverCollection, userService, imageService, storageService, tradingPolicy, ctx)
+	updatedProducts, err := productService.MigrateImageKeys()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if updatedProducts > 0 {
+		log.Printf("replaced the image links of %d products with storage keys", updatedProducts)
+	}
+	countedImages, err := productService.MigrateStorageUsage()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if countedImages > 0 {
+		log.Printf("counted %d product images in the storage usage of their sellers", countedImages)
+	}
+
+	productController = controllers.NewProductController(productService, auditService, blobStore, imageService, storageService, assetURLPolicy)
+
+	mediaController = controllers.NewMediaController(blobStore, imageService, storageService, assetURLPolicy)
+
+	adminController = controllers.NewAdminController(userService, authService, productService, auditService)
+
+	// The first administrators can only be appointed from the configuration
+	for _, adminUserId := range strings.Split(envMap["ADMIN_USER_IDS"], ",") {
+		adminUserId = strings.TrimSpace(adminUserId)
+		if adminUserId == "" {
+			continue
+		}
+		if err := userService.GrantRole(&adminUserId, models.RoleAdmin); err != nil {
+			log.Print(err)
+		}
+	}
 
 	server = gin.Default()
+	server.Use(controllers.RequestID())
 }
 
 func main() {
@@ -91,17 +323,34 @@ func main() {
 	}(mongoClient, ctx)
 
 	basePath := server.Group("/api").Group("/v1")
-	userController.RegisterUserRoutes(basePath)
-	authController.RegisterAuthRoutes(basePath)
-	productController.RegisterProductRoutes(basePath)
-
-	corsConfig := cors.New(cors.Options{
-		AllowedOrigins:   []string{"*"},
-		AllowedMethods:   []string{"PUT", "PATCH", "GET", "POST", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"*"},
-		AllowCredentials: true,
-		MaxAge:           int(12 * time.Hour),
-	})
+	userController.RegisterUserRoutes(basePath, &authMiddleware)
+	authController.RegisterAuthRoutes(basePath, &authMiddleware)
+	productController.RegisterProductRoutes(basePath, &authMiddleware)
+	adminController.RegisterAdminRoutes(basePath, &authMiddleware)
+	apiKeyController.RegisterAPIKeyRoutes(basePath, &authMiddleware)
+	oauthController.RegisterOAuthRoutes(basePath, &authMiddleware)
+	mediaController.RegisterMediaRoutes(basePath, &authMiddleware)
+
+	// Every setting falls back to the defaults of the environment if it is not configured
+	corsPolicy := security.DefaultCORSPolicy(envMap["APP_ENV"], envMap["APP_URL"])
+	if origins := envList("CORS_ALLOWED_ORIGINS"); origins != nil {
+		corsPolicy.AllowedOrigins = origins
+	}
+	if methods := envList("CORS_ALLOWED_METHODS"); methods != nil {
+		corsPolicy.AllowedMethods = methods
+	}
+	if headers := envList("CORS_ALLOWED_HEADERS"); headers != nil {
+		corsPolicy.AllowedHeaders = headers
+	}
+	if credentials, ok := envMap["CORS_ALLOW_CREDENTIALS"]; ok {
+		corsPolicy.AllowCredentials = credentials == "true"
+	}
+	corsPolicy.MaxAge = time.Duration(envInt("CORS_MAX_AGE_SECONDS", int(corsPolicy.MaxAge.Seconds()))) * time.Second
+	if err := security.CheckCORSPolicy(corsPolicy); err != nil {
+		log.Fatal(err)
+	}
+
+	corsConfig := cors.New(security.NewCORSOptions(corsPolicy))
 	handler := corsConfig.Handler(server)
 
 	host := envMap["HOST"]
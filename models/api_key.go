@@ -0,0 +1,51 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Scope string
+
+const (
+	ScopeProductsRead  Scope = "products:read"
+	ScopeProductsWrite Scope = "products:write"
+	ScopeOrdersRead    Scope = "orders:read"
+)
+
+func (s Scope) IsValid() bool {
+	switch s {
+	case ScopeProductsRead, ScopeProductsWrite, ScopeOrdersRead:
+		return true
+	}
+	return false
+}
+
+// APIKey lets a user access a limited part of the API from their own systems. Only the hash
+// of the key is stored, the prefix is kept so the user can tell the keys apart.
+type APIKey struct {
+	ID         primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserID     string             `json:"user_id" bson:"user_id"`
+	Name       string             `json:"name" bson:"name"`
+	Prefix     string             `json:"prefix" bson:"prefix"`
+	KeyHash    string             `json:"-" bson:"key_hash"`
+	Scopes     []Scope            `json:"scopes" bson:"scopes"`
+	ExpiresAt  *time.Time         `json:"expires_at,omitempty" bson:"expires_at"`
+	LastUsedAt *time.Time         `json:"last_used_at,omitempty" bson:"last_used_at"`
+	CreatedAt  time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt  time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+type APIKeyRequest struct {
+	Name      string     `json:"name" validate:"required,min=1,max=50"`
+	Scopes    []Scope    `json:"scopes" validate:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreatedAPIKey is only returned once, right after the key was created, since the key
+// itself cannot be recovered later.
+type CreatedAPIKey struct {
+	APIKey *APIKey `json:"api_key"`
+	Key    string  `json:"key"`
+}
@@ -0,0 +1,10 @@
+package models
+
+// AssetURLPolicy tells how the links of the stored files are built in the responses. Only the
+// storage keys are saved, so the links follow the configuration of the deployment. If the
+// CDN URL is set, the files are linked there by their key, otherwise they are served through
+// the public URL of the API, which includes the version prefix.
+type AssetURLPolicy struct {
+	PublicBaseURL string
+	CDNBaseURL    string
+}
@@ -0,0 +1,70 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const (
+	AuditRegister       = "register"
+	AuditLogin          = "login"
+	AuditLoginTwoFactor = "login_2fa"
+	AuditPasswordChange = "password_change"
+	AuditPasswordReset  = "password_reset"
+	AuditEmailChange    = "email_change"
+	AuditTokenRefresh   = "token_refresh"
+	AuditAccountDelete  = "account_delete"
+	AuditTwoFactorOn    = "2fa_enable"
+	AuditTwoFactorOff   = "2fa_disable"
+	AuditProductUpdate  = "product_update"
+	AuditProductDelete  = "product_delete"
+	AuditImpersonate    = "impersonation_start"
+	AuditImpersonated   = "impersonated_request"
+)
+
+const (
+	AuditOutcomeSuccess    = "success"
+	AuditOutcomeFailure    = "failure"
+	AuditOutcomeDenied     = "denied"
+	AuditOutcomeChallenged = "challenged"
+)
+
+// AuditEvent is an entry of the append-only security audit log. The actor is the user who
+// did it, if known, and the target is the user or product it was done to.
+type AuditEvent struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	Type      string             `json:"type" bson:"type"`
+	Outcome   string             `json:"outcome" bson:"outcome"`
+	Reason    string             `json:"reason,omitempty" bson:"reason,omitempty"`
+	ActorID   string             `json:"actor_id,omitempty" bson:"actor_id,omitempty"`
+	TargetID  string             `json:"target_id,omitempty" bson:"target_id,omitempty"`
+	Email     string             `json:"email,omitempty" bson:"email,omitempty"`
+	Method    string             `json:"method,omitempty" bson:"method,omitempty"`
+	Path      string             `json:"path,omitempty" bson:"path,omitempty"`
+	Status    int                `json:"status,omitempty" bson:"status,omitempty"`
+	IP        string             `json:"ip" bson:"ip"`
+	UserAgent string             `json:"user_agent" bson:"user_agent"`
+	RequestID string             `json:"request_id" bson:"request_id"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
+
+// RequestInfo describes the request an audited action came from.
+type RequestInfo struct {
+	IP        string
+	UserAgent string
+	RequestID string
+}
+
+type AuditEventQuery struct {
+	Type      string    `form:"type"`
+	Outcome   string    `form:"outcome"`
+	ActorID   string    `form:"actor_id"`
+	TargetID  string    `form:"target_id"`
+	Email     string    `form:"email"`
+	IP        string    `form:"ip"`
+	RequestID string    `form:"request_id"`
+	From      time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+	To        time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+	Limit     int64     `form:"limit" validate:"omitempty,min=1,max=1000"`
+}
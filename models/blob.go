@@ -0,0 +1,15 @@
+package models
+
+import "time"
+
+// BlobInfo describes a stored file. The key is its path in the store, e.g.
+// "product_pictures/abc.png". The hash is the hex SHA-256 of the content, it is empty if the
+// store does not know it. Private files are the ones stored under the private media prefix.
+type BlobInfo struct {
+	Key         string    `json:"key"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	ModTime     time.Time `json:"mod_time"`
+	Hash        string    `json:"hash,omitempty"`
+	Private     bool      `json:"private"`
+}
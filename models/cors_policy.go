@@ -0,0 +1,14 @@
+package models
+
+import "time"
+
+// CORSPolicy tells which browser origins may call the API. An origin may contain a single
+// wildcard, e.g. https://*.emezen.com.
+type CORSPolicy struct {
+	AllowedOrigins   []string
+	AllowedMethods   []string
+	AllowedHeaders   []string
+	ExposedHeaders   []string
+	AllowCredentials bool
+	MaxAge           time.Duration
+}
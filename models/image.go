@@ -0,0 +1,77 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// The key prefixes of the images in the blob store. Private media is stored under the ID of
+// its owner after the prefix, and can only be fetched through signed links.
+const (
+	ProductPicturesPrefix = "product_pictures/"
+	ProfilePicturesPrefix = "profile_pictures/"
+	PrivateMediaPrefix    = "private/"
+)
+
+// ProfilePictureKey returns the key of the profile picture of the user with the given ID.
+func ProfilePictureKey(userId string) string {
+	return ProfilePicturesPrefix + userId + ".png"
+}
+
+// IsPrivateMediaKey tells if the blob with the given key is private.
+func IsPrivateMediaKey(key string) bool {
+	return strings.HasPrefix(key, PrivateMediaPrefix)
+}
+
+// SignedMediaURL is a link to a stored file, which can be used until it expires.
+type SignedMediaURL struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// ImageUploadPolicy limits what can be uploaded as an image. The sizes are in bytes.
+type ImageUploadPolicy struct {
+	MaxFileSize    int64
+	MaxRequestSize int64
+	MaxFiles       int
+	MaxPixels      int
+}
+
+// StoredImage is an accepted upload. Its key is derived from the content, so the same image
+// is only stored once.
+type StoredImage struct {
+	Key         string `json:"key"`
+	URL         string `json:"url,omitempty"`
+	FileName    string `json:"file_name"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+}
+
+// RejectedFile tells why an uploaded file was not accepted. The index is its position in
+// the request, since file names do not have to be unique.
+type RejectedFile struct {
+	Index    int    `json:"index"`
+	FileName string `json:"file_name"`
+	Error    string `json:"error"`
+}
+
+type ImageUploadResult struct {
+	Stored   []*StoredImage  `json:"stored"`
+	Rejected []*RejectedFile `json:"rejected"`
+}
+
+// ImageVariant is a resized copy of an uploaded image, which fits in a square of the given
+// size in pixels.
+type ImageVariant struct {
+	Name    string
+	MaxSize int
+}
+
+// ImageVariants are generated for every product image, smaller images are not upscaled.
+var ImageVariants = []ImageVariant{
+	{Name: "thumbnail", MaxSize: 160},
+	{Name: "medium", MaxSize: 480},
+	{Name: "large", MaxSize: 1024},
+}
@@ -0,0 +1,12 @@
+package models
+
+import "time"
+
+// ImpersonationToken lets an admin act as the user for a short time. There is no refresh
+// token, a new one has to be requested once it expires.
+type ImpersonationToken struct {
+	AccessToken string    `json:"access_token"`
+	ActorID     string    `json:"actor_id"`
+	SubjectID   string    `json:"subject_id"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// LoginAttempt counts the consecutive failed logins of an account or an IP address.
+// The key is prefixed with the kind of the subject, e.g. "email:" or "ip:".
+type LoginAttempt struct {
+	ID            primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	Key           string             `json:"key" bson:"key"`
+	Failures      int                `json:"failures" bson:"failures"`
+	LastFailureAt time.Time          `json:"last_failure_at" bson:"last_failure_at"`
+	LockedUntil   time.Time          `json:"locked_until" bson:"locked_until"`
+}
+
+type UnlockAccountRequest struct {
+	Email string `json:"email" validate:"required,email"`
+	IP    string `json:"ip" validate:"omitempty,ip"`
+}
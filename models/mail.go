@@ -0,0 +1,15 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Mail struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	To        string             `json:"to" bson:"to"`
+	Subject   string             `json:"subject" bson:"subject"`
+	Body      string             `json:"body" bson:"body"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+}
@@ -0,0 +1,119 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// OAuthClient is a third-party application registered by a user. Confidential clients
+// authenticate with their secret, public clients have to use PKCE instead.
+type OAuthClient struct {
+	ID               primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	ClientID         string             `json:"client_id" bson:"client_id"`
+	ClientSecretHash string             `json:"-" bson:"client_secret_hash"`
+	OwnerUserID      string             `json:"owner_user_id" bson:"owner_user_id"`
+	Name             string             `json:"name" bson:"name"`
+	RedirectURIs     []string           `json:"redirect_uris" bson:"redirect_uris"`
+	Scopes           []Scope            `json:"scopes" bson:"scopes"`
+	Confidential     bool               `json:"confidential" bson:"confidential"`
+	CreatedAt        time.Time          `json:"created_at" bson:"created_at"`
+}
+
+type OAuthClientRequest struct {
+	Name         string   `json:"name" validate:"required,min=1,max=50"`
+	RedirectURIs []string `json:"redirect_uris" validate:"required,min=1,dive,url"`
+	Scopes       []Scope  `json:"scopes" validate:"required,min=1"`
+	Confidential bool     `json:"confidential"`
+}
+
+// CreatedOAuthClient is only returned once, right after the client was registered, since
+// the secret cannot be recovered later.
+type CreatedOAuthClient struct {
+	Client       *OAuthClient `json:"client"`
+	ClientSecret string       `json:"client_secret,omitempty"`
+}
+
+type OAuthAuthorizationCode struct {
+	ID                   primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	CodeHash             string             `json:"-" bson:"code_hash"`
+	ClientID             string             `json:"client_id" bson:"client_id"`
+	UserID               string             `json:"user_id" bson:"user_id"`
+	RedirectURI          string             `json:"redirect_uri" bson:"redirect_uri"`
+	RedirectURIDefaulted bool               `json:"-" bson:"redirect_uri_defaulted"`
+	Scopes               []Scope            `json:"scopes" bson:"scopes"`
+	CodeChallenge        string             `json:"-" bson:"code_challenge"`
+	CodeChallengeMethod  string             `json:"-" bson:"code_challenge_method"`
+	CreatedAt            time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt            time.Time          `json:"expires_at" bson:"expires_at"`
+	UsedAt               *time.Time         `json:"used_at,omitempty" bson:"used_at"`
+}
+
+// OAuthConsent records which scopes a user has granted to a client.
+type OAuthConsent struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	ClientID  string             `json:"client_id" bson:"client_id"`
+	Scopes    []Scope            `json:"scopes" bson:"scopes"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+}
+
+// OAuthToken is the stored record of an issued access token, so it can be introspected
+// and revoked before it expires. The user is the owner of the client for tokens issued
+// with the client credentials grant.
+type OAuthToken struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	ClientID  string             `json:"client_id" bson:"client_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	Scopes    []Scope            `json:"scopes" bson:"scopes"`
+	GrantType string             `json:"grant_type" bson:"grant_type"`
+	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
+	ExpiresAt time.Time          `json:"expires_at" bson:"expires_at"`
+	RevokedAt *time.Time         `json:"revoked_at,omitempty" bson:"revoked_at"`
+}
+
+type OAuthAuthorizeRequest struct {
+	ResponseType        string `json:"response_type" form:"response_type" validate:"required"`
+	ClientID            string `json:"client_id" form:"client_id" validate:"required"`
+	RedirectURI         string `json:"redirect_uri" form:"redirect_uri"`
+	Scope               string `json:"scope" form:"scope"`
+	State               string `json:"state" form:"state"`
+	CodeChallenge       string `json:"code_challenge" form:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method" form:"code_challenge_method"`
+	Approve             bool   `json:"approve" form:"approve"`
+}
+
+// OAuthAuthorizeInfo is shown on the consent screen before the user approves a request.
+type OAuthAuthorizeInfo struct {
+	ClientName    string  `json:"client_name"`
+	Scopes        []Scope `json:"scopes"`
+	ConsentExists bool    `json:"consent_exists"`
+}
+
+type OAuthTokenRequest struct {
+	GrantType    string `form:"grant_type" validate:"required"`
+	Code         string `form:"code"`
+	RedirectURI  string `form:"redirect_uri"`
+	CodeVerifier string `form:"code_verifier"`
+	Scope        string `form:"scope"`
+	ClientID     string `form:"client_id"`
+	ClientSecret string `form:"client_secret"`
+}
+
+type OAuthTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+	Scope       string `json:"scope"`
+}
+
+type OAuthIntrospection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
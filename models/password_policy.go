@@ -0,0 +1,22 @@
+package models
+
+// PasswordPolicy tells which rules new passwords have to satisfy. The common passwords are
+// read from the given file, or from the bundled list if it is empty.
+type PasswordPolicy struct {
+	MinLength           int    `json:"min_length"`
+	MaxLength           int    `json:"max_length"`
+	RequireUppercase    bool   `json:"require_uppercase"`
+	RequireLowercase    bool   `json:"require_lowercase"`
+	RequireDigit        bool   `json:"require_digit"`
+	RequireSymbol       bool   `json:"require_symbol"`
+	RejectPersonalInfo  bool   `json:"reject_personal_info"`
+	RejectCommon        bool   `json:"reject_common"`
+	CommonPasswordsFile string `json:"-"`
+}
+
+// PasswordRuleFailure is a rule of the password policy the password did not satisfy, so the
+// frontend can show every problem at once.
+type PasswordRuleFailure struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
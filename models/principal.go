@@ -0,0 +1,50 @@
+package models
+
+// Principal is the authenticated caller of a request, built from a validated token or
+// API key. Principals of API keys and third-party clients have no session and are limited
+// to the scopes they were granted.
+type Principal struct {
+	UserID    string  `json:"user_id"`
+	Roles     []Role  `json:"roles"`
+	SessionID string  `json:"session_id,omitempty"`
+	ActorID   string  `json:"actor_id,omitempty"`
+	APIKeyID  string  `json:"api_key_id,omitempty"`
+	ClientID  string  `json:"client_id,omitempty"`
+	Scopes    []Scope `json:"scopes,omitempty"`
+}
+
+func (p *Principal) HasRole(roles ...Role) bool {
+	return HasRole(p.Roles, roles...)
+}
+
+// IsImpersonated tells if an admin acts as the user of the principal.
+func (p *Principal) IsImpersonated() bool {
+	return p.ActorID != ""
+}
+
+// IsScoped tells if the principal is limited to its scopes, which is the case for everything
+// except user sessions.
+func (p *Principal) IsScoped() bool {
+	return p.APIKeyID != "" || p.ClientID != ""
+}
+
+// HasScopes checks if the principal has every given scope. Principals of user sessions are
+// not limited by scopes.
+func (p *Principal) HasScopes(scopes ...Scope) bool {
+	if !p.IsScoped() {
+		return true
+	}
+	for _, scope := range scopes {
+		found := false
+		for _, s := range p.Scopes {
+			if s == scope {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
@@ -8,13 +8,18 @@ import (
 
 type Product struct {
 	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
-	SellerID  string             `json:"seller_id" bson:"seller_id" validate:"required"`
+	SellerID  string             `json:"seller_id" bson:"seller_id"`
 	Name      string             `json:"name" bson:"name" validate:"required,min=1,max=50"`
 	Price     float32            `json:"price" bson:"price" validate:"required,min=0.01,max=999.99"`
-	Images    []string           `json:"images" bson:"images"`
+	Images    []string           `json:"images" bson:"images"` // The first image is the primary one
 	Details   string             `json:"details" bson:"details" validate:"required,min=1,max=1500"`
 	Quantity  int32              `json:"quantity" bson:"quantity" validate:"required,min=1,max=100"`
 	Category  Category           `json:"category" bson:"category"`
 	CreatedAt time.Time          `json:"created_at,omitempty" bson:"created_at"`
 	UpdatedAt time.Time          `json:"updated_at,omitempty" bson:"updated_at"`
 }
+
+// ProductImageOrder lists the file names of every image of a product in the new order.
+type ProductImageOrder struct {
+	Images []string `json:"images" validate:"required,min=1"`
+}
@@ -0,0 +1,42 @@
+package models
+
+type Role string
+
+const (
+	RoleBuyer     Role = "buyer"
+	RoleSeller    Role = "seller"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// DefaultRoles are given to every newly registered user, and they are assumed for users
+// registered before roles existed.
+var DefaultRoles = []Role{RoleBuyer, RoleSeller}
+
+func (r Role) IsValid() bool {
+	switch r {
+	case RoleBuyer, RoleSeller, RoleModerator, RoleAdmin:
+		return true
+	}
+	return false
+}
+
+// HasRole checks if any of the given roles is in the list. Admins are treated as having
+// every role.
+func HasRole(roles []Role, wanted ...Role) bool {
+	for _, role := range roles {
+		if role == RoleAdmin {
+			return true
+		}
+		for _, w := range wanted {
+			if role == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type SetRolesRequest struct {
+	Roles []Role `json:"roles" validate:"required,min=1"`
+}
@@ -0,0 +1,53 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// StoragePolicy limits what a user can upload. The quota is in bytes, zero turns a limit off.
+type StoragePolicy struct {
+	QuotaBytes          int64
+	MaxImagesPerProduct int
+	MaxUploadsPerHour   int
+}
+
+// StorageRecord counts a stored file against the quota of a user. Files with the same
+// content are stored once, but every user referencing them is charged for them. The variant
+// size is the total size of the resized copies of the file.
+type StorageRecord struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserID      string             `json:"user_id" bson:"user_id"`
+	Key         string             `json:"key" bson:"key"`
+	Size        int64              `json:"size" bson:"size"`
+	VariantSize int64              `json:"variant_size" bson:"variant_size"`
+	UploadedAt  time.Time          `json:"uploaded_at" bson:"uploaded_at"`
+}
+
+// StorageTotal is the number of bytes charged to a user. It is the sum of the records of the
+// user and the bytes reserved by the uploads in progress, and it is only changed with atomic
+// increments, so concurrent uploads cannot exceed the quota together.
+type StorageTotal struct {
+	ID        primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserID    string             `json:"user_id" bson:"user_id"`
+	UsedBytes int64              `json:"used_bytes" bson:"used_bytes"`
+}
+
+// UploadCounter is the number of files a user uploaded in the hour starting at the window.
+// The files are counted before they are stored, so deleting them does not free their place.
+type UploadCounter struct {
+	ID          primitive.ObjectID `json:"_id,omitempty" bson:"_id"`
+	UserID      string             `json:"user_id" bson:"user_id"`
+	WindowStart time.Time          `json:"window_start" bson:"window_start"`
+	Uploads     int                `json:"uploads" bson:"uploads"`
+}
+
+// StorageUsage is the current usage of a user together with the limits of the policy.
+type StorageUsage struct {
+	UsedBytes           int64 `json:"used_bytes"`
+	QuotaBytes          int64 `json:"quota_bytes"`
+	Files               int64 `json:"files"`
+	MaxImagesPerProduct int   `json:"max_images_per_product"`
+	MaxUploadsPerHour   int   `json:"max_uploads_per_hour"`
+}
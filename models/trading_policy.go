@@ -0,0 +1,8 @@
+package models
+
+// TradingPolicy tells what users need before they are allowed to buy or to list products.
+type TradingPolicy struct {
+	VerifiedEmailToBuy  bool
+	VerifiedEmailToSell bool
+	SellerRoleToSell    bool
+}
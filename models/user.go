@@ -14,20 +14,46 @@ type User struct {
 	ContactEmail   string             `json:"contact_email" bson:"contact_email"`
 	ProfilePicture string             `json:"profile_picture" bson:"profile_picture"`
 	Credits        float32            `json:"credits" bson:"credits"`
+	EmailVerified  bool               `json:"email_verified" bson:"email_verified"`
+	Roles          []Role             `json:"roles" bson:"roles"`
 	CreatedAt      time.Time          `json:"created_at,omitempty" bson:"created_at"`
 	UpdatedAt      time.Time          `json:"updated_at,omitempty" bson:"updated_at"`
 }
 
+// GetRoles returns the roles of the user, falling back to the default ones for users
+// registered before roles existed.
+func (u *User) GetRoles() []Role {
+	if len(u.Roles) == 0 {
+		return DefaultRoles
+	}
+	return u.Roles
+}
+
 type UserCredentials struct {
-	ID        primitive.ObjectID `json:"_id" bson:"_id"`
-	UserID    string             `json:"user_id" bson:"user_id"`
-	Email     string             `json:"email" bson:"email" validate:"required,email"`
-	Password  string             `json:"password" bson:"password" validate:"required,min=8,max=64"`
-	CreatedAt time.Time          `json:"created_at" bson:"created_at"`
-	UpdatedAt time.Time          `json:"updated_at" bson:"updated_at"`
+	ID                 primitive.ObjectID `json:"_id" bson:"_id"`
+	UserID             string             `json:"user_id" bson:"user_id"`
+	Email              string             `json:"email" bson:"email" validate:"required,email"`
+	Password           string             `json:"password" bson:"password" validate:"required"`
+	TwoFactorEnabled   bool               `json:"-" bson:"two_factor_enabled"`
+	TOTPSecret         string             `json:"-" bson:"totp_secret"`
+	PendingTOTPSecret  string             `json:"-" bson:"pending_totp_secret"`
+	TOTPLastStep       int64              `json:"-" bson:"totp_last_step"`
+	RecoveryCodeHashes []string           `json:"-" bson:"recovery_code_hashes"`
+	CreatedAt          time.Time          `json:"created_at" bson:"created_at"`
+	UpdatedAt          time.Time          `json:"updated_at" bson:"updated_at"`
 }
 
 type UserDataWithCredentials struct {
 	UserData    User            `json:"user_data"`
 	Credentials UserCredentials `json:"credentials"`
 }
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	NewPassword     string `json:"new_password" validate:"required"`
+}
+
+type ChangeEmailRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	Email           string `json:"email" validate:"required,email"`
+}
@@ -0,0 +1,73 @@
+package security
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/rs/cors"
+)
+
+const DevelopmentEnvironment = "development"
+
+// DefaultCORSPolicy returns the policy of the given environment. In development, every local
+// port is allowed, otherwise only the frontend at the app URL.
+func DefaultCORSPolicy(environment string, appUrl string) models.CORSPolicy {
+	policy := models.CORSPolicy{
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "X-Request-ID"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           time.Hour * 12,
+	}
+
+	if environment == DevelopmentEnvironment {
+		policy.AllowedOrigins = []string{"http://localhost:*", "http://127.0.0.1:*"}
+		policy.MaxAge = time.Minute * 10
+		return policy
+	}
+
+	if origin, err := url.Parse(appUrl); err == nil && origin.Scheme != "" && origin.Host != "" {
+		policy.AllowedOrigins = []string{origin.Scheme + "://" + origin.Host}
+	}
+	return policy
+}
+
+// CheckCORSPolicy will reject origins which cannot be matched, and the wildcard origin
+// together with credentials, since that would let every website act as the logged in user.
+// An empty list is rejected as well, since rs/cors allows every origin then.
+func CheckCORSPolicy(policy models.CORSPolicy) error {
+	if len(policy.AllowedOrigins) == 0 {
+		return utils.ErrInvalidCORSPolicy
+	}
+	for _, origin := range policy.AllowedOrigins {
+		if origin == "*" {
+			if policy.AllowCredentials {
+				return utils.ErrInvalidCORSPolicy
+			}
+			continue
+		}
+		if strings.Count(origin, "*") > 1 || !strings.Contains(origin, "://") {
+			return utils.ErrInvalidCORSPolicy
+		}
+	}
+	if policy.MaxAge < 0 {
+		return utils.ErrInvalidCORSPolicy
+	}
+	return nil
+}
+
+// NewCORSOptions converts the policy to the options of rs/cors, which expects the max age in
+// seconds.
+func NewCORSOptions(policy models.CORSPolicy) cors.Options {
+	return cors.Options{
+		AllowedOrigins:   policy.AllowedOrigins,
+		AllowedMethods:   policy.AllowedMethods,
+		AllowedHeaders:   policy.AllowedHeaders,
+		ExposedHeaders:   policy.ExposedHeaders,
+		AllowCredentials: policy.AllowCredentials,
+		MaxAge:           int(policy.MaxAge.Seconds()),
+	}
+}
@@ -0,0 +1,148 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"github.com/rs/cors"
+)
+
+// preflight sends a CORS preflight request through the middleware built from the policy.
+func preflight(policy models.CORSPolicy, origin string, method string, headers string) *httptest.ResponseRecorder {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := cors.New(NewCORSOptions(policy)).Handler(next)
+
+	request := httptest.NewRequest(http.MethodOptions, "http://api.emezen.com/api/v1/product/all", nil)
+	request.Header.Set("Origin", origin)
+	request.Header.Set("Access-Control-Request-Method", method)
+	if headers != "" {
+		request.Header.Set("Access-Control-Request-Headers", headers)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestCORSPreflight(t *testing.T) {
+	development := DefaultCORSPolicy(DevelopmentEnvironment, "http://localhost:3000")
+	production := DefaultCORSPolicy("production", "https://app.emezen.com/login")
+
+	tests := []struct {
+		name    string
+		policy  models.CORSPolicy
+		origin  string
+		method  string
+		headers string
+		allowed bool
+		maxAge  string
+	}{
+		{"development localhost port", development, "http://localhost:5173", "POST", "Authorization, Content-Type", true, "600"},
+		{"development loopback port", development, "http://127.0.0.1:8081", "DELETE", "", true, "600"},
+		{"development https localhost", development, "https://localhost:5173", "GET", "", false, ""},
+		{"development other host", development, "http://evil.example.com", "GET", "", false, ""},
+		{"production app origin", production, "https://app.emezen.com", "PUT", "Authorization", true, "43200"},
+		{"production other origin", production, "https://evil.example.com", "GET", "", false, ""},
+		{"production subdomain", production, "https://evil.app.emezen.com", "GET", "", false, ""},
+		{"production http app origin", production, "http://app.emezen.com", "GET", "", false, ""},
+		{"production localhost", production, "http://localhost:3000", "GET", "", false, ""},
+		{"method not allowed", production, "https://app.emezen.com", "CONNECT", "", false, ""},
+		{"header not allowed", production, "https://app.emezen.com", "GET", "X-Unknown-Header", false, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := preflight(test.policy, test.origin, test.method, test.headers)
+			if response.Code == http.StatusTeapot {
+				t.Fatal("the preflight request was passed to the handler")
+			}
+
+			header := response.Header()
+			allowOrigin := header.Get("Access-Control-Allow-Origin")
+			if !test.allowed {
+				if allowOrigin != "" {
+					t.Errorf("Access-Control-Allow-Origin = %q, want none", allowOrigin)
+				}
+				return
+			}
+
+			// The origin is echoed, never the wildcard, since credentials are allowed
+			if allowOrigin != test.origin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", allowOrigin, test.origin)
+			}
+			if credentials := header.Get("Access-Control-Allow-Credentials"); credentials != "true" {
+				t.Errorf("Access-Control-Allow-Credentials = %q, want true", credentials)
+			}
+			if maxAge := header.Get("Access-Control-Max-Age"); maxAge != test.maxAge {
+				t.Errorf("Access-Control-Max-Age = %q, want %q seconds", maxAge, test.maxAge)
+			}
+			if methods := header.Get("Access-Control-Allow-Methods"); methods != test.method {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", methods, test.method)
+			}
+		})
+	}
+}
+
+func TestCORSPreflightCustomMaxAge(t *testing.T) {
+	policy := DefaultCORSPolicy("production", "https://app.emezen.com")
+	policy.MaxAge = 90 * time.Second
+
+	response := preflight(policy, "https://app.emezen.com", "GET", "")
+	if maxAge := response.Header().Get("Access-Control-Max-Age"); maxAge != "90" {
+		t.Errorf("Access-Control-Max-Age = %q, want 90", maxAge)
+	}
+}
+
+func TestDefaultCORSPolicyInvalidAppURL(t *testing.T) {
+	// rs/cors would allow every origin without a list, so the policy must not be accepted
+	policy := DefaultCORSPolicy("production", "not a url")
+	if len(policy.AllowedOrigins) != 0 {
+		t.Errorf("AllowedOrigins = %v, want none", policy.AllowedOrigins)
+	}
+	if err := CheckCORSPolicy(policy); err != utils.ErrInvalidCORSPolicy {
+		t.Errorf("CheckCORSPolicy returned %v, want %v", err, utils.ErrInvalidCORSPolicy)
+	}
+}
+
+func TestCheckCORSPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		origins     []string
+		credentials bool
+		maxAge      time.Duration
+		valid       bool
+	}{
+		{"wildcard with credentials", []string{"*"}, true, time.Hour, false},
+		{"wildcard among origins with credentials", []string{"https://app.emezen.com", "*"}, true, time.Hour, false},
+		{"wildcard without credentials", []string{"*"}, false, time.Hour, true},
+		{"single wildcard in origin", []string{"https://*.emezen.com"}, true, time.Hour, true},
+		{"two wildcards in origin", []string{"https://*.*.emezen.com"}, true, time.Hour, false},
+		{"origin without scheme", []string{"app.emezen.com"}, true, time.Hour, false},
+		{"negative max age", []string{"https://app.emezen.com"}, true, -time.Second, false},
+		{"no origins", nil, true, time.Hour, false},
+		{"development defaults", DefaultCORSPolicy(DevelopmentEnvironment, "").AllowedOrigins, true, time.Hour, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := models.CORSPolicy{
+				AllowedOrigins:   test.origins,
+				AllowCredentials: test.credentials,
+				MaxAge:           test.maxAge,
+			}
+			err := CheckCORSPolicy(policy)
+			if test.valid && err != nil {
+				t.Errorf("CheckCORSPolicy returned %v, want nil", err)
+			}
+			if !test.valid && err != utils.ErrInvalidCORSPolicy {
+				t.Errorf("CheckCORSPolicy returned %v, want %v", err, utils.ErrInvalidCORSPolicy)
+			}
+		})
+	}
+}
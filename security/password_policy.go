@@ -0,0 +1,172 @@
+package security
+
+import (
+	"bufio"
+	_ "embed"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+// The rules of the password policy, as reported to the frontend
+const (
+	PasswordRuleMinLength    = "min_length"
+	PasswordRuleMaxLength    = "max_length"
+	PasswordRuleUppercase    = "uppercase"
+	PasswordRuleLowercase    = "lowercase"
+	PasswordRuleDigit        = "digit"
+	PasswordRuleSymbol       = "symbol"
+	PasswordRulePersonalInfo = "personal_info"
+	PasswordRuleCommon       = "common_password"
+)
+
+// Parts of the email or name shorter than this are not checked, since they would reject
+// too many passwords
+const minPersonalInfoLength = 3
+
+//go:embed common_passwords.txt
+var bundledCommonPasswords string
+
+// PasswordPolicyError is returned when a password does not satisfy the policy. It carries
+// every failed rule, not just the first one.
+type PasswordPolicyError struct {
+	Failures []models.PasswordRuleFailure
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return utils.ErrWeakPassword.Error()
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return utils.ErrWeakPassword
+}
+
+type PasswordPolicyChecker struct {
+	policy          models.PasswordPolicy
+	commonPasswords map[string]struct{}
+}
+
+// NewPasswordPolicyChecker will create a checker of the given policy, loading the list of
+// common passwords once.
+func NewPasswordPolicyChecker(policy models.PasswordPolicy) (*PasswordPolicyChecker, error) {
+	checker := &PasswordPolicyChecker{
+		policy:          policy,
+		commonPasswords: map[string]struct{}{},
+	}
+	if !policy.RejectCommon {
+		return checker, nil
+	}
+
+	var reader io.Reader = strings.NewReader(bundledCommonPasswords)
+	if policy.CommonPasswordsFile != "" {
+		file, err := os.Open(policy.CommonPasswordsFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		reader = file
+	}
+
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		checker.commonPasswords[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return checker, nil
+}
+
+func (pc *PasswordPolicyChecker) Policy() models.PasswordPolicy {
+	return pc.policy
+}
+
+// Check will return a *PasswordPolicyError listing every rule the password does not satisfy,
+// or nil if it satisfies all of them. The personal info, e.g. the email address and the name
+// of the user, must not be contained in the password.
+func (pc *PasswordPolicyChecker) Check(password string, personalInfo ...string) error {
+	var failures []models.PasswordRuleFailure
+	fail := func(rule string, format string, args ...interface{}) {
+		failures = append(failures, models.PasswordRuleFailure{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	length := utf8.RuneCountInString(password)
+	if pc.policy.MinLength > 0 && length < pc.policy.MinLength {
+		fail(PasswordRuleMinLength, "must be at least %d characters long", pc.policy.MinLength)
+	}
+	if pc.policy.MaxLength > 0 && length > pc.policy.MaxLength {
+		fail(PasswordRuleMaxLength, "must be at most %d characters long", pc.policy.MaxLength)
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsSpace(r):
+			hasSymbol = true
+		}
+	}
+	if pc.policy.RequireUppercase && !hasUpper {
+		fail(PasswordRuleUppercase, "must contain an uppercase letter")
+	}
+	if pc.policy.RequireLowercase && !hasLower {
+		fail(PasswordRuleLowercase, "must contain a lowercase letter")
+	}
+	if pc.policy.RequireDigit && !hasDigit {
+		fail(PasswordRuleDigit, "must contain a digit")
+	}
+	if pc.policy.RequireSymbol && !hasSymbol {
+		fail(PasswordRuleSymbol, "must contain a symbol")
+	}
+
+	lowered := strings.ToLower(password)
+	if pc.policy.RejectPersonalInfo && containsPersonalInfo(lowered, personalInfo) {
+		fail(PasswordRulePersonalInfo, "must not contain your email address or name")
+	}
+	if pc.policy.RejectCommon {
+		if _, found := pc.commonPasswords[lowered]; found {
+			fail(PasswordRuleCommon, "is too common, it appears in lists of breached passwords")
+		}
+	}
+
+	if len(failures) > 0 {
+		return &PasswordPolicyError{Failures: failures}
+	}
+	return nil
+}
+
+// containsPersonalInfo checks the local part of email addresses and every word of names
+// separately, so "john.smith@example.com" rejects both "john" and "smith".
+func containsPersonalInfo(password string, personalInfo []string) bool {
+	for _, info := range personalInfo {
+		info = strings.ToLower(info)
+		if at := strings.Index(info, "@"); at >= 0 {
+			info = info[:at]
+		}
+		parts := strings.FieldsFunc(info, func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, part := range parts {
+			if utf8.RuneCountInString(part) >= minPersonalInfoLength && strings.Contains(password, part) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,19 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+const PKCEMethodS256 = "S256"
+
+// VerifyPKCE checks the code verifier against the S256 code challenge of RFC 7636.
+func VerifyPKCE(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+	hashed := sha256.Sum256([]byte(verifier))
+	expected := base64.RawURLEncoding.EncodeToString(hashed[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(challenge)) == 1
+}
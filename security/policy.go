@@ -0,0 +1,28 @@
+package security
+
+import (
+	"strings"
+
+	"github.com/akunsecured/emezen_api/models"
+)
+
+// CanUpdateProduct tells if the user can change the given product. Only the seller of
+// the product and admins can do it.
+func CanUpdateProduct(principal *models.Principal, product *models.Product) bool {
+	return product.SellerID == principal.UserID || principal.HasRole(models.RoleAdmin)
+}
+
+// CanDeleteProduct tells if the user can delete the given product. Besides the seller and
+// admins, moderators can also remove products.
+func CanDeleteProduct(principal *models.Principal, product *models.Product) bool {
+	return product.SellerID == principal.UserID || principal.HasRole(models.RoleModerator)
+}
+
+// CanAccessMedia tells if the user can get a link to the stored file with the given key.
+// Private files can only be accessed by their owner and admins.
+func CanAccessMedia(principal *models.Principal, key string) bool {
+	if !models.IsPrivateMediaKey(key) {
+		return true
+	}
+	return strings.HasPrefix(key, models.PrivateMediaPrefix+principal.UserID+"/") || principal.HasRole(models.RoleAdmin)
+}
@@ -0,0 +1,48 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"strconv"
+	"time"
+
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+// MediaURLSecretKey is set from the MEDIA_URL_SECRET environment variable at startup.
+var MediaURLSecretKey []byte
+
+const (
+	MediaURLLifetime    = time.Minute * 15
+	MaxMediaURLLifetime = time.Hour * 24
+)
+
+func mediaSignature(key string, expires string) string {
+	mac := hmac.New(sha256.New, MediaURLSecretKey)
+	mac.Write([]byte(key + "\n" + expires))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// SignMediaKey returns the expires and signature query parameters of a link to the stored
+// file with the given key, which is valid until the given time.
+func SignMediaKey(key string, expiresAt time.Time) (string, string) {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires, mediaSignature(key, expires)
+}
+
+// VerifyMediaSignature checks the query parameters of a signed link to the stored file with
+// the given key.
+func VerifyMediaSignature(key string, expires string, signature string) error {
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || signature == "" {
+		return utils.ErrInvalidMediaSignature
+	}
+	if !hmac.Equal([]byte(signature), []byte(mediaSignature(key, expires))) {
+		return utils.ErrInvalidMediaSignature
+	}
+	if time.Now().Unix() > expiresAt {
+		return utils.ErrMediaURLExpired
+	}
+	return nil
+}
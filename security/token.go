@@ -9,46 +9,128 @@ import (
 	"time"
 )
 
-var (
-	JwtSecretKey = []byte("Emezen_SUP3R_S3CR3T_K3Y")
+// JwtSecretKey is set from the JWT_SECRET environment variable at startup.
+var JwtSecretKey []byte
+
+const (
+	AccessTokenLifetime        = time.Hour * 1
+	RefreshTokenLifetime       = time.Hour * 48
+	ImpersonationTokenLifetime = time.Minute * 15
+)
+
+// The token_type claim keeps the different kinds of tokens from being used in place of
+// each other, e.g. a refresh token as an access token.
+const (
+	AccessTokenType      = "access"
+	RefreshTokenType     = "refresh"
+	OAuthAccessTokenType = "oauth_access"
 )
 
+// JwtActor is the act claim of RFC 8693. It is only present in impersonation tokens, where
+// it names the admin acting as the subject of the token.
+type JwtActor struct {
+	Subject string `json:"sub"`
+}
+
 type JwtUserClaims struct {
-	User models.User `json:"user"`
+	User      models.User   `json:"user"`
+	Roles     []models.Role `json:"roles"`
+	TokenType string        `json:"token_type"`
+	Actor     *JwtActor     `json:"act,omitempty"`
+	jwt.StandardClaims
+}
+
+type JwtRefreshClaims struct {
+	TokenType string `json:"token_type"`
+	jwt.StandardClaims
+}
+
+type JwtOAuthClaims struct {
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope"`
+	TokenType string `json:"token_type"`
 	jwt.StandardClaims
 }
 
-func NewAccessToken(user models.User) (string, error) {
+// NewAccessToken will create a short-lived token for the given user. The session ID is
+// stored in the jti claim, so the token can be tied back to the session it was issued for.
+func NewAccessToken(user models.User, sessionId string) (string, error) {
+	userId := user.ID.Hex()
+	claims := JwtUserClaims{
+		user,
+		user.GetRoles(),
+		AccessTokenType,
+		nil,
+		jwt.StandardClaims{
+			Id:        sessionId,
+			Subject:   userId,
+			IssuedAt:  time.Now().Unix(),
+			ExpiresAt: time.Now().Add(AccessTokenLifetime).Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(JwtSecretKey)
+}
+
+// NewImpersonationToken will create an access token which lets the given admin act as the
+// user. It is shorter-lived than a usual access token and cannot be refreshed.
+func NewImpersonationToken(user models.User, sessionId string, actorId string, issuedAt time.Time, expiresAt time.Time) (string, error) {
 	userId := user.ID.Hex()
 	claims := JwtUserClaims{
 		user,
+		user.GetRoles(),
+		AccessTokenType,
+		&JwtActor{Subject: actorId},
+		jwt.StandardClaims{
+			Id:        sessionId,
+			Subject:   userId,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString(JwtSecretKey)
+}
+
+func NewRefreshToken(userId string, sessionId string) (string, error) {
+	claims := JwtRefreshClaims{
+		RefreshTokenType,
 		jwt.StandardClaims{
+			Id:        sessionId,
 			Subject:   userId,
 			IssuedAt:  time.Now().Unix(),
-			ExpiresAt: time.Now().Add(time.Hour * 1).Unix(),
+			ExpiresAt: time.Now().Add(RefreshTokenLifetime).Unix(),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(JwtSecretKey)
 }
 
-func NewRefreshToken(userId string) (string, error) {
-	claims := jwt.StandardClaims{
-		Subject:   userId,
-		IssuedAt:  time.Now().Unix(),
-		ExpiresAt: time.Now().Add(time.Hour * 48).Unix(),
+// NewOAuthAccessToken will create an access token issued to a third-party client. The ID of
+// the stored token record is kept in the jti claim, so the token can be revoked.
+func NewOAuthAccessToken(tokenId string, clientId string, userId string, scope string, issuedAt time.Time, expiresAt time.Time) (string, error) {
+	claims := JwtOAuthClaims{
+		clientId,
+		scope,
+		OAuthAccessTokenType,
+		jwt.StandardClaims{
+			Id:        tokenId,
+			Subject:   userId,
+			IssuedAt:  issuedAt.Unix(),
+			ExpiresAt: expiresAt.Unix(),
+		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString(JwtSecretKey)
 }
 
-func CreateAccessAndRefreshTokens(user models.User) (*models.WrappedToken, error) {
-	accessToken, err := NewAccessToken(user)
+func CreateAccessAndRefreshTokens(user models.User, sessionId string) (*models.WrappedToken, error) {
+	accessToken, err := NewAccessToken(user, sessionId)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken, err := NewRefreshToken(user.ID.Hex())
+	refreshToken, err := NewRefreshToken(user.ID.Hex(), sessionId)
 	if err != nil {
 		return nil, err
 	}
@@ -70,7 +152,11 @@ func ParseToken(tokenString string) (*jwt.MapClaims, error) {
 	if !strings.HasPrefix(tokenString, "Bearer ") {
 		return nil, utils.ErrInvalidTokenFormat
 	}
-	tokenString = strings.Split(tokenString, " ")[1]
+	return ParseRawToken(strings.Split(tokenString, " ")[1])
+}
+
+// ParseRawToken validates a token which is not wrapped in an Authorization header value.
+func ParseRawToken(tokenString string) (*jwt.MapClaims, error) {
 	token, err := jwt.Parse(tokenString, ValidateSignedMethod)
 	if err != nil {
 		return nil, err
@@ -82,3 +168,36 @@ func ParseToken(tokenString string) (*jwt.MapClaims, error) {
 
 	return &claims, nil
 }
+
+// PrincipalFromClaims checks if the claims belong to a token of the given type, and
+// returns the principal described by them. Claims of unexpected types are rejected
+// instead of being asserted, so malformed tokens cannot cause a panic. The roles claim is
+// only informative for the clients, the roles of the principal are loaded from the user.
+func PrincipalFromClaims(claims *jwt.MapClaims, tokenType string) (*models.Principal, error) {
+	if kind, _ := (*claims)["token_type"].(string); kind != tokenType {
+		return nil, utils.ErrInvalidTokenType
+	}
+
+	userId, ok := (*claims)["sub"].(string)
+	if !ok || userId == "" {
+		return nil, utils.ErrTokenParseError
+	}
+	sessionId, ok := (*claims)["jti"].(string)
+	if !ok || sessionId == "" {
+		return nil, utils.ErrTokenParseError
+	}
+
+	var actorId string
+	if actor, ok := (*claims)["act"].(map[string]interface{}); ok {
+		actorId, _ = actor["sub"].(string)
+		if actorId == "" {
+			return nil, utils.ErrTokenParseError
+		}
+	}
+
+	return &models.Principal{
+		UserID:    userId,
+		SessionID: sessionId,
+		ActorID:   actorId,
+	}, nil
+}
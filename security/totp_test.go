@@ -0,0 +1,119 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+// The test vectors of RFC 6238 Appendix B for HMAC-SHA1. The key is the ASCII string
+// "12345678901234567890", which is GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ in base32.
+var (
+	rfc6238Key    = []byte("12345678901234567890")
+	rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+)
+
+var rfc6238Vectors = []struct {
+	time int64
+	step int64
+	code string
+}{
+	{59, 0x1, "94287082"},
+	{1111111109, 0x23523EC, "07081804"},
+	{1111111111, 0x23523ED, "14050471"},
+	{1234567890, 0x273EF07, "89005924"},
+	{2000000000, 0x3F940AA, "69279037"},
+	{20000000000, 0x27BC86AA, "65353130"},
+}
+
+func TestHOTP(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		if code := HOTP(rfc6238Key, uint64(vector.step), 8); code != vector.code {
+			t.Errorf("HOTP at step %#x = %s, want %s", vector.step, code, vector.code)
+		}
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		now := time.Unix(vector.time, 0)
+		if step := TOTPStep(now); step != vector.step {
+			t.Errorf("TOTPStep(%d) = %#x, want %#x", vector.time, step, vector.step)
+		}
+
+		// The codes are six digits long, which are the last six digits of the vectors
+		code, err := TOTPCode(rfc6238Secret, now)
+		if err != nil {
+			t.Fatalf("TOTPCode(%d) returned error: %v", vector.time, err)
+		}
+		if want := vector.code[len(vector.code)-TOTPDigits:]; code != want {
+			t.Errorf("TOTPCode(%d) = %s, want %s", vector.time, code, want)
+		}
+	}
+}
+
+func TestTOTPCodeInvalidSecret(t *testing.T) {
+	if _, err := TOTPCode("not base32!", time.Unix(59, 0)); err == nil {
+		t.Error("TOTPCode accepted an invalid secret")
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		code := vector.code[len(vector.code)-TOTPDigits:]
+		now := time.Unix(vector.time, 0)
+
+		step, ok := ValidateTOTP(rfc6238Secret, code, now)
+		if !ok || step != vector.step {
+			t.Errorf("ValidateTOTP(%d) = %#x, %v, want %#x, true", vector.time, step, ok, vector.step)
+		}
+
+		// Lowercase and padded secrets are accepted as well
+		if _, ok := ValidateTOTP("gezdgnbvgy3tqojqgezdgnbvgy3tqojq====", code, now); !ok {
+			t.Errorf("ValidateTOTP(%d) rejected the lowercase secret", vector.time)
+		}
+
+		if _, ok := ValidateTOTP(rfc6238Secret, vector.code, now); ok {
+			t.Errorf("ValidateTOTP(%d) accepted an eight digit code", vector.time)
+		}
+	}
+}
+
+func TestValidateTOTPDrift(t *testing.T) {
+	vector := rfc6238Vectors[3]
+	code := vector.code[len(vector.code)-TOTPDigits:]
+	generatedAt := time.Unix(vector.time, 0)
+
+	tests := []struct {
+		name  string
+		drift time.Duration
+		valid bool
+	}{
+		{"same period", 0, true},
+		{"one period later", TOTPPeriod * time.Second, true},
+		{"one period earlier", -TOTPPeriod * time.Second, true},
+		{"two periods later", 2 * TOTPPeriod * time.Second, false},
+		{"two periods earlier", -2 * TOTPPeriod * time.Second, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			step, ok := ValidateTOTP(rfc6238Secret, code, generatedAt.Add(test.drift))
+			if ok != test.valid {
+				t.Fatalf("ValidateTOTP = %v, want %v", ok, test.valid)
+			}
+			// The step of the code is returned, not the current one, so it cannot be reused
+			if ok && step != vector.step {
+				t.Errorf("ValidateTOTP returned step %#x, want %#x", step, vector.step)
+			}
+		})
+	}
+}
+
+func TestValidateTOTPWrongCode(t *testing.T) {
+	if _, ok := ValidateTOTP(rfc6238Secret, "000000", time.Unix(59, 0)); ok {
+		t.Error("ValidateTOTP accepted a wrong code")
+	}
+	if _, ok := ValidateTOTP("not base32!", "287082", time.Unix(59, 0)); ok {
+		t.Error("ValidateTOTP accepted an invalid secret")
+	}
+}
@@ -0,0 +1,13 @@
+package services
+
+import "github.com/akunsecured/emezen_api/models"
+
+type APIKeyService interface {
+	CreateAPIKey(*string, *models.APIKeyRequest) (*models.CreatedAPIKey, error)
+	GetAPIKey(*string, *string) (*models.APIKey, error)
+	GetAPIKeysOfUser(*string) ([]*models.APIKey, error)
+	UpdateAPIKey(*string, *string, *models.APIKeyRequest) error
+	DeleteAPIKey(*string, *string) error
+	DeleteAPIKeysOfUser(*string) error
+	Authenticate(string) (*models.APIKey, error)
+}
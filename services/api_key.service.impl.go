@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// APIKeyPrefix marks API keys, so they can be told apart from JWTs in the Authorization header.
+const APIKeyPrefix = "emz_"
+
+type APIKeyServiceImpl struct {
+	apiKeyCollection *mongo.Collection
+	ctx              context.Context
+}
+
+func NewAPIKeyService(apiKeyCollection *mongo.Collection, ctx context.Context) APIKeyService {
+	return &APIKeyServiceImpl{
+		apiKeyCollection: apiKeyCollection,
+		ctx:              ctx,
+	}
+}
+
+func validateAPIKeyRequest(request *models.APIKeyRequest) error {
+	for _, scope := range request.Scopes {
+		if !scope.IsValid() {
+			return utils.ErrInvalidAPIKeyFormat
+		}
+	}
+	if request.ExpiresAt != nil && request.ExpiresAt.Before(time.Now()) {
+		return utils.ErrInvalidAPIKeyFormat
+	}
+	return nil
+}
+
+// CreateAPIKey will generate a new key for the given user. The key is returned only this
+// time, only its hash is stored.
+func (a *APIKeyServiceImpl) CreateAPIKey(userId *string, request *models.APIKeyRequest) (*models.CreatedAPIKey, error) {
+	if err := validateAPIKeyRequest(request); err != nil {
+		return nil, err
+	}
+
+	prefix, err := security.NewRandomToken(4)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := security.NewRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+	key := APIKeyPrefix + prefix + "_" + secret
+
+	apiKey := models.APIKey{
+		ID:        primitive.NewObjectID(),
+		UserID:    *userId,
+		Name:      request.Name,
+		Prefix:    APIKeyPrefix + prefix,
+		KeyHash:   security.HashToken(key),
+		Scopes:    request.Scopes,
+		ExpiresAt: request.ExpiresAt,
+		CreatedAt: time.Now(),
+	}
+	apiKey.UpdatedAt = apiKey.CreatedAt
+
+	_, err = a.apiKeyCollection.InsertOne(a.ctx, apiKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CreatedAPIKey{
+		APIKey: &apiKey,
+		Key:    key,
+	}, nil
+}
+
+func (a *APIKeyServiceImpl) GetAPIKey(userId *string, apiKeyId *string) (*models.APIKey, error) {
+	var apiKey *models.APIKey
+	objID, err := primitive.ObjectIDFromHex(*apiKeyId)
+	if err != nil {
+		return nil, err
+	}
+	query := bson.D{bson.E{Key: "_id", Value: objID}, bson.E{Key: "user_id", Value: *userId}}
+	err = a.apiKeyCollection.FindOne(a.ctx, query).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrNotExists
+	}
+	return apiKey, err
+}
+
+func (a *APIKeyServiceImpl) GetAPIKeysOfUser(userId *string) ([]*models.APIKey, error) {
+	apiKeys := []*models.APIKey{}
+
+	query := bson.D{bson.E{Key: "user_id", Value: *userId}}
+	cur, err := a.apiKeyCollection.Find(a.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(a.ctx) {
+		var apiKey *models.APIKey
+		err := cur.Decode(&apiKey)
+		if err != nil {
+			return nil, err
+		}
+
+		apiKeys = append(apiKeys, apiKey)
+	}
+
+	cur.Close(a.ctx)
+
+	return apiKeys, err
+}
+
+func (a *APIKeyServiceImpl) UpdateAPIKey(userId *string, apiKeyId *string, request *models.APIKeyRequest) error {
+	if err := validateAPIKeyRequest(request); err != nil {
+		return err
+	}
+
+	objID, err := primitive.ObjectIDFromHex(*apiKeyId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}, bson.E{Key: "user_id", Value: *userId}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "name", Value: request.Name},
+		bson.E{Key: "scopes", Value: request.Scopes},
+		bson.E{Key: "expires_at", Value: request.ExpiresAt},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+	result, err := a.apiKeyCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+	return nil
+}
+
+func (a *APIKeyServiceImpl) DeleteAPIKey(userId *string, apiKeyId *string) error {
+	objID, err := primitive.ObjectIDFromHex(*apiKeyId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}, bson.E{Key: "user_id", Value: *userId}}
+	result, err := a.apiKeyCollection.DeleteOne(a.ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount != 1 {
+		return utils.ErrNoMatchedDocumentFoundForDelete
+	}
+	return nil
+}
+
+func (a *APIKeyServiceImpl) DeleteAPIKeysOfUser(userId *string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: *userId}}
+	_, err := a.apiKeyCollection.DeleteMany(a.ctx, filter)
+	return err
+}
+
+// Authenticate will look up the API key by its hash. If it exists and has not expired, its
+// last usage is recorded and it is returned. Otherwise, it will return an error.
+func (a *APIKeyServiceImpl) Authenticate(key string) (*models.APIKey, error) {
+	if !strings.HasPrefix(key, APIKeyPrefix) {
+		return nil, utils.ErrInvalidAPIKey
+	}
+
+	now := time.Now()
+	filter := bson.D{bson.E{Key: "key_hash", Value: security.HashToken(key)}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "last_used_at", Value: now}}}}
+
+	var apiKey *models.APIKey
+	err := a.apiKeyCollection.FindOneAndUpdate(a.ctx, filter, update).Decode(&apiKey)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrInvalidAPIKey
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if apiKey.ExpiresAt != nil && now.After(*apiKey.ExpiresAt) {
+		return nil, utils.ErrInvalidAPIKey
+	}
+	return apiKey, nil
+}
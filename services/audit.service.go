@@ -0,0 +1,13 @@
+package services
+
+import (
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+)
+
+type AuditService interface {
+	Record(*models.AuditEvent, *models.RequestInfo, error)
+	GetEvents(*models.AuditEventQuery) ([]*models.AuditEvent, error)
+	EnsureRetention(time.Duration) error
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	auditRetentionIndexName = "created_at_ttl"
+	defaultAuditQueryLimit  = 100
+)
+
+type AuditServiceImpl struct {
+	auditCollection *mongo.Collection
+	ctx             context.Context
+}
+
+func NewAuditService(auditCollection *mongo.Collection, ctx context.Context) AuditService {
+	return &AuditServiceImpl{
+		auditCollection: auditCollection,
+		ctx:             ctx,
+	}
+}
+
+// Record will append the event to the audit log, with the outcome derived from the error of
+// the action unless it is already set. Failing to record it must not fail the action itself,
+// so the error is only logged.
+func (a *AuditServiceImpl) Record(event *models.AuditEvent, info *models.RequestInfo, err error) {
+	event.ID = primitive.NewObjectID()
+	event.CreatedAt = time.Now()
+	if info != nil {
+		event.IP = info.IP
+		event.UserAgent = info.UserAgent
+		event.RequestID = info.RequestID
+	}
+
+	if event.Outcome == "" {
+		switch err {
+		case nil:
+			event.Outcome = models.AuditOutcomeSuccess
+		case utils.ErrForbidden:
+			event.Outcome = models.AuditOutcomeDenied
+		default:
+			event.Outcome = models.AuditOutcomeFailure
+		}
+	}
+	if err != nil && event.Reason == "" {
+		event.Reason = err.Error()
+	}
+
+	if _, err := a.auditCollection.InsertOne(a.ctx, event); err != nil {
+		log.Print(err)
+	}
+}
+
+// GetEvents will return the latest events matching every given filter.
+func (a *AuditServiceImpl) GetEvents(query *models.AuditEventQuery) ([]*models.AuditEvent, error) {
+	events := []*models.AuditEvent{}
+
+	filter := bson.D{}
+	for _, field := range []bson.E{
+		{Key: "type", Value: query.Type},
+		{Key: "outcome", Value: query.Outcome},
+		{Key: "actor_id", Value: query.ActorID},
+		{Key: "target_id", Value: query.TargetID},
+		{Key: "email", Value: query.Email},
+		{Key: "ip", Value: query.IP},
+		{Key: "request_id", Value: query.RequestID},
+	} {
+		if field.Value != "" {
+			filter = append(filter, field)
+		}
+	}
+
+	createdAt := bson.D{}
+	if !query.From.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$gte", Value: query.From})
+	}
+	if !query.To.IsZero() {
+		createdAt = append(createdAt, bson.E{Key: "$lt", Value: query.To})
+	}
+	if len(createdAt) > 0 {
+		filter = append(filter, bson.E{Key: "created_at", Value: createdAt})
+	}
+
+	limit := query.Limit
+	if limit == 0 {
+		limit = defaultAuditQueryLimit
+	}
+	opts := options.Find().SetSort(bson.D{bson.E{Key: "created_at", Value: -1}}).SetLimit(limit)
+
+	cur, err := a.auditCollection.Find(a.ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(a.ctx) {
+		var event *models.AuditEvent
+		err := cur.Decode(&event)
+		if err != nil {
+			return nil, err
+		}
+
+		events = append(events, event)
+	}
+
+	cur.Close(a.ctx)
+
+	return events, err
+}
+
+// EnsureRetention will make MongoDB delete the events older than the given duration. If the
+// TTL index already exists with another duration, it is changed in place.
+func (a *AuditServiceImpl) EnsureRetention(retention time.Duration) error {
+	seconds := int32(retention.Seconds())
+	index := mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "created_at", Value: 1}},
+		Options: options.Index().SetName(auditRetentionIndexName).SetExpireAfterSeconds(seconds),
+	}
+	_, err := a.auditCollection.Indexes().CreateOne(a.ctx, index)
+	if err == nil {
+		return nil
+	}
+
+	command := bson.D{
+		bson.E{Key: "collMod", Value: a.auditCollection.Name()},
+		bson.E{Key: "index", Value: bson.D{
+			bson.E{Key: "name", Value: auditRetentionIndexName},
+			bson.E{Key: "expireAfterSeconds", Value: seconds},
+		}},
+	}
+	return a.auditCollection.Database().RunCommand(a.ctx, command).Err()
+}
@@ -2,14 +2,28 @@ package services
 
 import (
 	"github.com/akunsecured/emezen_api/models"
-	"github.com/form3tech-oss/jwt-go"
 )
 
 type AuthService interface {
-	Register(*models.UserDataWithCredentials) (*models.WrappedToken, error)
-	Login(*models.UserCredentials) (*models.WrappedToken, error)
-	Update(*models.UserCredentials) error
-	NewAccessToken(*jwt.MapClaims) (*string, error)
-	CurrentUser(*jwt.MapClaims) (*models.User, error)
-	DeleteUser(*jwt.MapClaims) error
+	Register(*models.UserDataWithCredentials, *models.RequestInfo) (*models.WrappedToken, error)
+	Login(*models.UserCredentials, *models.RequestInfo) (*models.WrappedToken, *models.TwoFactorChallenge, error)
+	ChangePassword(*models.Principal, *models.ChangePasswordRequest, *models.RequestInfo) error
+	ChangeEmail(*models.Principal, *models.ChangeEmailRequest, *models.RequestInfo) error
+	NewAccessToken(*models.Principal, *models.RequestInfo) (*string, error)
+	CurrentUser(*models.Principal) (*models.User, error)
+	DeleteUser(*models.Principal, *models.RequestInfo) error
+	ForgotPassword(*models.ForgotPasswordRequest) error
+	ResetPassword(*models.ResetPasswordRequest, *models.RequestInfo) error
+	GetPasswordPolicy() models.PasswordPolicy
+	ResendEmailVerification(*models.Principal) error
+	VerifyEmail(*models.VerifyEmailRequest) error
+	VerifyTwoFactorLogin(*models.TwoFactorLoginRequest, *models.RequestInfo) (*models.WrappedToken, error)
+	EnrollTwoFactor(*models.Principal) (*models.TwoFactorEnrollment, error)
+	ConfirmTwoFactor(*models.Principal, *models.TwoFactorCodeRequest, *models.RequestInfo) ([]string, error)
+	DisableTwoFactor(*models.Principal, *models.TwoFactorCodeRequest, *models.RequestInfo) error
+	UnlockAccount(*models.UnlockAccountRequest) error
+	Impersonate(*models.Principal, *string, *models.RequestInfo) (*models.ImpersonationToken, error)
+	DeleteAccount(*models.Principal, *string, *models.RequestInfo) error
+	EnsureIndexes() error
+	MigrateEmails() (int, []string, error)
 }
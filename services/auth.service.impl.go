@@ -2,36 +2,116 @@ package services
 
 import (
 	"context"
+	"log"
+	"strings"
 	"time"
 
 	"github.com/akunsecured/emezen_api/models"
 	"github.com/akunsecured/emezen_api/security"
 	"github.com/akunsecured/emezen_api/utils"
-	"github.com/form3tech-oss/jwt-go"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	passwordResetTokenLifetime     = time.Hour * 1
+	emailVerificationTokenLifetime = time.Hour * 24
+	loginChallengeLifetime         = time.Minute * 5
+	maxLoginChallengeAttempts      = 5
+	recoveryCodeCount              = 10
+	totpIssuer                     = "Emezen"
 )
 
 type AuthServiceImpl struct {
-	authCollection *mongo.Collection
-	userService    UserService
-	ctx            context.Context
+	authCollection              *mongo.Collection
+	passwordResetCollection     *mongo.Collection
+	emailVerificationCollection *mongo.Collection
+	loginChallengeCollection    *mongo.Collection
+	userService                 UserService
+	sessionService              SessionService
+	mailService                 MailService
+	loginAttemptService         LoginAttemptService
+	apiKeyService               APIKeyService
+	oauthService                OAuthService
+	auditService                AuditService
+	passwordPolicy              *security.PasswordPolicyChecker
+	appUrl                      string
+	ctx                         context.Context
 }
 
-func NewAuthService(authCollection *mongo.Collection, userService UserService, ctx context.Context) AuthService {
+func NewAuthService(authCollection *mongo.Collection, passwordResetCollection *mongo.Collection, emailVerificationCollection *mongo.Collection, loginChallengeCollection *mongo.Collection, userService UserService, sessionService SessionService, mailService MailService, loginAttemptService LoginAttemptService, apiKeyService APIKeyService, oauthService OAuthService, auditService AuditService, passwordPolicy *security.PasswordPolicyChecker, appUrl string, ctx context.Context) AuthService {
 	return &AuthServiceImpl{
-		authCollection: authCollection,
-		userService:    userService,
-		ctx:            ctx,
+		authCollection:              authCollection,
+		passwordResetCollection:     passwordResetCollection,
+		emailVerificationCollection: emailVerificationCollection,
+		loginChallengeCollection:    loginChallengeCollection,
+		userService:                 userService,
+		sessionService:              sessionService,
+		mailService:                 mailService,
+		loginAttemptService:         loginAttemptService,
+		apiKeyService:               apiKeyService,
+		oauthService:                oauthService,
+		auditService:                auditService,
+		passwordPolicy:              passwordPolicy,
+		appUrl:                      appUrl,
+		ctx:                         ctx,
 	}
 }
 
+// EnsureIndexes will create the unique index on the email address of the credentials, so two
+// accounts cannot be registered with the same address at the same time.
+func (a *AuthServiceImpl) EnsureIndexes() error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "email", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := a.authCollection.Indexes().CreateOne(a.ctx, index)
+	return err
+}
+
+// MigrateEmails will normalize the email addresses which were stored before the addresses
+// were normalized, and returns the number of changed credentials. An address which is
+// already used by another account in its normalized form is left as it is, and the ID of
+// its user is returned among the conflicts, so they can be resolved by hand.
+func (a *AuthServiceImpl) MigrateEmails() (int, []string, error) {
+	cur, err := a.authCollection.Find(a.ctx, bson.D{})
+	if err != nil {
+		return 0, nil, err
+	}
+	var credentials []*models.UserCredentials
+	if err := cur.All(a.ctx, &credentials); err != nil {
+		return 0, nil, err
+	}
+
+	changed := 0
+	var conflicts []string
+	for _, credential := range credentials {
+		email := utils.NormalizeEmail(credential.Email)
+		if email == credential.Email {
+			continue
+		}
+		filter := bson.D{bson.E{Key: "_id", Value: credential.ID}}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "email", Value: email}}}}
+		_, err := a.authCollection.UpdateOne(a.ctx, filter, update)
+		if mongo.IsDuplicateKeyError(err) {
+			conflicts = append(conflicts, credential.UserID)
+			continue
+		}
+		if err != nil {
+			return changed, conflicts, err
+		}
+		changed++
+	}
+	return changed, conflicts, nil
+}
+
 // CheckIfExistsWithEmail will check if there are any credentials with the given email address.
 // If so, it will be returned. Otherwise, it will return an error.
 func (a *AuthServiceImpl) CheckIfExistsWithEmail(email string) (*models.UserCredentials, error) {
 	var exists *models.UserCredentials
-	query := bson.D{bson.E{Key: "email", Value: email}}
+	query := bson.D{bson.E{Key: "email", Value: utils.NormalizeEmail(email)}}
 	err := a.authCollection.FindOne(a.ctx, query).Decode(&exists)
 	return exists, err
 }
@@ -49,6 +129,15 @@ func (a *AuthServiceImpl) CheckIfExistsWithID(id string) (*models.UserCredential
 	return exists, err
 }
 
+// CheckIfExistsWithUserID will check if there are any user credentials belonging to the given user.
+// If so, it will be returned. Otherwise, it will return an error.
+func (a *AuthServiceImpl) CheckIfExistsWithUserID(userId string) (*models.UserCredentials, error) {
+	var exists *models.UserCredentials
+	query := bson.D{bson.E{Key: "user_id", Value: userId}}
+	err := a.authCollection.FindOne(a.ctx, query).Decode(&exists)
+	return exists, err
+}
+
 func (a *AuthServiceImpl) DeleteCredentials(id string) error {
 	query := bson.D{bson.E{Key: "user_id", Value: id}}
 	result, err := a.authCollection.DeleteOne(a.ctx, query)
@@ -59,10 +148,39 @@ func (a *AuthServiceImpl) DeleteCredentials(id string) error {
 	return err
 }
 
+// StartSession will create a new session for the given user and return the token pair
+// issued for it.
+func (a *AuthServiceImpl) StartSession(user *models.User) (*models.WrappedToken, error) {
+	userId := user.ID.Hex()
+	sessionId, err := a.sessionService.CreateSession(&userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return security.CreateAccessAndRefreshTokens(*user, *sessionId)
+}
+
+// checkPasswordPolicy will check the new password against the password policy. The email
+// address and the name of the user must not be part of it.
+func (a *AuthServiceImpl) checkPasswordPolicy(password string, email string, user *models.User) error {
+	personalInfo := []string{email}
+	if user != nil {
+		personalInfo = append(personalInfo, user.FirstName, user.LastName, user.ContactEmail)
+	}
+	return a.passwordPolicy.Check(password, personalInfo...)
+}
+
+func (a *AuthServiceImpl) GetPasswordPolicy() models.PasswordPolicy {
+	return a.passwordPolicy.Policy()
+}
+
 // Register will check if the given email address is already in the database.
 // If so, an error will be returned. Otherwise, it will be saved to the database.
-func (a *AuthServiceImpl) Register(userDataWithCredentials *models.UserDataWithCredentials) (*models.WrappedToken, error) {
+func (a *AuthServiceImpl) Register(userDataWithCredentials *models.UserDataWithCredentials, info *models.RequestInfo) (wrappedToken *models.WrappedToken, err error) {
 	var userCredentials = userDataWithCredentials.Credentials
+	userCredentials.Email = utils.NormalizeEmail(userCredentials.Email)
+	event := &models.AuditEvent{Type: models.AuditRegister, Email: userCredentials.Email}
+	defer func() { a.auditService.Record(event, info, err) }()
 
 	exists, err := a.CheckIfExistsWithEmail(userCredentials.Email)
 	if exists != nil {
@@ -74,6 +192,12 @@ func (a *AuthServiceImpl) Register(userDataWithCredentials *models.UserDataWithC
 		if len(userData.ContactEmail) == 0 {
 			userData.ContactEmail = userCredentials.Email
 		}
+
+		err = a.checkPasswordPolicy(userCredentials.Password, userCredentials.Email, &userData)
+		if err != nil {
+			return nil, err
+		}
+
 		userId, err := a.userService.CreateUser(&userData)
 		if err != nil {
 			return nil, err
@@ -88,18 +212,32 @@ func (a *AuthServiceImpl) Register(userDataWithCredentials *models.UserDataWithC
 		userCredentials.UpdatedAt = userCredentials.CreatedAt
 		userCredentials.ID = primitive.NewObjectID()
 		userCredentials.UserID = *userId
+		event.ActorID = *userId
 
+		// The unique index refuses the address if it was registered since it was checked
 		_, err = a.authCollection.InsertOne(a.ctx, userCredentials)
+		if mongo.IsDuplicateKeyError(err) {
+			if err := a.userService.DeleteUser(userId); err != nil {
+				log.Print(err)
+			}
+			return nil, utils.ErrEmailIsAlreadyInUse
+		}
 		if err != nil {
 			return nil, err
 		}
 
+		// The account is usable right away, it only stays unverified until the link is opened
+		err = a.SendEmailVerification(*userId, userCredentials.Email)
+		if err != nil {
+			log.Print(err)
+		}
+
 		userData.ID, err = primitive.ObjectIDFromHex(*userId)
 		if err != nil {
 			return nil, err
 		}
 
-		wrappedToken, err := security.CreateAccessAndRefreshTokens(userData)
+		wrappedToken, err := a.StartSession(&userData)
 		if err != nil {
 			return nil, err
 		}
@@ -109,46 +247,154 @@ func (a *AuthServiceImpl) Register(userDataWithCredentials *models.UserDataWithC
 	return nil, err
 }
 
-// Login will check if the given email is in the database. If not, it will return an error.
-// Otherwise, it will check if the password matches with the one in the database. If so, it
-// will return a JWT token. Otherwise, it will return an error.
-func (a *AuthServiceImpl) Login(userCredentials *models.UserCredentials) (*models.WrappedToken, error) {
+// Login will check if the given email is in the database and the password matches with the
+// one in the database. If so, it will return a JWT token, or a login challenge if the account
+// has two-factor authentication enabled. Otherwise, it will return the same error in both cases,
+// so it cannot be used to find out which email addresses are registered. Failed attempts are
+// counted both for the account and the IP address, and they get locked temporarily after too
+// many of them.
+func (a *AuthServiceImpl) Login(userCredentials *models.UserCredentials, info *models.RequestInfo) (wrappedToken *models.WrappedToken, challenge *models.TwoFactorChallenge, err error) {
+	userCredentials.Email = utils.NormalizeEmail(userCredentials.Email)
+	event := &models.AuditEvent{Type: models.AuditLogin, Email: userCredentials.Email}
+	defer func() {
+		if challenge != nil {
+			event.Outcome = models.AuditOutcomeChallenged
+		}
+		a.auditService.Record(event, info, err)
+	}()
+
+	accountKey := accountLoginKey(userCredentials.Email)
+	ipKey := ipLoginKey(info.IP)
+	err = a.loginAttemptService.CheckLocked(accountKey, ipKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	exists, err := a.CheckIfExistsWithEmail(userCredentials.Email)
-	if err == mongo.ErrNoDocuments {
-		return nil, utils.ErrNoAccountWithThisEmail
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, nil, err
+	}
+
+	if exists == nil {
+		security.VerifyDummyPassword(userCredentials.Password)
+		err = utils.ErrInvalidCredentials
+	} else {
+		event.ActorID = exists.UserID
+		if security.VerifyPassword(exists.Password, userCredentials.Password) != nil {
+			err = utils.ErrInvalidCredentials
+		}
 	}
 	if err != nil {
-		return nil, err
+		a.registerLoginFailure(accountKey, ipKey)
+		return nil, nil, err
 	}
 
-	err = security.VerifyPassword(exists.Password, userCredentials.Password)
+	err = a.loginAttemptService.Reset(accountKey)
 	if err != nil {
-		return nil, utils.ErrInvalidPassword
+		return nil, nil, err
+	}
+
+	if security.NeedsRehash(exists.Password) {
+		// The login must not fail because of this, the hash is upgraded next time then
+		if err := a.rehashPassword(exists, userCredentials.Password); err != nil {
+			log.Print(err)
+		}
+	}
+
+	if exists.TwoFactorEnabled {
+		challenge, err := a.CreateLoginChallenge(exists.UserID)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, challenge, nil
 	}
 
 	user, err := a.userService.GetUser(&exists.UserID)
 	if err != nil {
-		return nil, mongo.ErrNoDocuments
+		return nil, nil, mongo.ErrNoDocuments
 	}
 
-	wrappedToken, err := security.CreateAccessAndRefreshTokens(*user)
+	wrappedToken, err = a.StartSession(user)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return wrappedToken, nil, nil
+}
+
+// rehashPassword will replace the stored hash of the credentials with one created by the
+// current hasher. It can only be done right after the password was verified, since that is
+// the only time the plain password is known.
+func (a *AuthServiceImpl) rehashPassword(credentials *models.UserCredentials, password string) error {
+	encryptedPassword, err := security.EncryptPassword(password)
+	if err != nil {
+		return err
+	}
+
+	// The hash is only replaced if the password was not changed in the meantime
+	filter := bson.D{bson.E{Key: "_id", Value: credentials.ID}, bson.E{Key: "password", Value: credentials.Password}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password", Value: encryptedPassword}}}}
+	_, err = a.authCollection.UpdateOne(a.ctx, filter, update)
+	return err
+}
+
+// checkCurrentPassword will return the credentials of the given principal if the given
+// password is the current one. Wrong guesses are counted like failed logins.
+func (a *AuthServiceImpl) checkCurrentPassword(principal *models.Principal, password string) (*models.UserCredentials, error) {
+	credentials, err := a.CheckIfExistsWithUserID(principal.UserID)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrNotExists
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	return wrappedToken, nil
+	accountKey := accountLoginKey(credentials.Email)
+	err = a.loginAttemptService.CheckLocked(accountKey)
+	if err != nil {
+		return nil, err
+	}
+	if security.VerifyPassword(credentials.Password, password) != nil {
+		a.registerLoginFailure(accountKey)
+		return nil, utils.ErrWrongCurrentPassword
+	}
+	return credentials, nil
 }
 
-// Update will check if the given account is in the database. If not, it will return an error.
-// Otherwise, it will update the credentials.
-func (a *AuthServiceImpl) Update(userCredentials *models.UserCredentials) error {
-	encryptedPassword, err := security.EncryptPassword(userCredentials.Password)
+// revokeOtherSessions will revoke every session of the given principal, except the one the
+// request came from.
+func (a *AuthServiceImpl) revokeOtherSessions(principal *models.Principal) error {
+	return a.sessionService.RevokeOtherSessionsOfUser(&principal.UserID, &principal.SessionID)
+}
+
+// ChangePassword will set a new password for the current user if the current password is
+// given correctly. Every other session of the user is revoked afterwards.
+func (a *AuthServiceImpl) ChangePassword(principal *models.Principal, request *models.ChangePasswordRequest, info *models.RequestInfo) (err error) {
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditPasswordChange, ActorID: principal.UserID, TargetID: principal.UserID}, info, err)
+	}()
+
+	credentials, err := a.checkCurrentPassword(principal, request.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	user, err := a.userService.GetUser(&principal.UserID)
+	if err != nil {
+		return utils.ErrNotExists
+	}
+	err = a.checkPasswordPolicy(request.NewPassword, credentials.Email, user)
+	if err != nil {
+		return err
+	}
+
+	encryptedPassword, err := security.EncryptPassword(request.NewPassword)
 	if err != nil {
 		return err
 	}
 
-	filter := bson.D{bson.E{Key: "_id", Value: userCredentials.ID}}
-	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "email", Value: userCredentials.Email}, bson.E{Key: "password", Value: encryptedPassword}, bson.E{Key: "updated_at", Value: time.Now()}}}}
+	filter := bson.D{bson.E{Key: "_id", Value: credentials.ID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password", Value: encryptedPassword}, bson.E{Key: "updated_at", Value: time.Now()}}}}
 	result, err := a.authCollection.UpdateOne(a.ctx, filter, update)
 	if err != nil {
 		return err
@@ -156,18 +402,56 @@ func (a *AuthServiceImpl) Update(userCredentials *models.UserCredentials) error
 	if result.MatchedCount != 1 {
 		return utils.ErrNotExists
 	}
-	return nil
+
+	return a.revokeOtherSessions(principal)
 }
 
-// NewAccessToken will try to parse the incoming token string and create a new access token from
-// the user ID given in the refresh token's claims
-func (a *AuthServiceImpl) NewAccessToken(claims *jwt.MapClaims) (*string, error) {
-	user, err := a.CurrentUser(claims)
+// ChangeEmail will send a verification link to the new email address of the current user if
+// the current password is given correctly. The address is only changed once it is confirmed.
+// Every other session of the user is revoked afterwards.
+func (a *AuthServiceImpl) ChangeEmail(principal *models.Principal, request *models.ChangeEmailRequest, info *models.RequestInfo) (err error) {
+	request.Email = utils.NormalizeEmail(request.Email)
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditEmailChange, ActorID: principal.UserID, TargetID: principal.UserID, Email: request.Email}, info, err)
+	}()
+
+	credentials, err := a.checkCurrentPassword(principal, request.CurrentPassword)
+	if err != nil {
+		return err
+	}
+
+	if request.Email == utils.NormalizeEmail(credentials.Email) {
+		return utils.ErrEmailIsUnchanged
+	}
+	exists, err := a.CheckIfExistsWithEmail(request.Email)
+	if exists != nil {
+		return utils.ErrEmailIsAlreadyInUse
+	}
+	if err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	err = a.SendEmailVerification(credentials.UserID, request.Email)
+	if err != nil {
+		return err
+	}
+
+	return a.revokeOtherSessions(principal)
+}
+
+// NewAccessToken will create a new access token for the principal of a refresh token. The
+// session of the refresh token is checked by the authentication middleware beforehand.
+func (a *AuthServiceImpl) NewAccessToken(principal *models.Principal, info *models.RequestInfo) (token *string, err error) {
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditTokenRefresh, ActorID: principal.UserID}, info, err)
+	}()
+
+	user, err := a.CurrentUser(principal)
 	if err != nil {
 		return nil, err
 	}
 
-	newToken, err := security.NewAccessToken(*user)
+	newToken, err := security.NewAccessToken(*user, principal.SessionID)
 	if err != nil {
 		return nil, err
 	}
@@ -175,10 +459,8 @@ func (a *AuthServiceImpl) NewAccessToken(claims *jwt.MapClaims) (*string, error)
 	return &newToken, nil
 }
 
-func (a *AuthServiceImpl) CurrentUser(claims *jwt.MapClaims) (*models.User, error) {
-	userId := (*claims)["sub"].(string)
-
-	user, err := a.userService.GetUser(&userId)
+func (a *AuthServiceImpl) CurrentUser(principal *models.Principal) (*models.User, error) {
+	user, err := a.userService.GetUser(&principal.UserID)
 	if err != nil {
 		return nil, err
 	}
@@ -186,15 +468,587 @@ func (a *AuthServiceImpl) CurrentUser(claims *jwt.MapClaims) (*models.User, erro
 	return user, nil
 }
 
-func (a *AuthServiceImpl) DeleteUser(claims *jwt.MapClaims) error {
-	userId := (*claims)["sub"].(string)
+func (a *AuthServiceImpl) DeleteUser(principal *models.Principal, info *models.RequestInfo) error {
+	return a.DeleteAccount(principal, &principal.UserID, info)
+}
+
+// DeleteAccount will delete the user with the given ID together with the credentials and
+// API keys, and revoke every session of the user and every grant of third-party clients. The
+// principal is the one who deletes it, either the user or an admin.
+func (a *AuthServiceImpl) DeleteAccount(principal *models.Principal, id *string, info *models.RequestInfo) (err error) {
+	userId := *id
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditAccountDelete, ActorID: principal.UserID, TargetID: userId}, info, err)
+	}()
 
-	err := a.userService.DeleteUser(&userId)
+	err = a.userService.DeleteUser(&userId)
 	if err != nil {
 		return err
 	}
 
 	err = a.DeleteCredentials(userId)
+	if err != nil {
+		return err
+	}
+
+	err = a.apiKeyService.DeleteAPIKeysOfUser(&userId)
+	if err != nil {
+		return err
+	}
+
+	err = a.oauthService.RevokeGrantsOfUser(&userId)
+	if err != nil {
+		return err
+	}
+
+	return a.sessionService.RevokeAllSessionsOfUser(&userId)
+}
+
+// Impersonate will issue a short-lived access token with which the admin of the principal can
+// act as the given user. Admins and the admin itself cannot be impersonated, so it cannot be
+// used to gain other privileges.
+func (a *AuthServiceImpl) Impersonate(principal *models.Principal, id *string, info *models.RequestInfo) (impersonationToken *models.ImpersonationToken, err error) {
+	userId := *id
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditImpersonate, ActorID: principal.UserID, TargetID: userId}, info, err)
+	}()
+
+	if principal.IsImpersonated() || userId == principal.UserID {
+		return nil, utils.ErrCannotImpersonate
+	}
+
+	user, err := a.userService.GetUser(&userId)
+	if err != nil {
+		return nil, utils.ErrNotExists
+	}
+	if models.HasRole(user.Roles, models.RoleAdmin) {
+		return nil, utils.ErrCannotImpersonate
+	}
+
+	session, err := a.sessionService.CreateImpersonationSession(&userId, &principal.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := security.NewImpersonationToken(*user, session.ID.Hex(), principal.UserID, session.CreatedAt, session.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ImpersonationToken{
+		AccessToken: accessToken,
+		ActorID:     principal.UserID,
+		SubjectID:   userId,
+		ExpiresAt:   session.ExpiresAt,
+	}, nil
+}
+
+// ForgotPassword will send a single-use reset link to the given email address if there is
+// an account with it. The outcome is the same whether the account exists or not, so the
+// caller cannot use it to find out which addresses are registered.
+func (a *AuthServiceImpl) ForgotPassword(request *models.ForgotPasswordRequest) error {
+	request.Email = utils.NormalizeEmail(request.Email)
+	exists, err := a.CheckIfExistsWithEmail(request.Email)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	token, err := security.NewRandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest reset link should be usable
+	filter := bson.D{bson.E{Key: "user_id", Value: exists.UserID}, bson.E{Key: "used_at", Value: nil}}
+	_, err = a.passwordResetCollection.DeleteMany(a.ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	resetToken := models.PasswordResetToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    exists.UserID,
+		TokenHash: security.HashToken(token),
+		CreatedAt: time.Now(),
+	}
+	resetToken.ExpiresAt = resetToken.CreatedAt.Add(passwordResetTokenLifetime)
+
+	_, err = a.passwordResetCollection.InsertOne(a.ctx, resetToken)
+	if err != nil {
+		return err
+	}
+
+	return a.mailService.SendMail(&models.Mail{
+		To:      exists.Email,
+		Subject: "Reset your Emezen password",
+		Body: "Someone requested a password reset for your Emezen account.\n\n" +
+			"You can set a new password with the following link in the next hour:\n" +
+			a.appUrl + "/reset_password?token=" + token + "\n\n" +
+			"If it was not you, you can ignore this email.",
+	})
+}
+
+// ResetPassword will check if the given reset token is valid. If so, it will be marked as used,
+// the password will be changed and every session of the user will be revoked. Otherwise, it
+// will return an error.
+func (a *AuthServiceImpl) ResetPassword(request *models.ResetPasswordRequest, info *models.RequestInfo) (err error) {
+	event := &models.AuditEvent{Type: models.AuditPasswordReset}
+	defer func() { a.auditService.Record(event, info, err) }()
+
+	now := time.Now()
+	filter := bson.D{
+		bson.E{Key: "token_hash", Value: security.HashToken(request.Token)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+	}
+
+	// The token is only used up once the new password satisfies the policy, so the user can
+	// try again with the same link
+	var resetToken *models.PasswordResetToken
+	err = a.passwordResetCollection.FindOne(a.ctx, filter).Decode(&resetToken)
+	if err == mongo.ErrNoDocuments {
+		return utils.ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	event.TargetID = resetToken.UserID
+
+	credentials, err := a.CheckIfExistsWithUserID(resetToken.UserID)
+	if err == mongo.ErrNoDocuments {
+		return utils.ErrNotExists
+	}
+	if err != nil {
+		return err
+	}
+	user, err := a.userService.GetUser(&resetToken.UserID)
+	if err != nil {
+		return utils.ErrNotExists
+	}
+	err = a.checkPasswordPolicy(request.Password, credentials.Email, user)
+	if err != nil {
+		return err
+	}
+
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}}}
+	err = a.passwordResetCollection.FindOneAndUpdate(a.ctx, filter, update).Decode(&resetToken)
+	if err == mongo.ErrNoDocuments {
+		return utils.ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+
+	encryptedPassword, err := security.EncryptPassword(request.Password)
+	if err != nil {
+		return err
+	}
+
+	filter = bson.D{bson.E{Key: "user_id", Value: resetToken.UserID}}
+	update = bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "password", Value: encryptedPassword}, bson.E{Key: "updated_at", Value: now}}}}
+	result, err := a.authCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+
+	return a.sessionService.RevokeAllSessionsOfUser(&resetToken.UserID)
+}
+
+// SendEmailVerification will send a single-use verification link to the given email address.
+// Opening it will set the address as the login email of the user and mark it as verified.
+func (a *AuthServiceImpl) SendEmailVerification(userId string, email string) error {
+	token, err := security.NewRandomToken(32)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest verification link should be usable
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "used_at", Value: nil}}
+	_, err = a.emailVerificationCollection.DeleteMany(a.ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	verificationToken := models.EmailVerificationToken{
+		ID:        primitive.NewObjectID(),
+		UserID:    userId,
+		Email:     email,
+		TokenHash: security.HashToken(token),
+		CreatedAt: time.Now(),
+	}
+	verificationToken.ExpiresAt = verificationToken.CreatedAt.Add(emailVerificationTokenLifetime)
+
+	_, err = a.emailVerificationCollection.InsertOne(a.ctx, verificationToken)
+	if err != nil {
+		return err
+	}
+
+	return a.mailService.SendMail(&models.Mail{
+		To:      email,
+		Subject: "Verify your email address",
+		Body: "Please confirm that this email address belongs to your Emezen account " +
+			"by opening the following link in the next 24 hours:\n" +
+			a.appUrl + "/verify_email?token=" + token + "\n\n" +
+			"If it was not you, you can ignore this email.",
+	})
+}
+
+// ResendEmailVerification will send a new verification link to the current email address
+// of the user, unless it is already verified.
+func (a *AuthServiceImpl) ResendEmailVerification(principal *models.Principal) error {
+	user, err := a.CurrentUser(principal)
+	if err != nil {
+		return err
+	}
+	if user.EmailVerified {
+		return utils.ErrEmailIsAlreadyVerified
+	}
+
+	credentials, err := a.CheckIfExistsWithUserID(user.ID.Hex())
+	if err != nil {
+		return err
+	}
+
+	return a.SendEmailVerification(credentials.UserID, credentials.Email)
+}
+
+// VerifyEmail will check if the given verification token is valid. If so, it will be marked
+// as used, the email address stored with it will become the login email of the user and the
+// user will be marked as verified. Otherwise, it will return an error.
+func (a *AuthServiceImpl) VerifyEmail(request *models.VerifyEmailRequest) error {
+	now := time.Now()
+	filter := bson.D{
+		bson.E{Key: "token_hash", Value: security.HashToken(request.Token)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+	}
+
+	var verificationToken *models.EmailVerificationToken
+	err := a.emailVerificationCollection.FindOne(a.ctx, filter).Decode(&verificationToken)
+	if err == mongo.ErrNoDocuments {
+		return utils.ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return err
+	}
+
+	// Somebody else could have registered with the address since the link was sent. This is
+	// checked before the token is used up, so the link still works once the conflict is gone.
+	exists, err := a.CheckIfExistsWithEmail(verificationToken.Email)
+	if exists != nil && exists.UserID != verificationToken.UserID {
+		return utils.ErrEmailIsAlreadyInUse
+	}
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	// The filter still requires the token to be unused, so concurrent requests cannot both
+	// use it
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}}}
+	err = a.emailVerificationCollection.FindOneAndUpdate(a.ctx, filter, update).Err()
+	if err == mongo.ErrNoDocuments {
+		return utils.ErrInvalidVerificationToken
+	}
+	if err != nil {
+		return err
+	}
+
+	filter = bson.D{bson.E{Key: "user_id", Value: verificationToken.UserID}}
+	update = bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "email", Value: utils.NormalizeEmail(verificationToken.Email)}, bson.E{Key: "updated_at", Value: now}}}}
+	result, err := a.authCollection.UpdateOne(a.ctx, filter, update)
+	if mongo.IsDuplicateKeyError(err) {
+		return utils.ErrEmailIsAlreadyInUse
+	}
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+
+	return a.userService.SetEmailVerified(&verificationToken.UserID, true)
+}
+
+// registerLoginFailure will count a failed login for every given key. The account and IP
+// keys have different thresholds, since many users can share an IP address.
+func (a *AuthServiceImpl) registerLoginFailure(keys ...string) {
+	for _, key := range keys {
+		threshold := accountLoginThreshold
+		if strings.HasPrefix(key, ipLoginKey("")) {
+			threshold = ipLoginThreshold
+		}
+		if err := a.loginAttemptService.RegisterFailure(key, threshold); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// UnlockAccount will lift the lockout of the given account, and of the given IP address if
+// there is one.
+func (a *AuthServiceImpl) UnlockAccount(request *models.UnlockAccountRequest) error {
+	err := a.loginAttemptService.Reset(accountLoginKey(request.Email))
+	if err != nil {
+		return err
+	}
+	if request.IP != "" {
+		return a.loginAttemptService.Reset(ipLoginKey(request.IP))
+	}
+	return nil
+}
+
+// CreateLoginChallenge will save a short-lived, single-use challenge for the given user and
+// return the token which has to be sent back together with a valid two-factor code.
+func (a *AuthServiceImpl) CreateLoginChallenge(userId string) (*models.TwoFactorChallenge, error) {
+	token, err := security.NewRandomToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge := models.LoginChallenge{
+		ID:        primitive.NewObjectID(),
+		UserID:    userId,
+		TokenHash: security.HashToken(token),
+		CreatedAt: time.Now(),
+	}
+	challenge.ExpiresAt = challenge.CreatedAt.Add(loginChallengeLifetime)
+
+	_, err = a.loginChallengeCollection.InsertOne(a.ctx, challenge)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorChallenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresAt:         challenge.ExpiresAt,
+	}, nil
+}
+
+// VerifyTwoFactorLogin will check if the given challenge is valid and the code belongs to
+// its user. If so, it will return the JWT tokens. Otherwise, it will return an error. A
+// challenge can only be tried a limited number of times.
+func (a *AuthServiceImpl) VerifyTwoFactorLogin(request *models.TwoFactorLoginRequest, info *models.RequestInfo) (wrappedToken *models.WrappedToken, err error) {
+	event := &models.AuditEvent{Type: models.AuditLoginTwoFactor}
+	defer func() { a.auditService.Record(event, info, err) }()
+
+	now := time.Now()
+	filter := bson.D{
+		bson.E{Key: "token_hash", Value: security.HashToken(request.ChallengeToken)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+		bson.E{Key: "attempts", Value: bson.D{bson.E{Key: "$lt", Value: maxLoginChallengeAttempts}}},
+	}
+	update := bson.D{bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "attempts", Value: 1}}}}
+
+	var challenge *models.LoginChallenge
+	err = a.loginChallengeCollection.FindOneAndUpdate(a.ctx, filter, update).Decode(&challenge)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrInvalidLoginChallenge
+	}
+	if err != nil {
+		return nil, err
+	}
+	event.ActorID = challenge.UserID
+
+	credentials, err := a.CheckIfExistsWithUserID(challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if !credentials.TwoFactorEnabled {
+		return nil, utils.ErrTwoFactorNotEnabled
+	}
+
+	err = a.CheckSecondFactor(credentials, request.Code)
+	if err == utils.ErrInvalidTwoFactorCode {
+		a.registerLoginFailure(accountLoginKey(credentials.Email))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	filter = bson.D{bson.E{Key: "_id", Value: challenge.ID}, bson.E{Key: "used_at", Value: nil}}
+	update = bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}}}
+	result, err := a.loginChallengeCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+	if result.ModifiedCount != 1 {
+		return nil, utils.ErrInvalidLoginChallenge
+	}
+
+	user, err := a.userService.GetUser(&challenge.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.StartSession(user)
+}
+
+// CheckSecondFactor will accept either a TOTP code, which was not used before, or one of the
+// unused recovery codes of the user. A recovery code is removed once it is used.
+func (a *AuthServiceImpl) CheckSecondFactor(credentials *models.UserCredentials, code string) error {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+
+	step, ok := security.ValidateTOTP(credentials.TOTPSecret, code, time.Now())
+	if ok {
+		// The same code cannot be used twice, even within its period
+		filter := bson.D{
+			bson.E{Key: "_id", Value: credentials.ID},
+			bson.E{Key: "totp_last_step", Value: bson.D{bson.E{Key: "$lt", Value: step}}},
+		}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "totp_last_step", Value: step}}}}
+		result, err := a.authCollection.UpdateOne(a.ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount != 1 {
+			return utils.ErrInvalidTwoFactorCode
+		}
+		return nil
+	}
+
+	filter := bson.D{
+		bson.E{Key: "_id", Value: credentials.ID},
+		bson.E{Key: "recovery_code_hashes", Value: security.HashToken(strings.ToLower(code))},
+	}
+	update := bson.D{bson.E{Key: "$pull", Value: bson.D{bson.E{Key: "recovery_code_hashes", Value: security.HashToken(strings.ToLower(code))}}}}
+	result, err := a.authCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.ModifiedCount != 1 {
+		return utils.ErrInvalidTwoFactorCode
+	}
+	return nil
+}
+
+// EnrollTwoFactor will generate a new TOTP secret for the current user. It is only stored as
+// pending until it is confirmed with a valid code.
+func (a *AuthServiceImpl) EnrollTwoFactor(principal *models.Principal) (*models.TwoFactorEnrollment, error) {
+	user, err := a.CurrentUser(principal)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := a.CheckIfExistsWithUserID(user.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if credentials.TwoFactorEnabled {
+		return nil, utils.ErrTwoFactorAlreadyEnabled
+	}
+
+	secret, err := security.NewTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.D{bson.E{Key: "_id", Value: credentials.ID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "pending_totp_secret", Value: secret}, bson.E{Key: "updated_at", Value: time.Now()}}}}
+	_, err = a.authCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorEnrollment{
+		Secret: secret,
+		URI:    security.TOTPURI(totpIssuer, credentials.Email, secret),
+	}, nil
+}
+
+// ConfirmTwoFactor will enable two-factor authentication if the code matches the pending
+// secret. The returned recovery codes are only shown this time, only their hashes are stored.
+func (a *AuthServiceImpl) ConfirmTwoFactor(principal *models.Principal, request *models.TwoFactorCodeRequest, info *models.RequestInfo) (recoveryCodes []string, err error) {
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditTwoFactorOn, ActorID: principal.UserID, TargetID: principal.UserID}, info, err)
+	}()
+
+	user, err := a.CurrentUser(principal)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials, err := a.CheckIfExistsWithUserID(user.ID.Hex())
+	if err != nil {
+		return nil, err
+	}
+	if credentials.TwoFactorEnabled {
+		return nil, utils.ErrTwoFactorAlreadyEnabled
+	}
+	if credentials.PendingTOTPSecret == "" {
+		return nil, utils.ErrTwoFactorNotEnrolled
+	}
+
+	step, ok := security.ValidateTOTP(credentials.PendingTOTPSecret, request.Code, time.Now())
+	if !ok {
+		return nil, utils.ErrInvalidTwoFactorCode
+	}
+
+	recoveryCodes = make([]string, recoveryCodeCount)
+	recoveryCodeHashes := make([]string, recoveryCodeCount)
+	for i := range recoveryCodes {
+		recoveryCodes[i], err = security.NewRandomToken(5)
+		if err != nil {
+			return nil, err
+		}
+		recoveryCodeHashes[i] = security.HashToken(recoveryCodes[i])
+	}
+
+	filter := bson.D{bson.E{Key: "_id", Value: credentials.ID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "two_factor_enabled", Value: true},
+		bson.E{Key: "totp_secret", Value: credentials.PendingTOTPSecret},
+		bson.E{Key: "pending_totp_secret", Value: ""},
+		bson.E{Key: "totp_last_step", Value: step},
+		bson.E{Key: "recovery_code_hashes", Value: recoveryCodeHashes},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+	_, err = a.authCollection.UpdateOne(a.ctx, filter, update)
+	if err != nil {
+		return nil, err
+	}
+
+	return recoveryCodes, nil
+}
+
+// DisableTwoFactor will turn off two-factor authentication if the given code is valid.
+func (a *AuthServiceImpl) DisableTwoFactor(principal *models.Principal, request *models.TwoFactorCodeRequest, info *models.RequestInfo) (err error) {
+	defer func() {
+		a.auditService.Record(&models.AuditEvent{Type: models.AuditTwoFactorOff, ActorID: principal.UserID, TargetID: principal.UserID}, info, err)
+	}()
+
+	user, err := a.CurrentUser(principal)
+	if err != nil {
+		return err
+	}
+
+	credentials, err := a.CheckIfExistsWithUserID(user.ID.Hex())
+	if err != nil {
+		return err
+	}
+	if !credentials.TwoFactorEnabled {
+		return utils.ErrTwoFactorNotEnabled
+	}
+
+	err = a.CheckSecondFactor(credentials, request.Code)
+	if err != nil {
+		return err
+	}
 
+	filter := bson.D{bson.E{Key: "_id", Value: credentials.ID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "two_factor_enabled", Value: false},
+		bson.E{Key: "totp_secret", Value: ""},
+		bson.E{Key: "totp_last_step", Value: 0},
+		bson.E{Key: "recovery_code_hashes", Value: []string{}},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+	_, err = a.authCollection.UpdateOne(a.ctx, filter, update)
 	return err
 }
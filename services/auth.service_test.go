@@ -0,0 +1,66 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/akunsecured/emezen_api/models"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func newAuthTestService(mt *mtest.T) *AuthServiceImpl {
+	database := mt.Client.Database(storageTestDatabase)
+	return &AuthServiceImpl{authCollection: database.Collection("credentials"), ctx: context.Background()}
+}
+
+func TestEmailIsLookedUpNormalized(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("forgot password", func(mt *mtest.T) {
+		service := newAuthTestService(mt)
+		mt.AddMockResponses(mtest.CreateCursorResponse(0, storageTestDatabase+".credentials", mtest.FirstBatch))
+
+		if err := service.ForgotPassword(&models.ForgotPasswordRequest{Email: " User@Example.COM "}); err != nil {
+			t.Fatal(err)
+		}
+		filter := storageTestCommand(mt, "find", "credentials").Lookup("filter")
+		if email := filter.Document().Lookup("email").StringValue(); email != "user@example.com" {
+			t.Errorf("the credentials were looked up by %q, want %q", email, "user@example.com")
+		}
+	})
+}
+
+func TestMigrateEmails(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("migrate", func(mt *mtest.T) {
+		service := newAuthTestService(mt)
+		normalized := models.UserCredentials{ID: primitive.NewObjectID(), UserID: "normalized", Email: "user@example.com"}
+		mixed := models.UserCredentials{ID: primitive.NewObjectID(), UserID: "mixed", Email: "Other@Example.com"}
+		conflicting := models.UserCredentials{ID: primitive.NewObjectID(), UserID: "conflicting", Email: "USER@example.com"}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, storageTestDatabase+".credentials", mtest.FirstBatch, storageTestDocument(mt, normalized), storageTestDocument(mt, mixed), storageTestDocument(mt, conflicting)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+		)
+
+		changed, conflicts, err := service.MigrateEmails()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != 1 {
+			t.Errorf("%d emails were normalized, want 1", changed)
+		}
+		if len(conflicts) != 1 || conflicts[0] != conflicting.UserID {
+			t.Errorf("the conflicts are %v, want [%s]", conflicts, conflicting.UserID)
+		}
+		update := storageTestCommand(mt, "update", "credentials").Lookup("updates").Array().Index(0).Value().Document()
+		if email := update.Lookup("u", "$set", "email").StringValue(); email != "other@example.com" {
+			t.Errorf("the email was set to %q, want %q", email, "other@example.com")
+		}
+	})
+}
@@ -0,0 +1,245 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+type FilesystemBlobStore struct {
+	root       string
+	hashes     map[string]filesystemBlobHash
+	hashesLock sync.Mutex
+}
+
+// filesystemBlobHash is the hash of a file, which is valid as long as the size and the
+// modification time of the file are the same.
+type filesystemBlobHash struct {
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+// NewFilesystemBlobStore will create a blob store keeping the files under the given
+// directory. It is only suitable for a single API instance.
+func NewFilesystemBlobStore(root string) BlobStore {
+	return &FilesystemBlobStore{
+		root:   root,
+		hashes: make(map[string]filesystemBlobHash),
+	}
+}
+
+func (f *FilesystemBlobStore) filePath(key string) (string, error) {
+	if err := checkBlobKey(key); err != nil {
+		return "", err
+	}
+	return filepath.Join(f.root, filepath.FromSlash(key)), nil
+}
+
+func (f *FilesystemBlobStore) info(key string, fileInfo fs.FileInfo) *models.BlobInfo {
+	return &models.BlobInfo{
+		Key:         key,
+		Size:        fileInfo.Size(),
+		ContentType: blobContentType(key, ""),
+		ModTime:     fileInfo.ModTime(),
+		Hash:        f.cachedHash(key, fileInfo),
+		Private:     models.IsPrivateMediaKey(key),
+	}
+}
+
+// cachedHash returns the hash of the file if it is known and the file has not changed since.
+func (f *FilesystemBlobStore) cachedHash(key string, fileInfo fs.FileInfo) string {
+	f.hashesLock.Lock()
+	defer f.hashesLock.Unlock()
+
+	cached, ok := f.hashes[key]
+	if !ok || cached.size != fileInfo.Size() || !cached.modTime.Equal(fileInfo.ModTime()) {
+		return ""
+	}
+	return cached.hash
+}
+
+func (f *FilesystemBlobStore) cacheHash(key string, fileInfo fs.FileInfo, hash string) {
+	f.hashesLock.Lock()
+	defer f.hashesLock.Unlock()
+
+	f.hashes[key] = filesystemBlobHash{
+		size:    fileInfo.Size(),
+		modTime: fileInfo.ModTime(),
+		hash:    hash,
+	}
+}
+
+// hashFile will compute the hash of the file unless it is cached already. The files have no
+// place for metadata, so the hashes of files written by an earlier run are computed when
+// they are first read.
+func (f *FilesystemBlobStore) hashFile(key string, filePath string, fileInfo fs.FileInfo) error {
+	if f.cachedHash(key, fileInfo) != "" {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	f.cacheHash(key, fileInfo, hex.EncodeToString(hash.Sum(nil)))
+	return nil
+}
+
+// Put will write the file to a temporary file first and rename it afterwards, so readers
+// never see a partially written file. The content type is derived from the extension.
+func (f *FilesystemBlobStore) Put(key string, contentType string, reader io.Reader) (*models.BlobInfo, error) {
+	filePath, err := f.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Dir(filePath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	tmp, err := os.CreateTemp(dir, ".upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(tmp, hash), reader)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return nil, err
+	}
+	fileInfo, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	f.cacheHash(key, fileInfo, hex.EncodeToString(hash.Sum(nil)))
+	return f.info(key, fileInfo), nil
+}
+
+func (f *FilesystemBlobStore) Get(key string, offset int64, length int64) (io.ReadCloser, *models.BlobInfo, error) {
+	filePath, err := f.filePath(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, nil, utils.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fileInfo, err := file.Stat()
+	if err == nil && fileInfo.IsDir() {
+		err = utils.ErrBlobNotFound
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	length, err = checkBlobRange(fileInfo.Size(), offset, length)
+	if err == nil {
+		err = f.hashFile(key, filePath, fileInfo)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	return newLimitedReadCloser(file, length), f.info(key, fileInfo), nil
+}
+
+func (f *FilesystemBlobStore) Delete(key string) error {
+	filePath, err := f.filePath(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(filePath)
+	if os.IsNotExist(err) {
+		return utils.ErrBlobNotFound
+	}
+	return err
+}
+
+func (f *FilesystemBlobStore) Stat(key string) (*models.BlobInfo, error) {
+	filePath, err := f.filePath(key)
+	if err != nil {
+		return nil, err
+	}
+
+	fileInfo, err := os.Stat(filePath)
+	if os.IsNotExist(err) || (err == nil && fileInfo.IsDir()) {
+		return nil, utils.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := f.hashFile(key, filePath, fileInfo); err != nil {
+		return nil, err
+	}
+	return f.info(key, fileInfo), nil
+}
+
+// List will return every file whose key starts with the given prefix.
+func (f *FilesystemBlobStore) List(prefix string) ([]*models.BlobInfo, error) {
+	blobs := []*models.BlobInfo{}
+
+	err := filepath.WalkDir(f.root, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".upload-") {
+			return nil
+		}
+
+		relative, err := filepath.Rel(f.root, filePath)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(relative)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		blobs = append(blobs, f.info(key, fileInfo))
+		return nil
+	})
+	return blobs, err
+}
@@ -0,0 +1,146 @@
+package services
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+// BlobStore stores the uploaded files, so the API instances do not depend on their local
+// disk. Get reads length bytes from the offset, or the rest of the file if length is negative.
+type BlobStore interface {
+	Put(string, string, io.Reader) (*models.BlobInfo, error)
+	Get(string, int64, int64) (io.ReadCloser, *models.BlobInfo, error)
+	Delete(string) error
+	Stat(string) (*models.BlobInfo, error)
+	List(string) ([]*models.BlobInfo, error)
+}
+
+// checkBlobKey will reject keys which could escape the root of the store, so they can be
+// built from user input safely.
+func checkBlobKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") || path.Clean(key) != key {
+		return utils.ErrInvalidBlobKey
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "." || part == ".." {
+			return utils.ErrInvalidBlobKey
+		}
+	}
+	return nil
+}
+
+// blobContentType returns the given content type, or guesses it from the extension of the
+// key if it is empty.
+func blobContentType(key string, contentType string) string {
+	if contentType != "" {
+		return contentType
+	}
+	if guessed := mime.TypeByExtension(path.Ext(key)); guessed != "" {
+		return guessed
+	}
+	return "application/octet-stream"
+}
+
+// checkBlobRange will check the requested range against the size of the blob and return the
+// number of bytes to read.
+func checkBlobRange(size int64, offset int64, length int64) (int64, error) {
+	if offset < 0 || offset > size {
+		return 0, utils.ErrInvalidBlobRange
+	}
+	if length < 0 || offset+length > size {
+		length = size - offset
+	}
+	return length, nil
+}
+
+// limitedReadCloser reads at most the given number of bytes, and closes the underlying
+// reader.
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newLimitedReadCloser(rc io.ReadCloser, length int64) io.ReadCloser {
+	return &limitedReadCloser{Reader: io.LimitReader(rc, length), Closer: rc}
+}
+
+// blobReadSeeker reads a blob from the store as if it was a file, so it can be served with
+// http.ServeContent. Seeking is free, the blob is only opened again at the new offset when
+// it is read.
+type blobReadSeeker struct {
+	blobStore    BlobStore
+	key          string
+	size         int64
+	offset       int64
+	reader       io.ReadCloser
+	readerOffset int64
+}
+
+// OpenBlob will open the blob with the given key for reading and seeking.
+func OpenBlob(blobStore BlobStore, key string) (io.ReadSeekCloser, *models.BlobInfo, error) {
+	reader, info, err := blobStore.Get(key, 0, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &blobReadSeeker{
+		blobStore: blobStore,
+		key:       key,
+		size:      info.Size,
+		reader:    reader,
+	}, info, nil
+}
+
+func (b *blobReadSeeker) Read(p []byte) (int, error) {
+	if b.reader != nil && b.readerOffset != b.offset {
+		b.reader.Close()
+		b.reader = nil
+	}
+	if b.offset >= b.size {
+		return 0, io.EOF
+	}
+	if b.reader == nil {
+		reader, _, err := b.blobStore.Get(b.key, b.offset, -1)
+		if err != nil {
+			return 0, err
+		}
+		b.reader = reader
+		b.readerOffset = b.offset
+	}
+
+	n, err := b.reader.Read(p)
+	b.offset += int64(n)
+	b.readerOffset += int64(n)
+	return n, err
+}
+
+func (b *blobReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += b.offset
+	case io.SeekEnd:
+		offset += b.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, utils.ErrInvalidBlobRange
+	}
+	b.offset = offset
+	return offset, nil
+}
+
+func (b *blobReadSeeker) Close() error {
+	if b.reader == nil {
+		return nil
+	}
+	err := b.reader.Close()
+	b.reader = nil
+	return err
+}
@@ -0,0 +1,187 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"regexp"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/gridfs"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type GridFSBlobStore struct {
+	bucket *gridfs.Bucket
+	ctx    context.Context
+}
+
+// NewGridFSBlobStore will create a blob store keeping the files in the given GridFS bucket,
+// so they are shared by every API instance.
+func NewGridFSBlobStore(bucket *gridfs.Bucket, ctx context.Context) BlobStore {
+	return &GridFSBlobStore{
+		bucket: bucket,
+		ctx:    ctx,
+	}
+}
+
+type gridFSMetadata struct {
+	ContentType string `bson:"content_type"`
+	SHA256      string `bson:"sha256,omitempty"`
+}
+
+func (g *GridFSBlobStore) info(file *gridfs.File) *models.BlobInfo {
+	var metadata gridFSMetadata
+	if file.Metadata != nil {
+		_ = bson.Unmarshal(file.Metadata, &metadata)
+	}
+
+	return &models.BlobInfo{
+		Key:         file.Name,
+		Size:        file.Length,
+		ContentType: blobContentType(file.Name, metadata.ContentType),
+		ModTime:     file.UploadDate,
+		Hash:        metadata.SHA256,
+		Private:     models.IsPrivateMediaKey(file.Name),
+	}
+}
+
+// findFiles will return the files stored with the given key, the latest one first.
+func (g *GridFSBlobStore) findFiles(filter bson.D) ([]*gridfs.File, error) {
+	opts := options.GridFSFind().SetSort(bson.D{bson.E{Key: "uploadDate", Value: -1}})
+	cur, err := g.bucket.Find(filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*gridfs.File
+	err = cur.All(g.ctx, &files)
+	return files, err
+}
+
+// Put will upload the file and delete the older revisions with the same key afterwards, so
+// readers never see a partially written file.
+func (g *GridFSBlobStore) Put(key string, contentType string, reader io.Reader) (*models.BlobInfo, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+
+	metadata := gridFSMetadata{ContentType: blobContentType(key, contentType)}
+	uploadOptions := options.GridFSUpload().SetMetadata(metadata)
+	hash := sha256.New()
+	fileId, err := g.bucket.UploadFromStream(key, io.TeeReader(reader, hash), uploadOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	// The hash is only known after the upload, so it is added to the metadata afterwards
+	filter := bson.D{bson.E{Key: "_id", Value: fileId}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "metadata.sha256", Value: hex.EncodeToString(hash.Sum(nil))}}}}
+	if _, err := g.bucket.GetFilesCollection().UpdateOne(g.ctx, filter, update); err != nil {
+		return nil, err
+	}
+
+	files, err := g.findFiles(bson.D{bson.E{Key: "filename", Value: key}})
+	if err != nil {
+		return nil, err
+	}
+	var uploaded *gridfs.File
+	for _, file := range files {
+		if file.ID == fileId {
+			uploaded = file
+			continue
+		}
+		if err := g.bucket.Delete(file.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return nil, err
+		}
+	}
+	if uploaded == nil {
+		return nil, utils.ErrBlobNotFound
+	}
+	return g.info(uploaded), nil
+}
+
+func (g *GridFSBlobStore) Get(key string, offset int64, length int64) (io.ReadCloser, *models.BlobInfo, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, nil, err
+	}
+
+	stream, err := g.bucket.OpenDownloadStreamByName(key)
+	if err == gridfs.ErrFileNotFound {
+		return nil, nil, utils.ErrBlobNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := g.info(stream.GetFile())
+	length, err = checkBlobRange(info.Size, offset, length)
+	if err == nil && offset > 0 {
+		_, err = stream.Skip(offset)
+	}
+	if err != nil {
+		stream.Close()
+		return nil, nil, err
+	}
+
+	return newLimitedReadCloser(stream, length), info, nil
+}
+
+func (g *GridFSBlobStore) Delete(key string) error {
+	if err := checkBlobKey(key); err != nil {
+		return err
+	}
+
+	files, err := g.findFiles(bson.D{bson.E{Key: "filename", Value: key}})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return utils.ErrBlobNotFound
+	}
+	for _, file := range files {
+		if err := g.bucket.Delete(file.ID); err != nil && err != gridfs.ErrFileNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *GridFSBlobStore) Stat(key string) (*models.BlobInfo, error) {
+	if err := checkBlobKey(key); err != nil {
+		return nil, err
+	}
+
+	files, err := g.findFiles(bson.D{bson.E{Key: "filename", Value: key}})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, utils.ErrBlobNotFound
+	}
+	return g.info(files[0]), nil
+}
+
+// List will return the latest revision of every file whose key starts with the given prefix.
+func (g *GridFSBlobStore) List(prefix string) ([]*models.BlobInfo, error) {
+	blobs := []*models.BlobInfo{}
+
+	filter := bson.D{bson.E{Key: "filename", Value: bson.D{bson.E{Key: "$regex", Value: "^" + regexp.QuoteMeta(prefix)}}}}
+	files, err := g.findFiles(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	for _, file := range files {
+		if seen[file.Name] {
+			continue
+		}
+		seen[file.Name] = true
+		blobs = append(blobs, g.info(file))
+	}
+	return blobs, nil
+}
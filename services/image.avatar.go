@@ -0,0 +1,105 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"golang.org/x/image/draw"
+)
+
+// The profile pictures are squares of this size in pixels, smaller pictures are not upscaled
+const profilePictureSize = 256
+
+// The default avatars are a symmetric grid of identiconCells squares in each direction
+const (
+	identiconCells    = 5
+	identiconCellSize = 44
+	identiconMargin   = (profilePictureSize - identiconCells*identiconCellSize) / 2
+)
+
+var identiconBackground = color.NRGBA{R: 0xF0, G: 0xF0, B: 0xF0, A: 0xFF}
+
+// SaveProfilePicture will crop the middle square of the uploaded image, scale it down to the
+// size of the profile pictures and store it as a PNG under the ID of the user, replacing
+// the previous one.
+func (i *ImageServiceImpl) SaveProfilePicture(userId string, fileHeader *multipart.FileHeader) (*models.StoredImage, error) {
+	uploaded, err := i.loadImage(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(bytes.NewReader(uploaded.data))
+	if err != nil {
+		return nil, utils.ErrInvalidImage
+	}
+
+	bounds := src.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	crop := image.Rect(0, 0, side, side).Add(bounds.Min).Add(image.Pt((bounds.Dx()-side)/2, (bounds.Dy()-side)/2))
+
+	size := side
+	if size > profilePictureSize {
+		size = profilePictureSize
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, dst); err != nil {
+		return nil, err
+	}
+
+	key := models.ProfilePictureKey(userId)
+	if _, err := i.blobStore.Put(key, "image/png", bytes.NewReader(buffer.Bytes())); err != nil {
+		return nil, err
+	}
+
+	return &models.StoredImage{
+		Key:         key,
+		FileName:    fileHeader.Filename,
+		ContentType: "image/png",
+		Size:        int64(buffer.Len()),
+		Width:       size,
+		Height:      size,
+	}, nil
+}
+
+// DefaultAvatar will generate an identicon PNG for the user with the given ID. The pattern
+// and the color are derived from the hash of the ID, so every user keeps the same one.
+func (i *ImageServiceImpl) DefaultAvatar(userId string) ([]byte, error) {
+	hash := sha256.Sum256([]byte(userId))
+	foreground := color.NRGBA{R: 48 + hash[0]%160, G: 48 + hash[1]%160, B: 48 + hash[2]%160, A: 0xFF}
+
+	img := image.NewNRGBA(image.Rect(0, 0, profilePictureSize, profilePictureSize))
+	draw.Draw(img, img.Bounds(), image.NewUniform(identiconBackground), image.Point{}, draw.Src)
+
+	// Only the left half and the middle column are taken from the hash, the right half
+	// mirrors them
+	for row := 0; row < identiconCells; row++ {
+		for column := 0; column < (identiconCells+1)/2; column++ {
+			bit := row*identiconCells + column
+			if hash[3+bit/8]&(1<<(bit%8)) == 0 {
+				continue
+			}
+			for _, x := range []int{column, identiconCells - 1 - column} {
+				cell := image.Rect(0, 0, identiconCellSize, identiconCellSize).
+					Add(image.Pt(identiconMargin+x*identiconCellSize, identiconMargin+row*identiconCellSize))
+				draw.Draw(img, cell, image.NewUniform(foreground), image.Point{}, draw.Src)
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
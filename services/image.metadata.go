@@ -0,0 +1,444 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+// Images are re-encoded with this quality when they have to be rotated
+const orientedJpegQuality = 92
+
+const exifOrientationTag = 0x0112
+
+var (
+	jpegExifHeader = []byte("Exif\x00\x00")
+	jpegIccHeader  = []byte("ICC_PROFILE\x00")
+	pngSignature   = []byte("\x89PNG\r\n\x1a\n")
+	gif87Signature = []byte("GIF87a")
+	gif89Signature = []byte("GIF89a")
+)
+
+// pngMetadataChunks are the chunks which can carry EXIF data or free text.
+var pngMetadataChunks = map[string]bool{
+	"eXIf": true,
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"tIME": true,
+}
+
+// webpImageChunks are the chunks of a WebP file which are needed to display it. Every other
+// chunk is dropped, e.g. EXIF and XMP, which can carry the location of a photo.
+var webpImageChunks = map[string]bool{
+	"VP8X": true,
+	"VP8 ": true,
+	"VP8L": true,
+	"ALPH": true,
+	"ANIM": true,
+	"ANMF": true,
+	"ICCP": true,
+}
+
+// The flags of the VP8X chunk telling that the file has EXIF or XMP chunks.
+const (
+	webpExifFlag = 0x08
+	webpXmpFlag  = 0x04
+)
+
+// gifLoopExtensions are the application extensions of GIF files which are kept, since they
+// tell how many times an animation is played. Every other application extension and the
+// comments are dropped.
+var gifLoopExtensions = map[string]bool{
+	"NETSCAPE2.0": true,
+	"ANIMEXTS1.0": true,
+}
+
+// stripImageMetadata will remove the metadata of the image, which can contain the location
+// where a photo was taken. If the EXIF orientation of a JPEG or PNG image says the image is
+// rotated or mirrored, the pixels are transformed instead, so the image still displays
+// upright. Other images are copied without the metadata, without being re-encoded.
+func stripImageMetadata(data []byte, format string) ([]byte, error) {
+	switch format {
+	case "jpeg":
+		stripped, orientation, err := stripJpegMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 {
+			return stripped, nil
+		}
+		return orientImage(stripped, orientation, func(buffer *bytes.Buffer, img image.Image) error {
+			return jpeg.Encode(buffer, img, &jpeg.Options{Quality: orientedJpegQuality})
+		})
+	case "png":
+		stripped, orientation, err := stripPngMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 {
+			return stripped, nil
+		}
+		return orientImage(stripped, orientation, func(buffer *bytes.Buffer, img image.Image) error {
+			return png.Encode(buffer, img)
+		})
+	case "webp":
+		return stripWebpMetadata(data)
+	case "gif":
+		return stripGifMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// stripJpegMetadata will drop the comments and the application segments other than the JFIF
+// header, the color profile and the Adobe color transform, which are needed to display the
+// image correctly. The orientation is read from the EXIF segment before it is dropped. Every
+// scan is walked, since progressive images can have segments between them.
+func stripJpegMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, 0, utils.ErrInvalidImage
+	}
+
+	output := bytes.NewBuffer(make([]byte, 0, len(data)))
+	output.Write(data[:2])
+	orientation := 0
+
+	position := 2
+	for {
+		if position+2 > len(data) || data[position] != 0xFF {
+			return nil, 0, utils.ErrInvalidImage
+		}
+		marker := data[position+1]
+		if marker == 0xFF {
+			// Fill byte before a marker
+			position++
+			continue
+		}
+		if marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7) {
+			// Markers without a length
+			output.Write(data[position : position+2])
+			position += 2
+			continue
+		}
+		if marker == 0xD9 {
+			// Anything after the end of the image, e.g. the other images of an MPO file with
+			// their own EXIF data, is dropped
+			output.Write(data[position : position+2])
+			return output.Bytes(), orientation, nil
+		}
+
+		if position+4 > len(data) {
+			return nil, 0, utils.ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint16(data[position+2 : position+4]))
+		end := position + 2 + length
+		if length < 2 || end > len(data) {
+			return nil, 0, utils.ErrInvalidImage
+		}
+		segment := data[position+4 : end]
+
+		keep := true
+		switch {
+		case marker == 0xE1:
+			if bytes.HasPrefix(segment, jpegExifHeader) && orientation == 0 {
+				orientation = exifOrientation(segment[len(jpegExifHeader):])
+			}
+			keep = false
+		case marker == 0xE2:
+			keep = bytes.HasPrefix(segment, jpegIccHeader)
+		case marker >= 0xE3 && marker <= 0xEF:
+			keep = marker == 0xEE
+		case marker == 0xFE:
+			keep = false
+		}
+		if keep {
+			output.Write(data[position:end])
+		}
+		position = end
+
+		if marker == 0xDA {
+			// The entropy-coded data of the scan follows, which ends at the next marker
+			// other than a restart marker. 0xFF bytes in the data are followed by a zero.
+			start := position
+			for position+1 < len(data) {
+				if data[position] == 0xFF && data[position+1] != 0x00 && (data[position+1] < 0xD0 || data[position+1] > 0xD7) {
+					break
+				}
+				position++
+			}
+			if position+1 >= len(data) {
+				// Keep the image usable if it was truncated before the end marker
+				output.Write(data[start:])
+				return output.Bytes(), orientation, nil
+			}
+			output.Write(data[start:position])
+		}
+	}
+}
+
+// stripPngMetadata will drop the EXIF and text chunks. The chunks are copied as they are, so
+// their checksums stay valid.
+func stripPngMetadata(data []byte) ([]byte, int, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, 0, utils.ErrInvalidImage
+	}
+
+	output := bytes.NewBuffer(make([]byte, 0, len(data)))
+	output.Write(pngSignature)
+	orientation := 0
+
+	position := len(pngSignature)
+	for position < len(data) {
+		if position+8 > len(data) {
+			return nil, 0, utils.ErrInvalidImage
+		}
+		length := int(binary.BigEndian.Uint32(data[position : position+4]))
+		chunkType := string(data[position+4 : position+8])
+		end := position + 12 + length
+		if length < 0 || end > len(data) || end < position {
+			return nil, 0, utils.ErrInvalidImage
+		}
+
+		if chunkType == "eXIf" && orientation == 0 {
+			orientation = exifOrientation(data[position+8 : position+8+length])
+		}
+		if !pngMetadataChunks[chunkType] {
+			output.Write(data[position:end])
+		}
+		position = end
+		if chunkType == "IEND" {
+			break
+		}
+	}
+	return output.Bytes(), orientation, nil
+}
+
+// stripWebpMetadata will copy the chunks needed to display the image, and clear the flags of
+// the dropped EXIF and XMP chunks in the VP8X header. Browsers ignore the EXIF orientation of
+// WebP images, so the pixels are not transformed. Anything after the RIFF container is
+// dropped as well.
+func stripWebpMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, utils.ErrInvalidImage
+	}
+	riffEnd := 8 + int(binary.LittleEndian.Uint32(data[4:8]))
+	if riffEnd > len(data) || riffEnd < 12 {
+		return nil, utils.ErrInvalidImage
+	}
+
+	output := bytes.NewBuffer(make([]byte, 0, riffEnd))
+	output.Write(data[:12])
+
+	position := 12
+	for position < riffEnd {
+		if position+8 > riffEnd {
+			return nil, utils.ErrInvalidImage
+		}
+		chunkType := string(data[position : position+4])
+		length := int(binary.LittleEndian.Uint32(data[position+4 : position+8]))
+		// Chunks are padded to an even length
+		end := position + 8 + length + length%2
+		if length < 0 || end > riffEnd || end < position {
+			return nil, utils.ErrInvalidImage
+		}
+
+		if webpImageChunks[chunkType] {
+			start := output.Len()
+			output.Write(data[position:end])
+			if chunkType == "VP8X" && length > 0 {
+				output.Bytes()[start+8] &^= webpExifFlag | webpXmpFlag
+			}
+		}
+		position = end
+	}
+
+	stripped := output.Bytes()
+	binary.LittleEndian.PutUint32(stripped[4:8], uint32(len(stripped)-8))
+	return stripped, nil
+}
+
+// stripGifMetadata will drop the comment extensions and the application extensions other than
+// the loop count of animations, e.g. XMP data. The images and their control extensions are
+// copied as they are, and anything after the trailer is dropped.
+func stripGifMetadata(data []byte) ([]byte, error) {
+	if len(data) < 13 || !(bytes.HasPrefix(data, gif87Signature) || bytes.HasPrefix(data, gif89Signature)) {
+		return nil, utils.ErrInvalidImage
+	}
+
+	// The header, the logical screen descriptor and the global color table
+	position := 13
+	if data[10]&0x80 != 0 {
+		position += 3 << (data[10]&0x07 + 1)
+	}
+	if position > len(data) {
+		return nil, utils.ErrInvalidImage
+	}
+	output := bytes.NewBuffer(make([]byte, 0, len(data)))
+	output.Write(data[:position])
+
+	// A truncated file is copied as far as it goes, the decoder handles the rest
+	for position < len(data) {
+		switch data[position] {
+		case 0x3B:
+			output.WriteByte(0x3B)
+			return output.Bytes(), nil
+		case 0x21:
+			if position+2 > len(data) {
+				return nil, utils.ErrInvalidImage
+			}
+			label := data[position+1]
+			end, err := gifSubBlocksEnd(data, position+2)
+			if err != nil {
+				return nil, err
+			}
+			keep := label != 0xFE && label != 0xFF
+			if label == 0xFF && position+14 <= end && data[position+2] == 11 {
+				keep = gifLoopExtensions[string(data[position+3:position+14])]
+			}
+			if keep {
+				output.Write(data[position:end])
+			}
+			position = end
+		case 0x2C:
+			// The image descriptor, the local color table and the LZW minimum code size
+			end := position + 10
+			if end > len(data) {
+				return nil, utils.ErrInvalidImage
+			}
+			if data[position+9]&0x80 != 0 {
+				end += 3 << (data[position+9]&0x07 + 1)
+			}
+			end, err := gifSubBlocksEnd(data, end+1)
+			if err != nil {
+				return nil, err
+			}
+			output.Write(data[position:end])
+			position = end
+		default:
+			return nil, utils.ErrInvalidImage
+		}
+	}
+	return output.Bytes(), nil
+}
+
+// gifSubBlocksEnd returns the position after the data sub-blocks starting at the given
+// position, including the terminating empty block.
+func gifSubBlocksEnd(data []byte, position int) (int, error) {
+	for {
+		if position >= len(data) {
+			return 0, utils.ErrInvalidImage
+		}
+		size := int(data[position])
+		position += 1 + size
+		if size == 0 {
+			return position, nil
+		}
+	}
+}
+
+// exifOrientation reads the orientation tag from the first directory of the TIFF structure of
+// the EXIF data. It returns 0 if the tag is missing or the data is malformed.
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 0
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 0
+	}
+	count := int(order.Uint16(tiff[offset : offset+2]))
+	for index := 0; index < count; index++ {
+		entry := offset + 2 + index*12
+		if entry+12 > len(tiff) {
+			return 0
+		}
+		if order.Uint16(tiff[entry:entry+2]) != exifOrientationTag {
+			continue
+		}
+		// The value is a single SHORT, stored in the first bytes of the value field
+		if order.Uint16(tiff[entry+2:entry+4]) != 3 {
+			return 0
+		}
+		orientation := int(order.Uint16(tiff[entry+8 : entry+10]))
+		if orientation < 1 || orientation > 8 {
+			return 0
+		}
+		return orientation
+	}
+	return 0
+}
+
+// orientImage will decode the image, transform it as the EXIF orientation describes and
+// encode it again. The encoders do not write any metadata.
+func orientImage(data []byte, orientation int, encode func(*bytes.Buffer, image.Image) error) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, utils.ErrInvalidImage
+	}
+
+	var buffer bytes.Buffer
+	if err := encode(&buffer, applyOrientation(img, orientation)); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// applyOrientation will transform the image, so it is displayed upright without the EXIF
+// orientation. The orientations are numbered as in the EXIF specification.
+func applyOrientation(img image.Image, orientation int) image.Image {
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2:
+				dx, dy = width-1-x, y
+			case 3:
+				dx, dy = width-1-x, height-1-y
+			case 4:
+				dx, dy = x, height-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = height-1-y, x
+			case 7:
+				dx, dy = height-1-y, width-1-x
+			case 8:
+				dx, dy = y, width-1-x
+			default:
+				dx, dy = x, y
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
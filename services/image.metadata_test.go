@@ -0,0 +1,227 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The images in testdata show four colored quadrants when displayed upright. Their pixels are
+// stored rotated or mirrored, and their EXIF data has the orientation which makes them upright,
+// together with a GPS position and a comment, which must not be kept.
+var uprightQuadrants = []struct {
+	x, y  int
+	color color.NRGBA
+}{
+	{16, 12, color.NRGBA{R: 220, G: 20, B: 20, A: 255}},
+	{48, 12, color.NRGBA{R: 20, G: 200, B: 20, A: 255}},
+	{16, 36, color.NRGBA{R: 20, G: 20, B: 220, A: 255}},
+	{48, 36, color.NRGBA{R: 230, G: 230, B: 20, A: 255}},
+}
+
+var leakedMetadata = [][]byte{
+	[]byte("Exif\x00\x00"),
+	[]byte("GPS-FIX"),
+	[]byte("secret comment"),
+	[]byte("MPF\x00"),
+	[]byte("eXIf"),
+	[]byte("tEXt"),
+	[]byte("xmpmeta"),
+}
+
+func readTestdata(t *testing.T, name string) []byte {
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func checkNoMetadata(t *testing.T, data []byte) {
+	t.Helper()
+	for _, leaked := range leakedMetadata {
+		if bytes.Contains(data, leaked) {
+			t.Errorf("the stripped image still contains %q", leaked)
+		}
+	}
+}
+
+func checkUpright(t *testing.T, data []byte) {
+	t.Helper()
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("the stripped image cannot be decoded: %v", err)
+	}
+	if size := img.Bounds().Size(); size.X != 64 || size.Y != 48 {
+		t.Fatalf("the stripped image is %v, want 64x48", size)
+	}
+
+	for _, quadrant := range uprightQuadrants {
+		got := color.NRGBAModel.Convert(img.At(img.Bounds().Min.X+quadrant.x, img.Bounds().Min.Y+quadrant.y)).(color.NRGBA)
+		if !similarColor(got, quadrant.color) {
+			t.Errorf("pixel at %d,%d is %v, want %v", quadrant.x, quadrant.y, got, quadrant.color)
+		}
+	}
+}
+
+// similarColor tolerates the changes of the lossy JPEG compression.
+func similarColor(a, b color.NRGBA) bool {
+	difference := func(x, y uint8) int {
+		if x > y {
+			return int(x - y)
+		}
+		return int(y - x)
+	}
+	return difference(a.R, b.R) < 32 && difference(a.G, b.G) < 32 && difference(a.B, b.B) < 32 && a.A == b.A
+}
+
+func TestStripJpegMetadataOrientation(t *testing.T) {
+	for orientation := 1; orientation <= 8; orientation++ {
+		t.Run(fmt.Sprint(orientation), func(t *testing.T) {
+			data := readTestdata(t, fmt.Sprintf("orientation_%d.jpg", orientation))
+
+			_, found, err := stripJpegMetadata(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found != orientation {
+				t.Errorf("orientation = %d, want %d", found, orientation)
+			}
+
+			stripped, err := stripImageMetadata(data, "jpeg")
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkNoMetadata(t, stripped)
+			checkUpright(t, stripped)
+		})
+	}
+}
+
+func TestStripJpegMetadataWithoutRotationIsLossless(t *testing.T) {
+	data := readTestdata(t, "orientation_1.jpg")
+	stripped, err := stripImageMetadata(data, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the metadata segments are removed, the scan is copied as it is
+	original, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, _, err := image.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(original.(*image.YCbCr).Y, copied.(*image.YCbCr).Y) {
+		t.Error("the image was re-encoded")
+	}
+	if len(stripped) >= len(data) {
+		t.Errorf("the stripped image has %d bytes, the original %d", len(stripped), len(data))
+	}
+}
+
+func TestStripJpegMetadataTrailingImage(t *testing.T) {
+	data := readTestdata(t, "mpf_trailing_image.jpg")
+	if bytes.Count(data, []byte{0xFF, 0xD8}) != 2 || !bytes.Contains(data, []byte("GPS-FIX")) {
+		t.Fatal("the test image should contain a second image with a GPS position")
+	}
+
+	stripped, err := stripImageMetadata(data, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoMetadata(t, stripped)
+	checkUpright(t, stripped)
+
+	if count := bytes.Count(stripped, []byte{0xFF, 0xD8}); count != 1 {
+		t.Errorf("the stripped image has %d start markers, want 1", count)
+	}
+	if !bytes.HasSuffix(stripped, []byte{0xFF, 0xD9}) {
+		t.Error("the stripped image does not end at the end marker")
+	}
+}
+
+func TestStripJpegMetadataTruncated(t *testing.T) {
+	data := readTestdata(t, "orientation_1.jpg")
+	truncated := data[:len(data)-2]
+
+	stripped, err := stripImageMetadata(truncated, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoMetadata(t, stripped)
+}
+
+func TestStripPngMetadata(t *testing.T) {
+	data := readTestdata(t, "exif_orientation_6.png")
+
+	_, orientation, err := stripPngMetadata(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if orientation != 6 {
+		t.Errorf("orientation = %d, want 6", orientation)
+	}
+
+	stripped, err := stripImageMetadata(data, "png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoMetadata(t, stripped)
+	checkUpright(t, stripped)
+}
+
+func TestStripWebpMetadata(t *testing.T) {
+	data := readTestdata(t, "exif_gps.webp")
+	if !bytes.Contains(data, []byte("EXIF")) || !bytes.Contains(data, []byte("GPS-FIX")) {
+		t.Fatal("the test image should contain an EXIF chunk with a GPS position")
+	}
+
+	stripped, err := stripImageMetadata(append(data, "trailing GPS-FIX"...), "webp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoMetadata(t, stripped)
+	checkUpright(t, stripped)
+
+	if size := int(binary.LittleEndian.Uint32(stripped[4:8])); size != len(stripped)-8 {
+		t.Errorf("the RIFF size is %d, want %d", size, len(stripped)-8)
+	}
+	if flags := stripped[20]; flags&(webpExifFlag|webpXmpFlag) != 0 {
+		t.Errorf("the VP8X flags %08b still announce metadata", flags)
+	}
+}
+
+func TestStripGifMetadata(t *testing.T) {
+	data := readTestdata(t, "comment_xmp.gif")
+	if !bytes.Contains(data, []byte("secret comment")) || !bytes.Contains(data, []byte("XMP DataXMP")) {
+		t.Fatal("the test image should contain a comment and XMP data")
+	}
+
+	stripped, err := stripImageMetadata(data, "gif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoMetadata(t, stripped)
+	checkUpright(t, stripped)
+
+	// The frames and the loop of the animation are kept
+	animation, err := gif.DecodeAll(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(animation.Image) != 2 || animation.LoopCount != 0 {
+		t.Errorf("the animation has %d frames and loop count %d, want 2 and 0", len(animation.Image), animation.LoopCount)
+	}
+	if !bytes.Contains(stripped, []byte("NETSCAPE2.0")) {
+		t.Error("the loop extension was dropped")
+	}
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"mime/multipart"
+
+	"github.com/akunsecured/emezen_api/models"
+)
+
+type ImageService interface {
+	SaveImage(string, *multipart.FileHeader) (*models.StoredImage, error)
+	SaveImages(string, []*multipart.FileHeader, []string, int) *models.ImageUploadResult
+	GetPolicy() models.ImageUploadPolicy
+	GenerateVariants(string)
+	GetVariantKey(string, string, string) (string, bool, error)
+	DeleteImage(string) error
+	GetImageInfo(string) (*models.BlobInfo, error)
+	GetVariantSize(string) (int64, error)
+	SaveProfilePicture(string, *multipart.FileHeader) (*models.StoredImage, error)
+	DefaultAvatar(string) ([]byte, error)
+}
@@ -0,0 +1,226 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	_ "golang.org/x/image/webp"
+)
+
+// imageExtensions are the accepted content types, as sniffed from the content, together
+// with the format reported by the decoder and the extension of the stored file.
+var imageExtensions = map[string]struct {
+	format    string
+	extension string
+}{
+	"image/jpeg": {"jpeg", ".jpg"},
+	"image/png":  {"png", ".png"},
+	"image/gif":  {"gif", ".gif"},
+	"image/webp": {"webp", ".webp"},
+}
+
+type ImageServiceImpl struct {
+	blobStore      BlobStore
+	storageService StorageService
+	policy         models.ImageUploadPolicy
+	variants       chan string
+}
+
+// NewImageService will also start the worker which generates the resized variants of the
+// images in the background, and charges their size to the users of the images.
+func NewImageService(blobStore BlobStore, storageService StorageService, policy models.ImageUploadPolicy) ImageService {
+	imageService := &ImageServiceImpl{
+		blobStore:      blobStore,
+		storageService: storageService,
+		policy:         policy,
+		variants:       make(chan string, variantQueueSize),
+	}
+	go imageService.variantWorker()
+	return imageService
+}
+
+func (i *ImageServiceImpl) GetPolicy() models.ImageUploadPolicy {
+	return i.policy
+}
+
+func (i *ImageServiceImpl) GetImageInfo(key string) (*models.BlobInfo, error) {
+	return i.blobStore.Stat(key)
+}
+
+// readImage will read the whole file, but not more than the size limit, whatever size the
+// client claimed.
+func (i *ImageServiceImpl) readImage(fileHeader *multipart.FileHeader) ([]byte, error) {
+	if fileHeader.Size > i.policy.MaxFileSize {
+		return nil, utils.ErrFileTooLarge
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, i.policy.MaxFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > i.policy.MaxFileSize {
+		return nil, utils.ErrFileTooLarge
+	}
+	return data, nil
+}
+
+// uploadedImage is an uploaded file which passed the checks, without its metadata.
+type uploadedImage struct {
+	data        []byte
+	contentType string
+	extension   string
+	config      image.Config
+}
+
+// loadImage will read the uploaded image if it is one of the accepted formats. The type is
+// sniffed from the content and checked by decoding the header, the name and the type sent by
+// the client are ignored. The metadata of JPEG and PNG images is removed.
+func (i *ImageServiceImpl) loadImage(fileHeader *multipart.FileHeader) (*uploadedImage, error) {
+	data, err := i.readImage(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	contentType := http.DetectContentType(data)
+	accepted, ok := imageExtensions[contentType]
+	if !ok {
+		return nil, utils.ErrUnsupportedImageType
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil || format != accepted.format || config.Width <= 0 || config.Height <= 0 {
+		return nil, utils.ErrInvalidImage
+	}
+	if config.Width*config.Height > i.policy.MaxPixels {
+		return nil, utils.ErrImageTooLarge
+	}
+
+	data, err = stripImageMetadata(data, format)
+	if err != nil {
+		return nil, err
+	}
+	config, _, err = image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, utils.ErrInvalidImage
+	}
+
+	return &uploadedImage{
+		data:        data,
+		contentType: contentType,
+		extension:   accepted.extension,
+		config:      config,
+	}, nil
+}
+
+// SaveImage will store the uploaded image under the given prefix if it is accepted. The
+// stored name is the hash of the content without the metadata.
+func (i *ImageServiceImpl) SaveImage(prefix string, fileHeader *multipart.FileHeader) (*models.StoredImage, error) {
+	uploaded, err := i.loadImage(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+	return i.storeImage(imageKey(prefix, uploaded), fileHeader, uploaded)
+}
+
+// imageKey returns the key of the uploaded image under the given prefix.
+func imageKey(prefix string, uploaded *uploadedImage) string {
+	hash := sha256.Sum256(uploaded.data)
+	return prefix + hex.EncodeToString(hash[:]) + uploaded.extension
+}
+
+func (i *ImageServiceImpl) storeImage(key string, fileHeader *multipart.FileHeader, uploaded *uploadedImage) (*models.StoredImage, error) {
+	// The same content is stored under the same key, so it only has to be written once
+	if _, err := i.blobStore.Stat(key); err == utils.ErrBlobNotFound {
+		_, err = i.blobStore.Put(key, uploaded.contentType, bytes.NewReader(uploaded.data))
+		if err != nil {
+			return nil, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return &models.StoredImage{
+		Key:         key,
+		FileName:    fileHeader.Filename,
+		ContentType: uploaded.contentType,
+		Size:        int64(len(uploaded.data)),
+		Width:       uploaded.config.Width,
+		Height:      uploaded.config.Height,
+	}, nil
+}
+
+// SaveImages will store every acceptable image and report the rest one by one, so a single
+// bad file does not reject the whole upload. The images are added to the given keys, which
+// can have at most maxKeys different keys together with the new ones, zero means no limit.
+// Only the images which are accepted take a place, and uploading an image which is among
+// the keys already does not take another one.
+func (i *ImageServiceImpl) SaveImages(prefix string, fileHeaders []*multipart.FileHeader, existingKeys []string, maxKeys int) *models.ImageUploadResult {
+	result := &models.ImageUploadResult{
+		Stored:   []*models.StoredImage{},
+		Rejected: []*models.RejectedFile{},
+	}
+
+	keys := append([]string{}, existingKeys...)
+	for index, fileHeader := range fileHeaders {
+		storedImage, err := i.saveImage(prefix, fileHeader, index, &keys, maxKeys)
+		if err != nil {
+			result.Rejected = append(result.Rejected, &models.RejectedFile{
+				Index:    index,
+				FileName: fileHeader.Filename,
+				Error:    err.Error(),
+			})
+			continue
+		}
+		result.Stored = append(result.Stored, storedImage)
+	}
+	return result
+}
+
+// saveImage will store the image at the given index of the upload, if it is accepted and
+// there is place for it among the keys, and adds its key to them.
+func (i *ImageServiceImpl) saveImage(prefix string, fileHeader *multipart.FileHeader, index int, keys *[]string, maxKeys int) (*models.StoredImage, error) {
+	if index >= i.policy.MaxFiles {
+		return nil, utils.ErrTooManyFiles
+	}
+	uploaded, err := i.loadImage(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	key := imageKey(prefix, uploaded)
+	isNew := true
+	for _, existingKey := range *keys {
+		if existingKey == key {
+			isNew = false
+			break
+		}
+	}
+	if isNew && maxKeys > 0 && len(*keys) >= maxKeys {
+		return nil, utils.ErrTooManyProductImages
+	}
+
+	storedImage, err := i.storeImage(key, fileHeader, uploaded)
+	if err != nil {
+		return nil, err
+	}
+	if isNew {
+		*keys = append(*keys, key)
+	}
+	return storedImage, nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"mime/multipart"
+	"testing"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+)
+
+// multipartTestFiles returns the given contents as uploaded files.
+func multipartTestFiles(t *testing.T, contents ...[]byte) []*multipart.FileHeader {
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, content := range contents {
+		part, err := writer.CreateFormFile("files", "image.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(content)
+	}
+	writer.Close()
+
+	form, err := multipart.NewReader(&body, writer.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.File["files"]
+}
+
+func pngTestImage(t *testing.T, fill color.Color) []byte {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for index := range img.Pix {
+		img.Pix[index] = 255
+	}
+	img.Set(0, 0, fill)
+	var buffer bytes.Buffer
+	if err := png.Encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestSaveImagesCountsOnlyAcceptedImages(t *testing.T) {
+	service := &ImageServiceImpl{
+		blobStore: NewFilesystemBlobStore(t.TempDir()),
+		policy:    models.ImageUploadPolicy{MaxFileSize: 1 << 20, MaxFiles: 10, MaxPixels: 1 << 20},
+	}
+	first := pngTestImage(t, color.NRGBA{R: 255, A: 255})
+	second := pngTestImage(t, color.NRGBA{G: 255, A: 255})
+	third := pngTestImage(t, color.NRGBA{B: 255, A: 255})
+	files := multipartTestFiles(t, []byte("not an image"), first, first, second, third)
+
+	// The product has one image already, and can have three
+	result := service.SaveImages(models.ProductPicturesPrefix, files, []string{"product_pictures/existing.png"}, 3)
+
+	if len(result.Stored) != 3 {
+		t.Fatalf("%d images were stored, want 3", len(result.Stored))
+	}
+	if result.Stored[0].Key != result.Stored[1].Key {
+		t.Error("the same image was stored under different keys")
+	}
+	expected := map[int]error{0: utils.ErrUnsupportedImageType, 4: utils.ErrTooManyProductImages}
+	if len(result.Rejected) != len(expected) {
+		t.Fatalf("rejected %d files, want %d", len(result.Rejected), len(expected))
+	}
+	for _, rejected := range result.Rejected {
+		if err, ok := expected[rejected.Index]; !ok || rejected.Error != err.Error() {
+			t.Errorf("file %d was rejected with %q", rejected.Index, rejected.Error)
+		}
+	}
+
+	// The rejected image is not stored
+	uploaded, err := service.loadImage(files[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.blobStore.Stat(imageKey(models.ProductPicturesPrefix, uploaded)); err != utils.ErrBlobNotFound {
+		t.Errorf("the image over the limit was stored: %v", err)
+	}
+}
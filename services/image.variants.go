@@ -0,0 +1,283 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/HugoSmits86/nativewebp"
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"golang.org/x/image/draw"
+)
+
+// variantQueueSize is the number of images which can wait for their variants. When the
+// queue is full, the image is skipped and served in its original size.
+const variantQueueSize = 256
+
+const variantJpegQuality = 85
+
+// WebPFormat can be requested instead of the format of the original image.
+const (
+	WebPFormat        = "webp"
+	webpExtension     = ".webp"
+	originalImageSize = "original"
+)
+
+// variantExtension returns the extension of the variants of an image with the given
+// extension, which are served to clients without WebP support. JPEG photos are resized to
+// JPEG, the others to PNG, so transparency is kept.
+func variantExtension(extension string) string {
+	if extension == ".jpg" {
+		return ".jpg"
+	}
+	return ".png"
+}
+
+// variantKey returns the key of the variant with the given name and extension. Image keys
+// are content hashes, so the variant names cannot collide with the key of another image.
+func variantKey(key string, name string, extension string) string {
+	return strings.TrimSuffix(key, path.Ext(key)) + "_" + name + extension
+}
+
+// variantKeys returns the keys of every variant the image with the given key can have.
+func variantKeys(key string) []string {
+	var keys []string
+	for _, variant := range models.ImageVariants {
+		keys = append(keys, variantKey(key, variant.Name, webpExtension))
+		if extension := variantExtension(path.Ext(key)); extension != webpExtension {
+			keys = append(keys, variantKey(key, variant.Name, extension))
+		}
+	}
+	return keys
+}
+
+// GenerateVariants will queue the image with the given key for resizing. It does not wait
+// for the variants to be generated.
+func (i *ImageServiceImpl) GenerateVariants(key string) {
+	select {
+	case i.variants <- key:
+	default:
+		log.Printf("image variant queue is full, skipping %s", key)
+	}
+}
+
+// GetVariantKey returns the key of the variant of the image in the given size and format.
+// If the WebP variant is not smaller than the other one, the other one is returned instead.
+// The second value tells whether the variant is final. It is false while the variant is not
+// generated yet, or the image is smaller than the variant, and the original image is returned
+// in its place.
+func (i *ImageServiceImpl) GetVariantKey(key string, size string, format string) (string, bool, error) {
+	if format != "" && format != originalImageSize && format != WebPFormat {
+		return "", false, utils.ErrUnknownImageFormat
+	}
+	if size == "" || size == originalImageSize {
+		return key, true, nil
+	}
+
+	for _, variant := range models.ImageVariants {
+		if variant.Name != size {
+			continue
+		}
+
+		// The WebP variant is stored first, so once the other one exists, the WebP variant
+		// either exists too, or it was not worth keeping
+		candidates := []string{variantKey(key, variant.Name, variantExtension(path.Ext(key)))}
+		if format == WebPFormat {
+			candidates = append([]string{variantKey(key, variant.Name, webpExtension)}, candidates...)
+		}
+		for _, candidate := range candidates {
+			if _, err := i.blobStore.Stat(candidate); err == nil {
+				return candidate, true, nil
+			} else if err != utils.ErrBlobNotFound {
+				return "", false, err
+			}
+		}
+		return key, false, nil
+	}
+	return "", false, utils.ErrUnknownImageSize
+}
+
+// DeleteImage will delete the image with the given key together with its variants.
+func (i *ImageServiceImpl) DeleteImage(key string) error {
+	for _, key := range append([]string{key}, variantKeys(key)...) {
+		if err := i.blobStore.Delete(key); err != nil && err != utils.ErrBlobNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetVariantSize returns the total size of the stored variants of the image with the given key.
+func (i *ImageServiceImpl) GetVariantSize(key string) (int64, error) {
+	var size int64
+	for _, key := range variantKeys(key) {
+		info, err := i.blobStore.Stat(key)
+		if err == utils.ErrBlobNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		size += info.Size
+	}
+	return size, nil
+}
+
+// variantWorker generates the variants of the queued images, and charges them to the users
+// of the images. The variants are only stored if every user can be charged for them without
+// exceeding the quota, otherwise the original image is served in their place. The variants
+// of an image uploaded again already exist, the new user is charged for them if the quota
+// allows it.
+func (i *ImageServiceImpl) variantWorker() {
+	for key := range i.variants {
+		if err := i.generateChargedVariants(key); err != nil {
+			log.Printf("could not generate the variants of %s: %v", key, err)
+		}
+	}
+}
+
+func (i *ImageServiceImpl) generateChargedVariants(key string) error {
+	variants, err := i.renderVariants(key)
+	if err != nil {
+		return err
+	}
+	size, err := i.GetVariantSize(key)
+	if err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		size += int64(len(variant.data))
+	}
+
+	err = i.storageService.ReserveVariantUsage(key, size)
+	if err != nil {
+		return err
+	}
+	return i.storeVariants(variants)
+}
+
+func (i *ImageServiceImpl) generateVariants(key string) error {
+	variants, err := i.renderVariants(key)
+	if err != nil {
+		return err
+	}
+	return i.storeVariants(variants)
+}
+
+// renderedVariant is an encoded variant which is not stored yet.
+type renderedVariant struct {
+	key         string
+	contentType string
+	data        []byte
+}
+
+// renderVariants will encode the variants of the image with the given key which are not
+// stored yet. The WebP variant comes before the other one of the same size, so they are
+// stored in the order GetVariantKey expects.
+func (i *ImageServiceImpl) renderVariants(key string) ([]*renderedVariant, error) {
+	reader, _, err := i.blobStore.Get(key, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	original, _, err := image.Decode(reader)
+	reader.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var variants []*renderedVariant
+	extension := variantExtension(path.Ext(key))
+	for _, variant := range models.ImageVariants {
+		bounds := original.Bounds()
+		if bounds.Dx() <= variant.MaxSize && bounds.Dy() <= variant.MaxSize {
+			continue
+		}
+
+		resizedKey := variantKey(key, variant.Name, extension)
+		if _, err := i.blobStore.Stat(resizedKey); err == nil {
+			continue
+		} else if err != utils.ErrBlobNotFound {
+			return nil, err
+		}
+
+		resized := resizeImage(original, variant.MaxSize)
+		data, contentType, err := encodeVariant(resized, extension)
+		if err != nil {
+			return nil, err
+		}
+
+		// The WebP encoder is lossless, so photos can end up larger than their JPEG variant.
+		// Those are not kept, and the JPEG variant is served to every client.
+		webpData, webpContentType, err := encodeVariant(resized, webpExtension)
+		if err != nil {
+			return nil, err
+		}
+		if len(webpData) < len(data) {
+			variants = append(variants, &renderedVariant{variantKey(key, variant.Name, webpExtension), webpContentType, webpData})
+		}
+		variants = append(variants, &renderedVariant{resizedKey, contentType, data})
+	}
+	return variants, nil
+}
+
+func (i *ImageServiceImpl) storeVariants(variants []*renderedVariant) error {
+	for _, variant := range variants {
+		_, err := i.blobStore.Put(variant.key, variant.contentType, bytes.NewReader(variant.data))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resizeImage will scale the image down to fit in a square of the given size, keeping its
+// aspect ratio.
+func resizeImage(src image.Image, maxSize int) *image.NRGBA {
+	bounds := src.Bounds()
+	width, height := maxSize, maxSize
+	if bounds.Dx() > bounds.Dy() {
+		height = bounds.Dy() * maxSize / bounds.Dx()
+	} else {
+		width = bounds.Dx() * maxSize / bounds.Dy()
+	}
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, bounds, draw.Over, nil)
+	return dst
+}
+
+func encodeVariant(img *image.NRGBA, extension string) ([]byte, string, error) {
+	var buffer bytes.Buffer
+	switch extension {
+	case ".png":
+		if err := png.Encode(&buffer, img); err != nil {
+			return nil, "", err
+		}
+		return buffer.Bytes(), "image/png", nil
+	case webpExtension:
+		if err := nativewebp.Encode(&buffer, img, nil); err != nil {
+			return nil, "", err
+		}
+		return buffer.Bytes(), "image/webp", nil
+	}
+
+	// JPEG has no transparency, so transparent pixels would turn black
+	flattened := image.NewRGBA(img.Bounds())
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, img.Bounds().Min, draw.Over)
+	if err := jpeg.Encode(&buffer, flattened, &jpeg.Options{Quality: variantJpegQuality}); err != nil {
+		return nil, "", err
+	}
+	return buffer.Bytes(), "image/jpeg", nil
+}
@@ -0,0 +1,219 @@
+package services
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"testing"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"golang.org/x/image/webp"
+)
+
+func newVariantTestService(t *testing.T) *ImageServiceImpl {
+	return &ImageServiceImpl{blobStore: NewFilesystemBlobStore(t.TempDir())}
+}
+
+func putTestImage(t *testing.T, service *ImageServiceImpl, key string, img image.Image, encode func(*bytes.Buffer, image.Image) error) {
+	var buffer bytes.Buffer
+	if err := encode(&buffer, img); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.blobStore.Put(key, "application/octet-stream", bytes.NewReader(buffer.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getTestImage(t *testing.T, service *ImageServiceImpl, key string) ([]byte, *models.BlobInfo) {
+	reader, info, err := service.blobStore.Get(key, 0, -1)
+	if err != nil {
+		t.Fatalf("could not get %s: %v", key, err)
+	}
+	defer reader.Close()
+	var buffer bytes.Buffer
+	if _, err := buffer.ReadFrom(reader); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes(), info
+}
+
+// logoImage has a transparent background with an opaque square in the middle.
+func logoImage(size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := size / 4; y < size*3/4; y++ {
+		for x := size / 4; x < size*3/4; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{R: 200, G: 30, B: 30, A: 255})
+		}
+	}
+	return img
+}
+
+// photoImage is noisy like a photo, which compresses badly without loss.
+func photoImage(width, height int) *image.NRGBA {
+	random := rand.New(rand.NewSource(1))
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	random.Read(img.Pix)
+	for index := 3; index < len(img.Pix); index += 4 {
+		img.Pix[index] = 255
+	}
+	return img
+}
+
+func TestVariantKeys(t *testing.T) {
+	tests := []struct {
+		key      string
+		expected []string
+	}{
+		{"products/abc.jpg", []string{
+			"products/abc_thumbnail.webp", "products/abc_thumbnail.jpg",
+			"products/abc_medium.webp", "products/abc_medium.jpg",
+			"products/abc_large.webp", "products/abc_large.jpg",
+		}},
+		{"products/abc.webp", []string{
+			"products/abc_thumbnail.webp", "products/abc_thumbnail.png",
+			"products/abc_medium.webp", "products/abc_medium.png",
+			"products/abc_large.webp", "products/abc_large.png",
+		}},
+		{"products/abc.gif", []string{
+			"products/abc_thumbnail.webp", "products/abc_thumbnail.png",
+			"products/abc_medium.webp", "products/abc_medium.png",
+			"products/abc_large.webp", "products/abc_large.png",
+		}},
+	}
+
+	for _, test := range tests {
+		keys := variantKeys(test.key)
+		if len(keys) != len(test.expected) {
+			t.Fatalf("variantKeys(%s) = %v, want %v", test.key, keys, test.expected)
+		}
+		for index := range keys {
+			if keys[index] != test.expected[index] {
+				t.Errorf("variantKeys(%s) = %v, want %v", test.key, keys, test.expected)
+				break
+			}
+		}
+	}
+}
+
+func TestGenerateVariantsKeepsTransparency(t *testing.T) {
+	for _, key := range []string{"products/logo.png", "products/logo.webp"} {
+		t.Run(key, func(t *testing.T) {
+			service := newVariantTestService(t)
+			// The original is stored as PNG in both cases, the decoder only looks at the content
+			putTestImage(t, service, key, logoImage(600), func(buffer *bytes.Buffer, img image.Image) error {
+				return png.Encode(buffer, img)
+			})
+			if err := service.generateVariants(key); err != nil {
+				t.Fatal(err)
+			}
+
+			// The original fits in the large variant, so only the smaller ones are generated
+			if _, err := service.blobStore.Stat("products/logo_large.png"); err != utils.ErrBlobNotFound {
+				t.Errorf("the large variant was generated for a smaller image: %v", err)
+			}
+
+			data, _ := getTestImage(t, service, "products/logo_medium.png")
+			fallback, err := png.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, info := getTestImage(t, service, "products/logo_medium.webp")
+			if info.ContentType != "image/webp" {
+				t.Errorf("content type = %s, want image/webp", info.ContentType)
+			}
+			webpVariant, err := webp.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, variant := range []image.Image{fallback, webpVariant} {
+				if size := variant.Bounds().Size(); size.X != 480 || size.Y != 480 {
+					t.Errorf("variant is %v, want 480x480", size)
+				}
+				if _, _, _, alpha := variant.At(0, 0).RGBA(); alpha != 0 {
+					t.Errorf("the corner has alpha %d, want transparent", alpha)
+				}
+				if _, _, _, alpha := variant.At(240, 240).RGBA(); alpha != 0xffff {
+					t.Errorf("the center has alpha %d, want opaque", alpha)
+				}
+			}
+		})
+	}
+}
+
+func TestGetVariantKey(t *testing.T) {
+	service := newVariantTestService(t)
+	putTestImage(t, service, "products/logo.png", logoImage(600), func(buffer *bytes.Buffer, img image.Image) error {
+		return png.Encode(buffer, img)
+	})
+	putTestImage(t, service, "products/photo.jpg", photoImage(640, 480), func(buffer *bytes.Buffer, img image.Image) error {
+		return jpeg.Encode(buffer, img, &jpeg.Options{Quality: 90})
+	})
+
+	tests := []struct {
+		name      string
+		key       string
+		size      string
+		format    string
+		generated bool
+		expected  string
+		final     bool
+		err       error
+	}{
+		{"original", "products/logo.png", "", "", false, "products/logo.png", true, nil},
+		{"original in webp", "products/logo.png", "original", "webp", false, "products/logo.png", true, nil},
+		{"not generated yet", "products/logo.png", "thumbnail", "", false, "products/logo.png", false, nil},
+		{"webp not generated yet", "products/logo.png", "thumbnail", "webp", false, "products/logo.png", false, nil},
+		{"generated", "products/logo.png", "thumbnail", "", true, "products/logo_thumbnail.png", true, nil},
+		{"generated in webp", "products/logo.png", "thumbnail", "webp", true, "products/logo_thumbnail.webp", true, nil},
+		{"smaller than the variant", "products/logo.png", "large", "webp", true, "products/logo.png", false, nil},
+		{"webp larger than jpeg", "products/photo.jpg", "medium", "webp", true, "products/photo_medium.jpg", true, nil},
+		{"unknown size", "products/logo.png", "huge", "", false, "", false, utils.ErrUnknownImageSize},
+		{"unknown format", "products/logo.png", "thumbnail", "avif", false, "", false, utils.ErrUnknownImageFormat},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.generated {
+				if err := service.generateVariants(test.key); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				for _, key := range variantKeys(test.key) {
+					service.blobStore.Delete(key)
+				}
+			}
+
+			key, final, err := service.GetVariantKey(test.key, test.size, test.format)
+			if err != test.err {
+				t.Fatalf("GetVariantKey returned error %v, want %v", err, test.err)
+			}
+			if key != test.expected || final != test.final {
+				t.Errorf("GetVariantKey = %s, %v, want %s, %v", key, final, test.expected, test.final)
+			}
+		})
+	}
+}
+
+func TestDeleteImageDeletesVariants(t *testing.T) {
+	service := newVariantTestService(t)
+	putTestImage(t, service, "products/logo.png", logoImage(1200), func(buffer *bytes.Buffer, img image.Image) error {
+		return png.Encode(buffer, img)
+	})
+	if err := service.generateVariants("products/logo.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := service.DeleteImage("products/logo.png"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range append([]string{"products/logo.png"}, variantKeys("products/logo.png")...) {
+		if _, err := service.blobStore.Stat(key); err != utils.ErrBlobNotFound {
+			t.Errorf("%s was not deleted: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,8 @@
+package services
+
+type LoginAttemptService interface {
+	CheckLocked(...string) error
+	RegisterFailure(string, int) error
+	Reset(string) error
+	EnsureIndexes() error
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	loginLockoutBase   = time.Minute * 1
+	loginLockoutMax    = time.Hour * 1
+	loginFailureWindow = time.Hour * 24
+	// accountLoginThreshold and ipLoginThreshold are the number of consecutive failures
+	// after which an account or an IP address gets locked
+	accountLoginThreshold = 5
+	ipLoginThreshold      = 20
+)
+
+type LoginAttemptServiceImpl struct {
+	loginAttemptCollection *mongo.Collection
+	ctx                    context.Context
+}
+
+func NewLoginAttemptService(loginAttemptCollection *mongo.Collection, ctx context.Context) LoginAttemptService {
+	return &LoginAttemptServiceImpl{
+		loginAttemptCollection: loginAttemptCollection,
+		ctx:                    ctx,
+	}
+}
+
+func (l *LoginAttemptServiceImpl) getLoginAttempt(key string) (*models.LoginAttempt, error) {
+	var loginAttempt *models.LoginAttempt
+	query := bson.D{bson.E{Key: "key", Value: key}}
+	err := l.loginAttemptCollection.FindOne(l.ctx, query).Decode(&loginAttempt)
+	return loginAttempt, err
+}
+
+// CheckLocked will return an error if any of the given keys is temporarily locked because
+// of too many failed login attempts.
+func (l *LoginAttemptServiceImpl) CheckLocked(keys ...string) error {
+	for _, key := range keys {
+		loginAttempt, err := l.getLoginAttempt(key)
+		if err == mongo.ErrNoDocuments {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if time.Now().Before(loginAttempt.LockedUntil) {
+			return utils.ErrTooManyLoginAttempts
+		}
+	}
+	return nil
+}
+
+// EnsureIndexes will create the unique index on the key, so concurrent failures of a new key
+// are counted in the same document.
+func (l *LoginAttemptServiceImpl) EnsureIndexes() error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	_, err := l.loginAttemptCollection.Indexes().CreateOne(l.ctx, index)
+	return err
+}
+
+// RegisterFailure will count a failed login for the given key. Once the number of failures
+// reaches the threshold, the key is locked, and the lockout doubles with every further
+// failure up to an hour. Failures older than a day are forgotten. The counter is incremented
+// in the database, so failures happening at the same time are all counted.
+func (l *LoginAttemptServiceImpl) RegisterFailure(key string, threshold int) error {
+	now := time.Now()
+
+	// Once the last failure is outside the window, the count starts over. The filter only
+	// matches stale documents, so it cannot reset a failure counted in the meantime.
+	filter := bson.D{
+		bson.E{Key: "key", Value: key},
+		bson.E{Key: "last_failure_at", Value: bson.D{bson.E{Key: "$lt", Value: now.Add(-loginFailureWindow)}}},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "failures", Value: 0}}}}
+	_, err := l.loginAttemptCollection.UpdateOne(l.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+
+	filter = bson.D{bson.E{Key: "key", Value: key}}
+	update = bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "failures", Value: 1}}},
+		bson.E{Key: "$max", Value: bson.D{bson.E{Key: "last_failure_at", Value: now}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{bson.E{Key: "_id", Value: primitive.NewObjectID()}}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+
+	var loginAttempt *models.LoginAttempt
+	err = l.loginAttemptCollection.FindOneAndUpdate(l.ctx, filter, update, opts).Decode(&loginAttempt)
+	if err != nil {
+		return err
+	}
+	if loginAttempt.Failures < threshold {
+		return nil
+	}
+
+	lockout := loginLockoutBase
+	for i := threshold; i < loginAttempt.Failures && lockout < loginLockoutMax; i++ {
+		lockout *= 2
+	}
+	if lockout > loginLockoutMax {
+		lockout = loginLockoutMax
+	}
+
+	// $max keeps the longer lockout if a later failure has already been written
+	update = bson.D{bson.E{Key: "$max", Value: bson.D{bson.E{Key: "locked_until", Value: now.Add(lockout)}}}}
+	_, err = l.loginAttemptCollection.UpdateOne(l.ctx, filter, update)
+	return err
+}
+
+// Reset will forget every failed attempt of the given key and lift its lockout.
+func (l *LoginAttemptServiceImpl) Reset(key string) error {
+	filter := bson.D{bson.E{Key: "key", Value: key}}
+	_, err := l.loginAttemptCollection.DeleteOne(l.ctx, filter)
+	return err
+}
+
+func accountLoginKey(email string) string {
+	return "email:" + utils.NormalizeEmail(email)
+}
+
+func ipLoginKey(ip string) string {
+	return "ip:" + ip
+}
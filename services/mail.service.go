@@ -0,0 +1,7 @@
+package services
+
+import "github.com/akunsecured/emezen_api/models"
+
+type MailService interface {
+	SendMail(*models.Mail) error
+}
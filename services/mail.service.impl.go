@@ -0,0 +1,32 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MailServiceImpl does not deliver anything, it only stores the messages in
+// the outbox collection, so they can be inspected or sent by a separate worker.
+type MailServiceImpl struct {
+	outboxCollection *mongo.Collection
+	ctx              context.Context
+}
+
+func NewMailService(outboxCollection *mongo.Collection, ctx context.Context) MailService {
+	return &MailServiceImpl{
+		outboxCollection: outboxCollection,
+		ctx:              ctx,
+	}
+}
+
+func (m *MailServiceImpl) SendMail(mail *models.Mail) error {
+	mail.ID = primitive.NewObjectID()
+	mail.CreatedAt = time.Now()
+
+	_, err := m.outboxCollection.InsertOne(m.ctx, mail)
+	return err
+}
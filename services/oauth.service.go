@@ -0,0 +1,18 @@
+package services
+
+import "github.com/akunsecured/emezen_api/models"
+
+type OAuthService interface {
+	RegisterClient(*string, *models.OAuthClientRequest) (*models.CreatedOAuthClient, error)
+	GetClientsOfUser(*string) ([]*models.OAuthClient, error)
+	DeleteClient(*string, *string) error
+	GetAuthorizeInfo(*string, *models.OAuthAuthorizeRequest) (*models.OAuthAuthorizeInfo, error)
+	Authorize(*string, *models.OAuthAuthorizeRequest) (string, error)
+	Exchange(*models.OAuthTokenRequest) (*models.OAuthTokenResponse, error)
+	Introspect(string, string, string) (*models.OAuthIntrospection, error)
+	Revoke(string, string, string) error
+	ValidateAccessToken(string) (*models.OAuthToken, error)
+	GetConsentsOfUser(*string) ([]*models.OAuthConsent, error)
+	RevokeConsent(*string, *string) error
+	RevokeGrantsOfUser(*string) error
+}
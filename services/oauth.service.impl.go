@@ -0,0 +1,619 @@
+package services
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	oauthCodeLifetime        = time.Minute * 5
+	oauthAccessTokenLifetime = time.Hour * 1
+
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeClientCredentials = "client_credentials"
+)
+
+type OAuthServiceImpl struct {
+	clientCollection  *mongo.Collection
+	codeCollection    *mongo.Collection
+	tokenCollection   *mongo.Collection
+	consentCollection *mongo.Collection
+	ctx               context.Context
+}
+
+func NewOAuthService(clientCollection *mongo.Collection, codeCollection *mongo.Collection, tokenCollection *mongo.Collection, consentCollection *mongo.Collection, ctx context.Context) OAuthService {
+	return &OAuthServiceImpl{
+		clientCollection:  clientCollection,
+		codeCollection:    codeCollection,
+		tokenCollection:   tokenCollection,
+		consentCollection: consentCollection,
+		ctx:               ctx,
+	}
+}
+
+func joinScopes(scopes []models.Scope) string {
+	values := make([]string, len(scopes))
+	for i, scope := range scopes {
+		values[i] = string(scope)
+	}
+	return strings.Join(values, " ")
+}
+
+func containsScope(scopes []models.Scope, scope models.Scope) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// parseScopes will parse the space separated scope parameter. Every requested scope has to be
+// allowed for the client. If nothing is requested, every allowed scope is granted.
+func parseScopes(scope string, allowed []models.Scope) ([]models.Scope, error) {
+	fields := strings.Fields(scope)
+	if len(fields) == 0 {
+		return allowed, nil
+	}
+
+	var scopes []models.Scope
+	for _, field := range fields {
+		requested := models.Scope(field)
+		if !requested.IsValid() || !containsScope(allowed, requested) {
+			return nil, utils.ErrOAuthInvalidScope
+		}
+		if !containsScope(scopes, requested) {
+			scopes = append(scopes, requested)
+		}
+	}
+	return scopes, nil
+}
+
+func (o *OAuthServiceImpl) getClient(clientId string) (*models.OAuthClient, error) {
+	var client *models.OAuthClient
+	query := bson.D{bson.E{Key: "client_id", Value: clientId}}
+	err := o.clientCollection.FindOne(o.ctx, query).Decode(&client)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrOAuthInvalidClient
+	}
+	return client, err
+}
+
+// authenticateClient will return the client if the credentials are valid. Confidential clients
+// always need their secret, public clients can only be identified by their ID.
+func (o *OAuthServiceImpl) authenticateClient(clientId string, clientSecret string) (*models.OAuthClient, error) {
+	client, err := o.getClient(clientId)
+	if err != nil {
+		return nil, err
+	}
+	if client.Confidential {
+		hashed := security.HashToken(clientSecret)
+		if clientSecret == "" || subtle.ConstantTimeCompare([]byte(hashed), []byte(client.ClientSecretHash)) != 1 {
+			return nil, utils.ErrOAuthInvalidClient
+		}
+	}
+	return client, nil
+}
+
+// RegisterClient will register a new third-party application of the given user. The secret
+// of confidential clients is returned only this time, only its hash is stored.
+func (o *OAuthServiceImpl) RegisterClient(userId *string, request *models.OAuthClientRequest) (*models.CreatedOAuthClient, error) {
+	for _, scope := range request.Scopes {
+		if !scope.IsValid() {
+			return nil, utils.ErrInvalidOAuthClientFormat
+		}
+	}
+
+	clientId, err := security.NewRandomToken(16)
+	if err != nil {
+		return nil, err
+	}
+
+	client := models.OAuthClient{
+		ID:           primitive.NewObjectID(),
+		ClientID:     clientId,
+		OwnerUserID:  *userId,
+		Name:         request.Name,
+		RedirectURIs: request.RedirectURIs,
+		Scopes:       request.Scopes,
+		Confidential: request.Confidential,
+		CreatedAt:    time.Now(),
+	}
+
+	var clientSecret string
+	if client.Confidential {
+		clientSecret, err = security.NewRandomToken(32)
+		if err != nil {
+			return nil, err
+		}
+		client.ClientSecretHash = security.HashToken(clientSecret)
+	}
+
+	_, err = o.clientCollection.InsertOne(o.ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.CreatedOAuthClient{
+		Client:       &client,
+		ClientSecret: clientSecret,
+	}, nil
+}
+
+func (o *OAuthServiceImpl) GetClientsOfUser(userId *string) ([]*models.OAuthClient, error) {
+	clients := []*models.OAuthClient{}
+
+	query := bson.D{bson.E{Key: "owner_user_id", Value: *userId}}
+	cur, err := o.clientCollection.Find(o.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(o.ctx) {
+		var client *models.OAuthClient
+		err := cur.Decode(&client)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, client)
+	}
+
+	cur.Close(o.ctx)
+
+	return clients, err
+}
+
+// DeleteClient will delete the client of the given user, revoke every token issued to it
+// and forget the consents given to it.
+func (o *OAuthServiceImpl) DeleteClient(userId *string, clientId *string) error {
+	filter := bson.D{bson.E{Key: "client_id", Value: *clientId}, bson.E{Key: "owner_user_id", Value: *userId}}
+	result, err := o.clientCollection.DeleteOne(o.ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount != 1 {
+		return utils.ErrNoMatchedDocumentFoundForDelete
+	}
+
+	err = o.revokeTokens(bson.D{bson.E{Key: "client_id", Value: *clientId}})
+	if err != nil {
+		return err
+	}
+
+	filter = bson.D{bson.E{Key: "client_id", Value: *clientId}}
+	_, err = o.consentCollection.DeleteMany(o.ctx, filter)
+	return err
+}
+
+// validateAuthorizeRequest will check the client and the redirect URI of the request. Errors
+// of these must not be redirected to the client, every other error can be.
+func (o *OAuthServiceImpl) validateAuthorizeRequest(request *models.OAuthAuthorizeRequest) (*models.OAuthClient, []models.Scope, error) {
+	client, err := o.getClient(request.ClientID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if request.RedirectURI == "" {
+		if len(client.RedirectURIs) != 1 {
+			return nil, nil, utils.ErrOAuthInvalidRequest
+		}
+		request.RedirectURI = client.RedirectURIs[0]
+	}
+	registered := false
+	for _, redirectURI := range client.RedirectURIs {
+		if redirectURI == request.RedirectURI {
+			registered = true
+			break
+		}
+	}
+	if !registered {
+		return nil, nil, utils.ErrOAuthInvalidRequest
+	}
+
+	if request.ResponseType != "code" {
+		return client, nil, utils.ErrOAuthUnsupportedResponse
+	}
+
+	// Public clients cannot keep a secret, so they have to prove they started the flow
+	if request.CodeChallenge != "" && request.CodeChallengeMethod != security.PKCEMethodS256 {
+		return client, nil, utils.ErrOAuthInvalidRequest
+	}
+	if !client.Confidential && request.CodeChallenge == "" {
+		return client, nil, utils.ErrOAuthInvalidRequest
+	}
+
+	scopes, err := parseScopes(request.Scope, client.Scopes)
+	if err != nil {
+		return client, nil, err
+	}
+	return client, scopes, nil
+}
+
+func (o *OAuthServiceImpl) getConsent(userId string, clientId string) (*models.OAuthConsent, error) {
+	var consent *models.OAuthConsent
+	query := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "client_id", Value: clientId}}
+	err := o.consentCollection.FindOne(o.ctx, query).Decode(&consent)
+	return consent, err
+}
+
+// GetAuthorizeInfo will validate the authorization request and return what the consent screen
+// has to show, including whether the user already consented to every requested scope.
+func (o *OAuthServiceImpl) GetAuthorizeInfo(userId *string, request *models.OAuthAuthorizeRequest) (*models.OAuthAuthorizeInfo, error) {
+	client, scopes, err := o.validateAuthorizeRequest(request)
+	if err != nil {
+		return nil, err
+	}
+
+	consentExists := false
+	consent, err := o.getConsent(*userId, client.ClientID)
+	if err == nil {
+		consentExists = true
+		for _, scope := range scopes {
+			if !containsScope(consent.Scopes, scope) {
+				consentExists = false
+			}
+		}
+	} else if err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+
+	return &models.OAuthAuthorizeInfo{
+		ClientName:    client.Name,
+		Scopes:        scopes,
+		ConsentExists: consentExists,
+	}, nil
+}
+
+// Authorize will record the decision of the user and return the URI the user has to be
+// redirected to, carrying either an authorization code or the error.
+func (o *OAuthServiceImpl) Authorize(userId *string, request *models.OAuthAuthorizeRequest) (string, error) {
+	// The only registered URI is used if the client leaves it out, and then the client does
+	// not have to repeat it when exchanging the code
+	redirectURIDefaulted := request.RedirectURI == ""
+	client, scopes, err := o.validateAuthorizeRequest(request)
+	if client == nil {
+		return "", err
+	}
+
+	redirectURI, parseErr := url.Parse(request.RedirectURI)
+	if parseErr != nil {
+		return "", utils.ErrOAuthInvalidRequest
+	}
+	query := redirectURI.Query()
+	if request.State != "" {
+		query.Set("state", request.State)
+	}
+
+	if err == nil && !request.Approve {
+		err = utils.ErrOAuthAccessDenied
+	}
+	if err != nil {
+		query.Set("error", err.Error())
+		redirectURI.RawQuery = query.Encode()
+		return redirectURI.String(), nil
+	}
+
+	err = o.saveConsent(*userId, client.ClientID, scopes)
+	if err != nil {
+		return "", err
+	}
+
+	code, err := security.NewRandomToken(32)
+	if err != nil {
+		return "", err
+	}
+
+	authorizationCode := models.OAuthAuthorizationCode{
+		ID:                   primitive.NewObjectID(),
+		CodeHash:             security.HashToken(code),
+		ClientID:             client.ClientID,
+		UserID:               *userId,
+		RedirectURI:          request.RedirectURI,
+		RedirectURIDefaulted: redirectURIDefaulted,
+		Scopes:               scopes,
+		CodeChallenge:        request.CodeChallenge,
+		CodeChallengeMethod:  request.CodeChallengeMethod,
+		CreatedAt:            time.Now(),
+	}
+	authorizationCode.ExpiresAt = authorizationCode.CreatedAt.Add(oauthCodeLifetime)
+
+	_, err = o.codeCollection.InsertOne(o.ctx, authorizationCode)
+	if err != nil {
+		return "", err
+	}
+
+	query.Set("code", code)
+	redirectURI.RawQuery = query.Encode()
+	return redirectURI.String(), nil
+}
+
+// saveConsent will add the given scopes to the consent of the user given to the client.
+func (o *OAuthServiceImpl) saveConsent(userId string, clientId string, scopes []models.Scope) error {
+	now := time.Now()
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "client_id", Value: clientId}}
+	update := bson.D{
+		bson.E{Key: "$addToSet", Value: bson.D{bson.E{Key: "scopes", Value: bson.D{bson.E{Key: "$each", Value: scopes}}}}},
+		bson.E{Key: "$set", Value: bson.D{bson.E{Key: "updated_at", Value: now}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "_id", Value: primitive.NewObjectID()},
+			bson.E{Key: "created_at", Value: now},
+		}},
+	}
+	_, err := o.consentCollection.UpdateOne(o.ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// Exchange will issue an access token for the authorization code or client credentials grant.
+func (o *OAuthServiceImpl) Exchange(request *models.OAuthTokenRequest) (*models.OAuthTokenResponse, error) {
+	client, err := o.authenticateClient(request.ClientID, request.ClientSecret)
+	if err != nil {
+		return nil, err
+	}
+
+	switch request.GrantType {
+	case GrantTypeAuthorizationCode:
+		return o.exchangeAuthorizationCode(client, request)
+	case GrantTypeClientCredentials:
+		if !client.Confidential {
+			return nil, utils.ErrOAuthUnauthorizedClient
+		}
+		scopes, err := parseScopes(request.Scope, client.Scopes)
+		if err != nil {
+			return nil, err
+		}
+		return o.issueToken(client.ClientID, client.OwnerUserID, scopes, GrantTypeClientCredentials)
+	}
+	return nil, utils.ErrOAuthUnsupportedGrantType
+}
+
+func (o *OAuthServiceImpl) exchangeAuthorizationCode(client *models.OAuthClient, request *models.OAuthTokenRequest) (*models.OAuthTokenResponse, error) {
+	if request.Code == "" {
+		return nil, utils.ErrOAuthInvalidRequest
+	}
+
+	now := time.Now()
+	filter := bson.D{
+		bson.E{Key: "code_hash", Value: security.HashToken(request.Code)},
+		bson.E{Key: "used_at", Value: nil},
+		bson.E{Key: "expires_at", Value: bson.D{bson.E{Key: "$gt", Value: now}}},
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "used_at", Value: now}}}}
+
+	var code *models.OAuthAuthorizationCode
+	err := o.codeCollection.FindOneAndUpdate(o.ctx, filter, update).Decode(&code)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrOAuthInvalidGrant
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// RFC 6749 only requires the redirect URI if it was given when authorizing, but if it is
+	// given, it has to match anyway
+	if code.ClientID != client.ClientID {
+		return nil, utils.ErrOAuthInvalidGrant
+	}
+	if (!code.RedirectURIDefaulted || request.RedirectURI != "") && code.RedirectURI != request.RedirectURI {
+		return nil, utils.ErrOAuthInvalidGrant
+	}
+	if code.CodeChallenge != "" && !security.VerifyPKCE(request.CodeVerifier, code.CodeChallenge) {
+		return nil, utils.ErrOAuthInvalidGrant
+	}
+
+	return o.issueToken(client.ClientID, code.UserID, code.Scopes, GrantTypeAuthorizationCode)
+}
+
+func (o *OAuthServiceImpl) issueToken(clientId string, userId string, scopes []models.Scope, grantType string) (*models.OAuthTokenResponse, error) {
+	token := models.OAuthToken{
+		ID:        primitive.NewObjectID(),
+		ClientID:  clientId,
+		UserID:    userId,
+		Scopes:    scopes,
+		GrantType: grantType,
+		CreatedAt: time.Now(),
+	}
+	token.ExpiresAt = token.CreatedAt.Add(oauthAccessTokenLifetime)
+
+	_, err := o.tokenCollection.InsertOne(o.ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	scope := joinScopes(scopes)
+	accessToken, err := security.NewOAuthAccessToken(token.ID.Hex(), clientId, userId, scope, token.CreatedAt, token.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.OAuthTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int64(oauthAccessTokenLifetime.Seconds()),
+		Scope:       scope,
+	}, nil
+}
+
+// ValidateAccessToken will return the record of the token with the given ID if it is neither
+// revoked nor expired. Otherwise, it will return an error.
+func (o *OAuthServiceImpl) ValidateAccessToken(tokenId string) (*models.OAuthToken, error) {
+	objID, err := primitive.ObjectIDFromHex(tokenId)
+	if err != nil {
+		return nil, utils.ErrTokenParseError
+	}
+
+	var token *models.OAuthToken
+	query := bson.D{bson.E{Key: "_id", Value: objID}}
+	err = o.tokenCollection.FindOne(o.ctx, query).Decode(&token)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if token.RevokedAt != nil {
+		return nil, utils.ErrSessionRevoked
+	}
+	if time.Now().After(token.ExpiresAt) {
+		return nil, utils.ErrExpiredAuthToken
+	}
+	return token, nil
+}
+
+// findToken will return the record of the given access token string if it was issued to the
+// given client.
+func (o *OAuthServiceImpl) findToken(client *models.OAuthClient, tokenString string) (*models.OAuthToken, error) {
+	claims, err := security.ParseRawToken(tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if kind, _ := (*claims)["token_type"].(string); kind != security.OAuthAccessTokenType {
+		return nil, utils.ErrInvalidTokenType
+	}
+
+	tokenId, _ := (*claims)["jti"].(string)
+	token, err := o.ValidateAccessToken(tokenId)
+	if err != nil {
+		return nil, err
+	}
+	if token.ClientID != client.ClientID {
+		return nil, utils.ErrOAuthInvalidClient
+	}
+	return token, nil
+}
+
+// Introspect will describe the given token to the confidential client it was issued to. Every
+// token which cannot be used is reported as inactive, without telling the reason.
+func (o *OAuthServiceImpl) Introspect(clientId string, clientSecret string, tokenString string) (*models.OAuthIntrospection, error) {
+	client, err := o.authenticateClient(clientId, clientSecret)
+	if err != nil {
+		return nil, err
+	}
+	if !client.Confidential {
+		return nil, utils.ErrOAuthUnauthorizedClient
+	}
+
+	token, err := o.findToken(client, tokenString)
+	if err != nil {
+		return &models.OAuthIntrospection{Active: false}, nil
+	}
+
+	return &models.OAuthIntrospection{
+		Active:    true,
+		Scope:     joinScopes(token.Scopes),
+		ClientID:  token.ClientID,
+		Subject:   token.UserID,
+		TokenType: "Bearer",
+		ExpiresAt: token.ExpiresAt.Unix(),
+		IssuedAt:  token.CreatedAt.Unix(),
+	}, nil
+}
+
+// Revoke will revoke the given token if it was issued to the client. As RFC 7009 requires,
+// invalid tokens are not reported as errors.
+func (o *OAuthServiceImpl) Revoke(clientId string, clientSecret string, tokenString string) error {
+	client, err := o.authenticateClient(clientId, clientSecret)
+	if err != nil {
+		return err
+	}
+
+	token, err := o.findToken(client, tokenString)
+	if err != nil {
+		return nil
+	}
+
+	return o.revokeTokens(bson.D{bson.E{Key: "_id", Value: token.ID}})
+}
+
+func (o *OAuthServiceImpl) revokeTokens(filter bson.D) error {
+	filter = append(filter, bson.E{Key: "revoked_at", Value: nil})
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked_at", Value: time.Now()}}}}
+	_, err := o.tokenCollection.UpdateMany(o.ctx, filter, update)
+	return err
+}
+
+func (o *OAuthServiceImpl) GetConsentsOfUser(userId *string) ([]*models.OAuthConsent, error) {
+	consents := []*models.OAuthConsent{}
+
+	query := bson.D{bson.E{Key: "user_id", Value: *userId}}
+	cur, err := o.consentCollection.Find(o.ctx, query)
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(o.ctx) {
+		var consent *models.OAuthConsent
+		err := cur.Decode(&consent)
+		if err != nil {
+			return nil, err
+		}
+
+		consents = append(consents, consent)
+	}
+
+	cur.Close(o.ctx)
+
+	return consents, err
+}
+
+// RevokeConsent will forget the consent of the user given to the client and revoke every
+// token the client received on behalf of the user.
+func (o *OAuthServiceImpl) RevokeConsent(userId *string, clientId *string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: *userId}, bson.E{Key: "client_id", Value: *clientId}}
+	result, err := o.consentCollection.DeleteOne(o.ctx, filter)
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount != 1 {
+		return utils.ErrNoMatchedDocumentFoundForDelete
+	}
+
+	return o.revokeTokens(bson.D{
+		bson.E{Key: "user_id", Value: *userId},
+		bson.E{Key: "client_id", Value: *clientId},
+		bson.E{Key: "grant_type", Value: GrantTypeAuthorizationCode},
+	})
+}
+
+// RevokeGrantsOfUser will revoke every token issued on behalf of the user, forget the consents
+// and the unused codes of the user, and delete the clients of the user together with their
+// tokens, so nothing keeps acting as the user once the account is deleted.
+func (o *OAuthServiceImpl) RevokeGrantsOfUser(userId *string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: *userId}}
+	err := o.revokeTokens(filter)
+	if err != nil {
+		return err
+	}
+	_, err = o.consentCollection.DeleteMany(o.ctx, filter)
+	if err != nil {
+		return err
+	}
+	_, err = o.codeCollection.DeleteMany(o.ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	clients, err := o.GetClientsOfUser(userId)
+	if err != nil {
+		return err
+	}
+	for _, client := range clients {
+		err = o.DeleteClient(userId, &client.ClientID)
+		if err != nil && err != utils.ErrNoMatchedDocumentFoundForDelete {
+			return err
+		}
+	}
+	return nil
+}
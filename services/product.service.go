@@ -8,6 +8,11 @@ type ProductService interface {
 	GetAllProducts() ([]*models.Product, error)
 	UpdateProduct(*models.Product) error
 	DeleteProduct(*string) error
+	DeleteProductImage(*models.Product, *string) error
+	ReorderProductImages(*models.Product, *models.ProductImageOrder) error
+	SetPrimaryProductImage(*models.Product, *string) error
+	MigrateImageKeys() (int, error)
+	MigrateStorageUsage() (int, error)
 	GetAllProductsOfUser(*string) ([]*models.Product, error)
 	BuyProducts(*map[string]int32, *string) error
 	GetProductObserverOfUser(*string) (*models.ProductObserver, error)
@@ -2,6 +2,11 @@ package services
 
 import (
 	"context"
+	"log"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
 	"time"
 
 	"github.com/akunsecured/emezen_api/models"
@@ -9,25 +14,71 @@ import (
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type ProductServiceImpl struct {
 	productCollection         *mongo.Collection
 	productObserverCollection *mongo.Collection
 	userService               UserService
+	imageService              ImageService
+	storageService            StorageService
+	tradingPolicy             models.TradingPolicy
 	ctx                       context.Context
 }
 
-func NewProductService(productCollection *mongo.Collection, productObserverCollection *mongo.Collection, userService UserService, ctx context.Context) ProductService {
+func NewProductService(productCollection *mongo.Collection, productObserverCollection *mongo.Collection, userService UserService, imageService ImageService, storageService StorageService, tradingPolicy models.TradingPolicy, ctx context.Context) ProductService {
 	return &ProductServiceImpl{
 		productCollection:         productCollection,
 		productObserverCollection: productObserverCollection,
 		userService:               userService,
+		imageService:              imageService,
+		storageService:            storageService,
+		tradingPolicy:             tradingPolicy,
 		ctx:                       ctx,
 	}
 }
 
+// checkEmailVerified will return an error if the user with the given ID has not verified
+// their email address yet.
+func (p *ProductServiceImpl) checkEmailVerified(userId *string) error {
+	user, err := p.userService.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if !user.EmailVerified {
+		return utils.ErrEmailIsNotVerified
+	}
+	return nil
+}
+
+// checkCanSell will return an error if the trading policy does not allow the user with the
+// given ID to list products.
+func (p *ProductServiceImpl) checkCanSell(userId *string) error {
+	if !p.tradingPolicy.VerifiedEmailToSell && !p.tradingPolicy.SellerRoleToSell {
+		return nil
+	}
+
+	user, err := p.userService.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if p.tradingPolicy.VerifiedEmailToSell && !user.EmailVerified {
+		return utils.ErrEmailIsNotVerified
+	}
+	if p.tradingPolicy.SellerRoleToSell && !models.HasRole(user.GetRoles(), models.RoleSeller) {
+		return utils.ErrSellerRoleRequired
+	}
+	return nil
+}
+
+// AddProduct will save the given product. The seller of the product has to be set by the
+// caller from the authenticated user, it is never taken from the client.
 func (p *ProductServiceImpl) AddProduct(product *models.Product) (*string, error) {
+	if err := p.checkCanSell(&product.SellerID); err != nil {
+		return nil, err
+	}
+
 	product.ID = primitive.NewObjectID()
 	product.CreatedAt = time.Now()
 	product.UpdatedAt = product.CreatedAt
@@ -116,26 +167,238 @@ func (p *ProductServiceImpl) UpdateProduct(product *models.Product) error {
 	return err
 }
 
+// DeleteProduct will delete the product, and the images which are not used by any other
+// product.
 func (p *ProductServiceImpl) DeleteProduct(productId *string) error {
 	objID, err := primitive.ObjectIDFromHex(*productId)
 	if err != nil {
 		return err
 	}
 
+	var product *models.Product
 	filter := bson.D{bson.E{Key: "_id", Value: objID}}
-	result, _ := p.productCollection.DeleteOne(p.ctx, filter)
-	if result.DeletedCount != 1 {
+	err = p.productCollection.FindOneAndDelete(p.ctx, filter).Decode(&product)
+	if err == mongo.ErrNoDocuments {
 		return utils.ErrNoMatchedDocumentFoundForDelete
+	} else if err != nil {
+		return err
+	}
+
+	p.collectImages(product.SellerID, product.Images)
+	return nil
+}
+
+// productImageIndex returns the index of the image with the given file name in the images of
+// the product, or -1 if the product has no such image.
+func productImageIndex(product *models.Product, fileName string) int {
+	for index, image := range product.Images {
+		if path.Base(image) == fileName {
+			return index
+		}
+	}
+	return -1
+}
+
+// isImageUsed tells if any product has the image with the given file name. If the seller is
+// given, only the products of the seller are checked.
+func (p *ProductServiceImpl) isImageUsed(fileName string, sellerId string) (bool, error) {
+	pattern := "(^|/)" + regexp.QuoteMeta(fileName) + "$"
+	filter := bson.D{bson.E{Key: "images", Value: primitive.Regex{Pattern: pattern}}}
+	if sellerId != "" {
+		filter = append(filter, bson.E{Key: "seller_id", Value: sellerId})
+	}
+	count, err := p.productCollection.CountDocuments(p.ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+// collectImages will stop charging the seller for the given images once none of their
+// products uses them, and delete them from the blob store unless another product uses them
+// too, since the same content is stored only once. Failures are only logged, the images are
+// collected again when another product referencing them is deleted.
+func (p *ProductServiceImpl) collectImages(sellerId string, images []string) {
+	for _, image := range images {
+		fileName := path.Base(image)
+		key := models.ProductPicturesPrefix + fileName
+
+		used, err := p.isImageUsed(fileName, sellerId)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if used {
+			continue
+		}
+		if err := p.storageService.RemoveUsage(sellerId, key); err != nil {
+			log.Print(err)
+		}
+
+		used, err = p.isImageUsed(fileName, "")
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		if used {
+			continue
+		}
+		if err := p.imageService.DeleteImage(key); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// DeleteProductImage will remove the image with the given file name from the product, and
+// delete it from the blob store if no other product uses it.
+func (p *ProductServiceImpl) DeleteProductImage(product *models.Product, fileName *string) error {
+	index := productImageIndex(product, *fileName)
+	if index < 0 {
+		return utils.ErrProductImageNotFound
+	}
+
+	removed := product.Images[index]
+	product.Images = append(product.Images[:index:index], product.Images[index+1:]...)
+	if err := p.UpdateProduct(product); err != nil {
+		return err
 	}
 
+	p.collectImages(product.SellerID, []string{removed})
 	return nil
 }
 
+// ReorderProductImages will order the images of the product as the file names in the request.
+// Images cannot be added or removed this way.
+func (p *ProductServiceImpl) ReorderProductImages(product *models.Product, order *models.ProductImageOrder) error {
+	// Earlier uploads could list the same image twice, those are only listed once in the new
+	// order, so the duplicates are dropped
+	distinct := make(map[string]bool)
+	for _, image := range product.Images {
+		distinct[path.Base(image)] = true
+	}
+	if len(order.Images) != len(distinct) {
+		return utils.ErrInvalidImageOrder
+	}
+
+	images := make([]string, 0, len(order.Images))
+	seen := make(map[string]bool)
+	for _, fileName := range order.Images {
+		index := productImageIndex(product, fileName)
+		if index < 0 || seen[fileName] {
+			return utils.ErrInvalidImageOrder
+		}
+		seen[fileName] = true
+		images = append(images, product.Images[index])
+	}
+
+	product.Images = images
+	return p.UpdateProduct(product)
+}
+
+// SetPrimaryProductImage will move the image with the given file name to the front of the
+// images of the product, keeping the order of the others.
+func (p *ProductServiceImpl) SetPrimaryProductImage(product *models.Product, fileName *string) error {
+	index := productImageIndex(product, *fileName)
+	if index < 0 {
+		return utils.ErrProductImageNotFound
+	}
+
+	primary := product.Images[index]
+	copy(product.Images[1:index+1], product.Images[:index])
+	product.Images[0] = primary
+	return p.UpdateProduct(product)
+}
+
+// MigrateImageKeys will replace the image links saved by earlier versions with the storage
+// keys of the images, and returns the number of updated products. Links which do not point
+// to a product image of the API are kept.
+func (p *ProductServiceImpl) MigrateImageKeys() (int, error) {
+	filter := bson.D{bson.E{Key: "images", Value: primitive.Regex{Pattern: "^https?://"}}}
+	cur, err := p.productCollection.Find(p.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	defer cur.Close(p.ctx)
+
+	updated := 0
+	for cur.Next(p.ctx) {
+		var product models.Product
+		if err := cur.Decode(&product); err != nil {
+			return updated, err
+		}
+
+		changed := false
+		for index, image := range product.Images {
+			parsed, err := url.Parse(image)
+			if err != nil || !strings.HasSuffix(path.Dir(parsed.Path), "/product/image") {
+				continue
+			}
+			product.Images[index] = models.ProductPicturesPrefix + path.Base(parsed.Path)
+			changed = true
+		}
+		if !changed {
+			continue
+		}
+
+		filter := bson.D{bson.E{Key: "_id", Value: product.ID}}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "images", Value: product.Images}}}}
+		if _, err := p.productCollection.UpdateOne(p.ctx, filter, update); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, cur.Err()
+}
+
+// MigrateStorageUsage will charge the sellers for the product images uploaded before the
+// storage usage was tracked, and for the variants of the images, which were not charged
+// before. It returns the number of images it found.
+func (p *ProductServiceImpl) MigrateStorageUsage() (int, error) {
+	products, err := p.GetAllProducts()
+	if err != nil {
+		return 0, err
+	}
+
+	added := 0
+	for _, product := range products {
+		for _, key := range product.Images {
+			counted, err := p.storageService.HasUsage(product.SellerID, key)
+			if err != nil {
+				return added, err
+			}
+			if !counted {
+				info, err := p.imageService.GetImageInfo(key)
+				if err == utils.ErrBlobNotFound || err == utils.ErrInvalidBlobKey {
+					continue
+				} else if err != nil {
+					return added, err
+				}
+				if err := p.storageService.SetUsage(product.SellerID, key, info.Size); err != nil {
+					return added, err
+				}
+				added++
+			}
+
+			variantSize, err := p.imageService.GetVariantSize(key)
+			if err != nil {
+				return added, err
+			}
+			if err := p.storageService.SetVariantUsage(key, variantSize); err != nil {
+				return added, err
+			}
+		}
+	}
+	return added, nil
+}
+
 func (p *ProductServiceImpl) BuyProducts(cart *map[string]int32, userId *string) error {
 	if len(*cart) == 0 {
 		return utils.ErrEmptyCart
 	}
 
+	if p.tradingPolicy.VerifiedEmailToBuy {
+		if err := p.checkEmailVerified(userId); err != nil {
+			return err
+		}
+	}
+
 	var err error
 
 	var sum float32
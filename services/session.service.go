@@ -0,0 +1,12 @@
+package services
+
+import "github.com/akunsecured/emezen_api/models"
+
+type SessionService interface {
+	CreateSession(*string) (*string, error)
+	CreateImpersonationSession(*string, *string) (*models.Session, error)
+	GetSession(*string) (*models.Session, error)
+	RevokeSession(*string) error
+	RevokeAllSessionsOfUser(*string) error
+	RevokeOtherSessionsOfUser(*string, *string) error
+}
@@ -0,0 +1,123 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/security"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type SessionServiceImpl struct {
+	sessionCollection *mongo.Collection
+	ctx               context.Context
+}
+
+func NewSessionService(sessionCollection *mongo.Collection, ctx context.Context) SessionService {
+	return &SessionServiceImpl{
+		sessionCollection: sessionCollection,
+		ctx:               ctx,
+	}
+}
+
+// CreateSession will save a new session for the given user. The session lives as long as
+// the refresh token issued with it.
+func (s *SessionServiceImpl) CreateSession(userId *string) (*string, error) {
+	session := models.Session{
+		ID:        primitive.NewObjectID(),
+		UserID:    *userId,
+		CreatedAt: time.Now(),
+	}
+	session.ExpiresAt = session.CreatedAt.Add(security.RefreshTokenLifetime)
+
+	result, err := s.sessionCollection.InsertOne(s.ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	if oid, ok := result.InsertedID.(primitive.ObjectID); ok {
+		var oidHex = oid.Hex()
+		return &oidHex, nil
+	}
+	return nil, utils.ErrInsertedIDIsNotObjectID
+}
+
+// CreateImpersonationSession will save a short-lived session in which the given admin acts
+// as the given user. It cannot be refreshed, it ends with the impersonation token.
+func (s *SessionServiceImpl) CreateImpersonationSession(userId *string, actorId *string) (*models.Session, error) {
+	session := models.Session{
+		ID:        primitive.NewObjectID(),
+		UserID:    *userId,
+		ActorID:   *actorId,
+		CreatedAt: time.Now(),
+	}
+	session.ExpiresAt = session.CreatedAt.Add(security.ImpersonationTokenLifetime)
+
+	_, err := s.sessionCollection.InsertOne(s.ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GetSession will return the session with the given ID if it is neither revoked nor expired.
+// Otherwise, it will return an error.
+func (s *SessionServiceImpl) GetSession(sessionId *string) (*models.Session, error) {
+	var session *models.Session
+	objID, err := primitive.ObjectIDFromHex(*sessionId)
+	if err != nil {
+		return nil, utils.ErrSessionRevoked
+	}
+	query := bson.D{bson.E{Key: "_id", Value: objID}}
+	err = s.sessionCollection.FindOne(s.ctx, query).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, utils.ErrSessionRevoked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if session.RevokedAt != nil {
+		return nil, utils.ErrSessionRevoked
+	}
+	if time.Now().After(session.ExpiresAt) {
+		return nil, utils.ErrExpiredAuthToken
+	}
+	return session, nil
+}
+
+func (s *SessionServiceImpl) RevokeSession(sessionId *string) error {
+	objID, err := primitive.ObjectIDFromHex(*sessionId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}, bson.E{Key: "revoked_at", Value: nil}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked_at", Value: time.Now()}}}}
+	_, err = s.sessionCollection.UpdateOne(s.ctx, filter, update)
+	return err
+}
+
+// RevokeAllSessionsOfUser will revoke every active session of the given user, so none of
+// the previously issued refresh tokens can be used anymore.
+func (s *SessionServiceImpl) RevokeAllSessionsOfUser(userId *string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: *userId}, bson.E{Key: "revoked_at", Value: nil}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked_at", Value: time.Now()}}}}
+	_, err := s.sessionCollection.UpdateMany(s.ctx, filter, update)
+	return err
+}
+
+// RevokeOtherSessionsOfUser will revoke every active session of the given user except the
+// given one, so the user stays logged in where the request came from.
+func (s *SessionServiceImpl) RevokeOtherSessionsOfUser(userId *string, sessionId *string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: *userId}, bson.E{Key: "revoked_at", Value: nil}}
+	if objID, err := primitive.ObjectIDFromHex(*sessionId); err == nil {
+		filter = append(filter, bson.E{Key: "_id", Value: bson.D{bson.E{Key: "$ne", Value: objID}}})
+	}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "revoked_at", Value: time.Now()}}}}
+	_, err := s.sessionCollection.UpdateMany(s.ctx, filter, update)
+	return err
+}
@@ -0,0 +1,20 @@
+package services
+
+import (
+	"github.com/akunsecured/emezen_api/models"
+)
+
+type StorageService interface {
+	GetPolicy() models.StoragePolicy
+	GetUsage(string) (*models.StorageUsage, error)
+	ReserveQuota(string, int64, ...string) (int64, error)
+	ReleaseQuota(string, int64) error
+	ReserveUploads(string, int) error
+	SetUsage(string, string, int64) error
+	SetVariantUsage(string, int64) error
+	ReserveVariantUsage(string, int64) error
+	RemoveUsage(string, string) error
+	HasUsage(string, string) (bool, error)
+	EnsureIndexes() error
+	MigrateTotals() (int, error)
+}
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const uploadRateWindow = time.Hour * 1
+
+type StorageServiceImpl struct {
+	storageCollection *mongo.Collection
+	totalCollection   *mongo.Collection
+	uploadCollection  *mongo.Collection
+	policy            models.StoragePolicy
+	ctx               context.Context
+}
+
+func NewStorageService(storageCollection *mongo.Collection, totalCollection *mongo.Collection, uploadCollection *mongo.Collection, policy models.StoragePolicy, ctx context.Context) StorageService {
+	return &StorageServiceImpl{
+		storageCollection: storageCollection,
+		totalCollection:   totalCollection,
+		uploadCollection:  uploadCollection,
+		policy:            policy,
+		ctx:               ctx,
+	}
+}
+
+func (s *StorageServiceImpl) GetPolicy() models.StoragePolicy {
+	return s.policy
+}
+
+// EnsureIndexes will create the unique indexes which keep a file from being counted twice
+// for the same user and a user from having two totals or two counters in the same hour, and
+// the TTL index which deletes the upload counters once their hour is over.
+func (s *StorageServiceImpl) EnsureIndexes() error {
+	index := mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := s.storageCollection.Indexes().CreateOne(s.ctx, index); err != nil {
+		return err
+	}
+
+	index = mongo.IndexModel{
+		Keys:    bson.D{bson.E{Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	}
+	if _, err := s.totalCollection.Indexes().CreateOne(s.ctx, index); err != nil {
+		return err
+	}
+
+	indexes := []mongo.IndexModel{
+		{
+			Keys:    bson.D{bson.E{Key: "window_start", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(uploadRateWindow.Seconds())),
+		},
+		{
+			Keys:    bson.D{bson.E{Key: "user_id", Value: 1}, bson.E{Key: "window_start", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+	}
+	_, err := s.uploadCollection.Indexes().CreateMany(s.ctx, indexes)
+	return err
+}
+
+// MigrateTotals will create the totals of the users whose files were counted before the
+// totals were kept, and returns the number of users it found. It has to run before anything
+// else changes the usage.
+func (s *StorageServiceImpl) MigrateTotals() (int, error) {
+	filter := bson.D{bson.E{Key: "variant_size", Value: bson.D{bson.E{Key: "$exists", Value: false}}}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "variant_size", Value: 0}}}}
+	if _, err := s.storageCollection.UpdateMany(s.ctx, filter, update); err != nil {
+		return 0, err
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{bson.E{Key: "$group", Value: bson.D{
+			bson.E{Key: "_id", Value: "$user_id"},
+			bson.E{Key: "bytes", Value: bson.D{bson.E{Key: "$sum", Value: bson.D{
+				bson.E{Key: "$add", Value: bson.A{"$size", "$variant_size"}},
+			}}}},
+		}}},
+	}
+	cur, err := s.storageCollection.Aggregate(s.ctx, pipeline)
+	if err != nil {
+		return 0, err
+	}
+	var totals []struct {
+		UserID string `bson:"_id"`
+		Bytes  int64  `bson:"bytes"`
+	}
+	if err := cur.All(s.ctx, &totals); err != nil {
+		return 0, err
+	}
+
+	created := 0
+	for _, total := range totals {
+		filter := bson.D{bson.E{Key: "user_id", Value: total.UserID}}
+		update := bson.D{bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "_id", Value: primitive.NewObjectID()},
+			bson.E{Key: "used_bytes", Value: total.Bytes},
+		}}}
+		result, err := s.totalCollection.UpdateOne(s.ctx, filter, update, options.Update().SetUpsert(true))
+		if err != nil {
+			return created, err
+		}
+		if result.UpsertedCount > 0 {
+			created++
+		}
+	}
+	return created, nil
+}
+
+// addUsedBytes will change the total of the user by the given number of bytes.
+func (s *StorageServiceImpl) addUsedBytes(userId string, bytes int64) error {
+	if bytes == 0 {
+		return nil
+	}
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}}
+	update := bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "used_bytes", Value: bytes}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{bson.E{Key: "_id", Value: primitive.NewObjectID()}}},
+	}
+	_, err := s.totalCollection.UpdateOne(s.ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+// recordedBytes returns the number of bytes charged to the user for the files with the given
+// keys.
+func (s *StorageServiceImpl) recordedBytes(userId string, keys ...string) (int64, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	filter := bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "key", Value: bson.D{bson.E{Key: "$in", Value: keys}}},
+	}
+	cur, err := s.storageCollection.Find(s.ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+	var records []*models.StorageRecord
+	if err := cur.All(s.ctx, &records); err != nil {
+		return 0, err
+	}
+
+	var bytes int64
+	for _, record := range records {
+		bytes += record.Size + record.VariantSize
+	}
+	return bytes, nil
+}
+
+func (s *StorageServiceImpl) GetUsage(userId string) (*models.StorageUsage, error) {
+	var total models.StorageTotal
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}}
+	err := s.totalCollection.FindOne(s.ctx, filter).Decode(&total)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return nil, err
+	}
+	files, err := s.storageCollection.CountDocuments(s.ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.StorageUsage{
+		UsedBytes:           total.UsedBytes,
+		QuotaBytes:          s.policy.QuotaBytes,
+		Files:               files,
+		MaxImagesPerProduct: s.policy.MaxImagesPerProduct,
+		MaxUploadsPerHour:   s.policy.MaxUploadsPerHour,
+	}, nil
+}
+
+// ReserveQuota will add the given number of bytes to the total of the user, unless it would
+// exceed the quota. The files with the given keys are about to be replaced, so their size is
+// not reserved again. It returns the number of bytes reserved, which have to be released with
+// ReleaseQuota once the upload is done.
+func (s *StorageServiceImpl) ReserveQuota(userId string, size int64, replacedKeys ...string) (int64, error) {
+	if s.policy.QuotaBytes <= 0 {
+		return 0, nil
+	}
+	replacedBytes, err := s.recordedBytes(userId, replacedKeys...)
+	if err != nil {
+		return 0, err
+	}
+	reserved := size - replacedBytes
+	if reserved <= 0 {
+		return 0, nil
+	}
+	if err := s.reserveBytes(userId, reserved); err != nil {
+		return 0, err
+	}
+	return reserved, nil
+}
+
+// reserveBytes will add the given number of bytes to the total of the user, unless it would
+// exceed the quota. The total is only incremented if it is low enough, so uploads running at
+// the same time cannot exceed the quota together.
+func (s *StorageServiceImpl) reserveBytes(userId string, bytes int64) error {
+	if s.policy.QuotaBytes <= 0 || bytes <= 0 {
+		return s.addUsedBytes(userId, bytes)
+	}
+	if bytes > s.policy.QuotaBytes {
+		return utils.ErrStorageQuotaExceeded
+	}
+
+	filter := bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "used_bytes", Value: bson.D{bson.E{Key: "$lte", Value: s.policy.QuotaBytes - bytes}}},
+	}
+	update := bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "used_bytes", Value: bytes}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{bson.E{Key: "_id", Value: primitive.NewObjectID()}}},
+	}
+	_, err := s.totalCollection.UpdateOne(s.ctx, filter, update, options.Update().SetUpsert(true))
+	// If the total of the user is too high, the filter does not match, and the upsert fails
+	// on the unique index of the existing total
+	if mongo.IsDuplicateKeyError(err) {
+		return utils.ErrStorageQuotaExceeded
+	}
+	return err
+}
+
+// ReleaseQuota will give back the bytes reserved by ReserveQuota.
+func (s *StorageServiceImpl) ReleaseQuota(userId string, reserved int64) error {
+	return s.addUsedBytes(userId, -reserved)
+}
+
+// ReserveUploads will count the given number of files against the upload rate of the user,
+// unless the user would upload more files in the current hour than allowed. The counter is
+// only incremented if it is low enough, so requests running at the same time cannot exceed
+// the limit together. Every file of a request is counted, even if it is rejected later.
+func (s *StorageServiceImpl) ReserveUploads(userId string, files int) error {
+	if s.policy.MaxUploadsPerHour <= 0 {
+		return nil
+	}
+	if files > s.policy.MaxUploadsPerHour {
+		return utils.ErrTooManyUploads
+	}
+
+	filter := bson.D{
+		bson.E{Key: "user_id", Value: userId},
+		bson.E{Key: "window_start", Value: time.Now().Truncate(uploadRateWindow)},
+		bson.E{Key: "uploads", Value: bson.D{bson.E{Key: "$lte", Value: s.policy.MaxUploadsPerHour - files}}},
+	}
+	update := bson.D{
+		bson.E{Key: "$inc", Value: bson.D{bson.E{Key: "uploads", Value: files}}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{bson.E{Key: "_id", Value: primitive.NewObjectID()}}},
+	}
+	_, err := s.uploadCollection.UpdateOne(s.ctx, filter, update, options.Update().SetUpsert(true))
+	// The counter of the hour exists already if the filter does not match because of the
+	// number of uploads, so the upsert fails on the unique index
+	if mongo.IsDuplicateKeyError(err) {
+		return utils.ErrTooManyUploads
+	}
+	return err
+}
+
+// SetUsage will count the file with the given key and size against the quota of the user,
+// replacing the previous size if the key is already counted.
+func (s *StorageServiceImpl) SetUsage(userId string, key string, size int64) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "key", Value: key}}
+	update := bson.D{
+		bson.E{Key: "$set", Value: bson.D{
+			bson.E{Key: "size", Value: size},
+			bson.E{Key: "uploaded_at", Value: time.Now()},
+		}},
+		bson.E{Key: "$setOnInsert", Value: bson.D{
+			bson.E{Key: "_id", Value: primitive.NewObjectID()},
+			bson.E{Key: "variant_size", Value: 0},
+		}},
+	}
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.Before)
+
+	var previous models.StorageRecord
+	err := s.storageCollection.FindOneAndUpdate(s.ctx, filter, update, opts).Decode(&previous)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+	return s.addUsedBytes(userId, size-previous.Size)
+}
+
+// SetVariantUsage will charge every user of the file with the given key for its resized
+// copies, which take the given number of bytes together.
+func (s *StorageServiceImpl) SetVariantUsage(key string, size int64) error {
+	return s.setVariantUsage(key, size, false)
+}
+
+// ReserveVariantUsage will charge every user of the file with the given key for its resized
+// copies like SetVariantUsage, unless it would exceed the quota of any of them. In that case
+// nobody is charged, and the copies must not be stored.
+func (s *StorageServiceImpl) ReserveVariantUsage(key string, size int64) error {
+	return s.setVariantUsage(key, size, true)
+}
+
+func (s *StorageServiceImpl) setVariantUsage(key string, size int64, limited bool) error {
+	filter := bson.D{
+		bson.E{Key: "key", Value: key},
+		bson.E{Key: "variant_size", Value: bson.D{bson.E{Key: "$ne", Value: size}}},
+	}
+	cur, err := s.storageCollection.Find(s.ctx, filter)
+	if err != nil {
+		return err
+	}
+	var records []*models.StorageRecord
+	if err := cur.All(s.ctx, &records); err != nil {
+		return err
+	}
+
+	// Every user is charged before any record is changed, so the charges can be given back
+	// if one of the users is over the quota
+	for index, record := range records {
+		if limited {
+			err = s.reserveBytes(record.UserID, size-record.VariantSize)
+		} else {
+			err = s.addUsedBytes(record.UserID, size-record.VariantSize)
+		}
+		if err != nil {
+			for _, charged := range records[:index] {
+				if err := s.addUsedBytes(charged.UserID, charged.VariantSize-size); err != nil {
+					return err
+				}
+			}
+			return err
+		}
+	}
+
+	for _, record := range records {
+		// The record is only changed if nobody else changed it since it was read, otherwise
+		// the charge is given back, so the difference is added to the total once
+		filter := bson.D{
+			bson.E{Key: "_id", Value: record.ID},
+			bson.E{Key: "variant_size", Value: record.VariantSize},
+		}
+		update := bson.D{bson.E{Key: "$set", Value: bson.D{bson.E{Key: "variant_size", Value: size}}}}
+		result, err := s.storageCollection.UpdateOne(s.ctx, filter, update)
+		if err != nil {
+			return err
+		}
+		if result.ModifiedCount > 0 {
+			continue
+		}
+		if err := s.addUsedBytes(record.UserID, record.VariantSize-size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *StorageServiceImpl) RemoveUsage(userId string, key string) error {
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "key", Value: key}}
+	var record models.StorageRecord
+	err := s.storageCollection.FindOneAndDelete(s.ctx, filter).Decode(&record)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.addUsedBytes(userId, -(record.Size + record.VariantSize))
+}
+
+// HasUsage tells if the file with the given key is counted against the quota of the user.
+func (s *StorageServiceImpl) HasUsage(userId string, key string) (bool, error) {
+	filter := bson.D{bson.E{Key: "user_id", Value: userId}, bson.E{Key: "key", Value: key}}
+	count, err := s.storageCollection.CountDocuments(s.ctx, filter, options.Count().SetLimit(1))
+	return count > 0, err
+}
@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"testing"
+
+	"github.com/akunsecured/emezen_api/models"
+	"github.com/akunsecured/emezen_api/utils"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+// The storage tests run against the mock deployment of the driver, which answers the
+// commands with the queued responses and records them.
+
+const storageTestDatabase = "emezen_test"
+
+var storageTestPolicy = models.StoragePolicy{QuotaBytes: 1000, MaxUploadsPerHour: 100}
+
+func newStorageTestService(mt *mtest.T) StorageService {
+	database := mt.Client.Database(storageTestDatabase)
+	return NewStorageService(database.Collection("storage_usage"), database.Collection("storage_totals"), database.Collection("upload_counters"), storageTestPolicy, context.Background())
+}
+
+func storageTestDocument(mt *mtest.T, value interface{}) bson.D {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		mt.Fatal(err)
+	}
+	var document bson.D
+	if err := bson.Unmarshal(data, &document); err != nil {
+		mt.Fatal(err)
+	}
+	return document
+}
+
+// storageTestCommand returns the first recorded command with the given name on the given
+// collection.
+func storageTestCommand(mt *mtest.T, name string, collection string) bson.Raw {
+	for _, started := range mt.GetAllStartedEvents() {
+		if started.CommandName != name {
+			continue
+		}
+		if value, err := started.Command.LookupErr(name); err == nil && value.StringValue() == collection {
+			return started.Command
+		}
+	}
+	mt.Fatalf("no %s command on %s", name, collection)
+	return nil
+}
+
+// storageTestIncrement returns the number of bytes the first update of the totals added.
+func storageTestIncrement(mt *mtest.T) (int64, bson.Raw) {
+	update := storageTestCommand(mt, "update", "storage_totals").Lookup("updates").Array().Index(0).Value().Document()
+	return update.Lookup("u", "$inc", "used_bytes").Int64(), update.Lookup("q").Document()
+}
+
+func TestReserveQuota(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("reserved", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		reserved, err := service.ReserveQuota("user", 400)
+		if err != nil || reserved != 400 {
+			t.Fatalf("ReserveQuota = %d, %v, want 400", reserved, err)
+		}
+		increment, filter := storageTestIncrement(mt)
+		if increment != 400 {
+			t.Errorf("the total was incremented by %d, want 400", increment)
+		}
+		// The total is only incremented if the reserved bytes still fit in the quota
+		if limit := filter.Lookup("used_bytes", "$lte").Int64(); limit != 600 {
+			t.Errorf("the total is incremented up to %d, want 600", limit)
+		}
+	})
+
+	mt.Run("quota exceeded", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}))
+
+		reserved, err := service.ReserveQuota("user", 400)
+		if err != utils.ErrStorageQuotaExceeded || reserved != 0 {
+			t.Errorf("ReserveQuota = %d, %v, want %v", reserved, err, utils.ErrStorageQuotaExceeded)
+		}
+	})
+
+	mt.Run("larger than the quota", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+
+		if _, err := service.ReserveQuota("user", 1001); err != utils.ErrStorageQuotaExceeded {
+			t.Errorf("ReserveQuota returned %v, want %v", err, utils.ErrStorageQuotaExceeded)
+		}
+	})
+
+	mt.Run("replaced file", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		replaced := models.StorageRecord{ID: primitive.NewObjectID(), UserID: "user", Key: "profile_pictures/user.png", Size: 300, VariantSize: 50}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, storageTestDatabase+".storage_usage", mtest.FirstBatch, storageTestDocument(mt, replaced)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		reserved, err := service.ReserveQuota("user", 400, replaced.Key)
+		if err != nil || reserved != 50 {
+			t.Errorf("ReserveQuota = %d, %v, want only the difference of 50", reserved, err)
+		}
+	})
+}
+
+func TestReserveUploads(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("reserved", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}))
+
+		if err := service.ReserveUploads("user", 3); err != nil {
+			t.Fatal(err)
+		}
+		update := storageTestCommand(mt, "update", "upload_counters").Lookup("updates").Array().Index(0).Value().Document()
+		if increment := update.Lookup("u", "$inc", "uploads").Int32(); increment != 3 {
+			t.Errorf("the counter was incremented by %d, want 3", increment)
+		}
+		// The counter of the hour is only incremented if the files still fit in the limit
+		if limit := update.Lookup("q", "uploads", "$lte").Int32(); limit != 97 {
+			t.Errorf("the counter is incremented up to %d, want 97", limit)
+		}
+		if _, err := update.LookupErr("q", "window_start"); err != nil {
+			t.Error("the counter is not per hour")
+		}
+	})
+
+	mt.Run("too many uploads", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		mt.AddMockResponses(mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}))
+
+		if err := service.ReserveUploads("user", 1); err != utils.ErrTooManyUploads {
+			t.Errorf("ReserveUploads returned %v, want %v", err, utils.ErrTooManyUploads)
+		}
+	})
+
+	mt.Run("more files than the limit", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+
+		if err := service.ReserveUploads("user", 101); err != utils.ErrTooManyUploads {
+			t.Errorf("ReserveUploads returned %v, want %v", err, utils.ErrTooManyUploads)
+		}
+	})
+}
+
+func TestSetUsage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	tests := []struct {
+		name      string
+		previous  *models.StorageRecord
+		increment int64
+	}{
+		{"new file", nil, 300},
+		{"replaced file", &models.StorageRecord{ID: primitive.NewObjectID(), UserID: "user", Key: "key", Size: 100, VariantSize: 40}, 200},
+	}
+
+	for _, test := range tests {
+		mt.Run(test.name, func(mt *mtest.T) {
+			service := newStorageTestService(mt)
+			var previous interface{}
+			if test.previous != nil {
+				previous = storageTestDocument(mt, test.previous)
+			}
+			mt.AddMockResponses(
+				mtest.CreateSuccessResponse(bson.E{Key: "value", Value: previous}),
+				mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			)
+
+			if err := service.SetUsage("user", "key", 300); err != nil {
+				t.Fatal(err)
+			}
+			if increment, _ := storageTestIncrement(mt); increment != test.increment {
+				t.Errorf("the total was incremented by %d, want %d", increment, test.increment)
+			}
+		})
+	}
+}
+
+func TestRemoveUsageReleasesVariants(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("remove", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		record := models.StorageRecord{ID: primitive.NewObjectID(), UserID: "user", Key: "key", Size: 300, VariantSize: 200}
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "value", Value: storageTestDocument(mt, record)}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+		)
+
+		if err := service.RemoveUsage("user", "key"); err != nil {
+			t.Fatal(err)
+		}
+		if increment, _ := storageTestIncrement(mt); increment != -500 {
+			t.Errorf("the total was incremented by %d, want -500", increment)
+		}
+	})
+}
+
+func TestSetVariantUsage(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("charge", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		record := models.StorageRecord{ID: primitive.NewObjectID(), UserID: "user", Key: "key", Size: 300, VariantSize: 0}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, storageTestDatabase+".storage_usage", mtest.FirstBatch, storageTestDocument(mt, record)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := service.SetVariantUsage("key", 120); err != nil {
+			t.Fatal(err)
+		}
+		if increment, _ := storageTestIncrement(mt); increment != 120 {
+			t.Errorf("the total was incremented by %d, want 120", increment)
+		}
+	})
+}
+
+func TestReserveVariantUsageOverQuota(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	defer mt.Close()
+
+	mt.Run("second user over quota", func(mt *mtest.T) {
+		service := newStorageTestService(mt)
+		first := models.StorageRecord{ID: primitive.NewObjectID(), UserID: "first", Key: "key", Size: 300}
+		second := models.StorageRecord{ID: primitive.NewObjectID(), UserID: "second", Key: "key", Size: 300}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, storageTestDatabase+".storage_usage", mtest.FirstBatch, storageTestDocument(mt, first), storageTestDocument(mt, second)),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+			mtest.CreateWriteErrorsResponse(mtest.WriteError{Index: 0, Code: 11000, Message: "duplicate key"}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		if err := service.ReserveVariantUsage("key", 120); err != utils.ErrStorageQuotaExceeded {
+			t.Fatalf("ReserveVariantUsage returned %v, want %v", err, utils.ErrStorageQuotaExceeded)
+		}
+
+		// The charge of the first user is given back, and no record is changed
+		var increments []int64
+		for _, started := range mt.GetAllStartedEvents() {
+			if started.CommandName != "update" {
+				continue
+			}
+			if started.Command.Lookup("update").StringValue() != "storage_totals" {
+				t.Fatalf("%s was changed", started.Command.Lookup("update").StringValue())
+			}
+			update := started.Command.Lookup("updates").Array().Index(0).Value().Document()
+			increments = append(increments, update.Lookup("u", "$inc", "used_bytes").Int64())
+		}
+		if len(increments) != 3 || increments[0] != 120 || increments[1] != 120 || increments[2] != -120 {
+			t.Errorf("the totals were incremented by %v, want [120 120 -120]", increments)
+		}
+	})
+}
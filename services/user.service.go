@@ -7,6 +7,11 @@ import (
 type UserService interface {
 	CreateUser(*models.User) (*string, error)
 	GetUser(*string) (*models.User, error)
+	GetAllUsers() ([]*models.User, error)
 	UpdateUser(*models.User) error
 	DeleteUser(*string) error
+	SetEmailVerified(*string, bool) error
+	SetProfilePicture(*string, string) error
+	SetRoles(*string, []models.Role) error
+	GrantRole(*string, models.Role) error
 }
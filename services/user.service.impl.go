@@ -29,6 +29,8 @@ func (u *UserServiceImpl) CreateUser(user *models.User) (*string, error) {
 	user.CreatedAt = time.Now()
 	user.UpdatedAt = user.CreatedAt
 	user.Credits = 0
+	user.EmailVerified = false
+	user.Roles = models.DefaultRoles
 
 	result, err := u.userCollection.InsertOne(u.ctx, user)
 	if err != nil {
@@ -53,6 +55,31 @@ func (u *UserServiceImpl) GetUser(userId *string) (*models.User, error) {
 	return user, err
 }
 
+func (u *UserServiceImpl) GetAllUsers() ([]*models.User, error) {
+	var users []*models.User
+
+	cur, err := u.userCollection.Find(u.ctx, bson.D{})
+	if err != nil {
+		return nil, err
+	}
+
+	for cur.Next(u.ctx) {
+		var user *models.User
+		err := cur.Decode(&user)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	cur.Close(u.ctx)
+
+	return users, err
+}
+
+// UpdateUser will save the profile of the user. The profile picture is not changed, it is
+// only set by uploading a picture.
 func (u *UserServiceImpl) UpdateUser(user *models.User) error {
 	filter := bson.D{bson.E{Key: "_id", Value: user.ID}}
 	update := bson.D{bson.E{Key: "$set", Value: bson.D{
@@ -60,7 +87,6 @@ func (u *UserServiceImpl) UpdateUser(user *models.User) error {
 		bson.E{Key: "last_name", Value: user.LastName},
 		bson.E{Key: "age", Value: user.Age},
 		bson.E{Key: "contact_email", Value: user.ContactEmail},
-		bson.E{Key: "profile_picture", Value: user.ProfilePicture},
 		bson.E{Key: "credits", Value: user.Credits},
 		bson.E{Key: "updated_at", Value: time.Now()},
 	}}}
@@ -84,3 +110,84 @@ func (u *UserServiceImpl) DeleteUser(userId *string) error {
 	}
 	return nil
 }
+
+// SetProfilePicture will save the storage key of the profile picture of the user.
+func (u *UserServiceImpl) SetProfilePicture(userId *string, key string) error {
+	objID, err := primitive.ObjectIDFromHex(*userId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "profile_picture", Value: key},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	result, err := u.userCollection.UpdateOne(u.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+	return nil
+}
+
+func (u *UserServiceImpl) SetEmailVerified(userId *string, verified bool) error {
+	objID, err := primitive.ObjectIDFromHex(*userId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "email_verified", Value: verified},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	result, err := u.userCollection.UpdateOne(u.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+	return nil
+}
+
+func (u *UserServiceImpl) SetRoles(userId *string, roles []models.Role) error {
+	objID, err := primitive.ObjectIDFromHex(*userId)
+	if err != nil {
+		return err
+	}
+	filter := bson.D{bson.E{Key: "_id", Value: objID}}
+	update := bson.D{bson.E{Key: "$set", Value: bson.D{
+		bson.E{Key: "roles", Value: roles},
+		bson.E{Key: "updated_at", Value: time.Now()},
+	}}}
+
+	result, err := u.userCollection.UpdateOne(u.ctx, filter, update)
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount != 1 {
+		return utils.ErrNotExists
+	}
+	return nil
+}
+
+// GrantRole will add the given role to the user, keeping the roles the user already has.
+func (u *UserServiceImpl) GrantRole(userId *string, role models.Role) error {
+	user, err := u.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	roles := user.GetRoles()
+	for _, r := range roles {
+		if r == role {
+			return nil
+		}
+	}
+
+	return u.SetRoles(userId, append(append([]models.Role{}, roles...), role))
+}
@@ -5,8 +5,7 @@ import "errors"
 var (
 	ErrEmailIsAlreadyInUse             = errors.New("email is already in use")
 	ErrInvalidCredentialsFormat        = errors.New("bad credentials format")
-	ErrNoAccountWithThisEmail          = errors.New("no account with this email address")
-	ErrInvalidPassword                 = errors.New("invalid password")
+	ErrInvalidCredentials              = errors.New("invalid email or password")
 	ErrNotExists                       = errors.New("account does not exist")
 	ErrInvalidTokenFormat              = errors.New("invalid token format in header")
 	ErrMissingAuthToken                = errors.New("missing token")
@@ -20,4 +19,63 @@ var (
 	ErrOwnerCannotBuy                  = errors.New("the product's owner cannot buy the product")
 	ErrNotEnoughProducts               = errors.New("not enough products to buy")
 	ErrNotEnoughCredits                = errors.New("user does not have enough credits")
+	ErrInvalidTokenType                = errors.New("invalid token type")
+	ErrSessionRevoked                  = errors.New("session is revoked")
+	ErrInvalidResetToken               = errors.New("invalid or expired reset token")
+	ErrInvalidVerificationToken        = errors.New("invalid or expired verification token")
+	ErrEmailIsAlreadyVerified          = errors.New("email is already verified")
+	ErrEmailIsNotVerified              = errors.New("email address has to be verified first")
+	ErrTwoFactorAlreadyEnabled         = errors.New("two-factor authentication is already enabled")
+	ErrTwoFactorNotEnabled             = errors.New("two-factor authentication is not enabled")
+	ErrTwoFactorNotEnrolled            = errors.New("two-factor enrollment was not started")
+	ErrInvalidTwoFactorCode            = errors.New("invalid two-factor code")
+	ErrInvalidLoginChallenge           = errors.New("invalid or expired login challenge")
+	ErrTooManyLoginAttempts            = errors.New("too many failed login attempts, try again later")
+	ErrForbidden                       = errors.New("insufficient permissions")
+	ErrWrongCurrentPassword            = errors.New("current password is incorrect")
+	ErrEmailIsUnchanged                = errors.New("new email address is the same as the current one")
+	ErrInvalidRole                     = errors.New("invalid role")
+	ErrSellerRoleRequired              = errors.New("seller role is required to list products")
+	ErrInvalidAPIKey                   = errors.New("invalid or expired api key")
+	ErrInvalidAPIKeyFormat             = errors.New("bad api key format")
+	ErrMissingScope                    = errors.New("missing the required scope")
+	ErrScopedTokenNotAllowed           = errors.New("api keys and third-party tokens cannot be used for this endpoint")
+	ErrInvalidOAuthClientFormat        = errors.New("bad oauth client format")
+	ErrPasswordMismatch                = errors.New("password does not match")
+	ErrUnknownPasswordHash             = errors.New("unknown password hash format")
+	ErrWeakPassword                    = errors.New("password does not satisfy the password policy")
+	ErrInvalidAuditQuery               = errors.New("bad audit event query")
+	ErrImpersonationNotAllowed         = errors.New("this is not allowed while impersonating a user")
+	ErrCannotImpersonate               = errors.New("this user cannot be impersonated")
+	ErrInvalidCORSPolicy               = errors.New("bad cors configuration")
+	ErrBlobNotFound                    = errors.New("file not found")
+	ErrInvalidBlobKey                  = errors.New("invalid file name")
+	ErrInvalidBlobRange                = errors.New("invalid range")
+	ErrFileTooLarge                    = errors.New("file is too large")
+	ErrRequestTooLarge                 = errors.New("request is too large")
+	ErrTooManyFiles                    = errors.New("too many files in one request")
+	ErrUnsupportedImageType            = errors.New("unsupported image type, only jpeg, png, gif and webp are accepted")
+	ErrInvalidImage                    = errors.New("file is not a valid image")
+	ErrImageTooLarge                   = errors.New("image dimensions are too large")
+	ErrNoFilesUploaded                 = errors.New("no files were uploaded")
+	ErrUnknownImageSize                = errors.New("unknown image size, use thumbnail, medium, large or original")
+	ErrUnknownImageFormat              = errors.New("unknown image format, use webp or original")
+	ErrProductImageNotFound            = errors.New("the product has no such image")
+	ErrInvalidImageOrder               = errors.New("the new order has to contain every image of the product exactly once")
+	ErrInvalidMediaSignature           = errors.New("invalid or missing signature")
+	ErrMediaURLExpired                 = errors.New("the link has expired")
+	ErrInvalidMediaURLLifetime         = errors.New("bad link lifetime")
+	ErrStorageQuotaExceeded            = errors.New("storage quota exceeded, delete some images before uploading new ones")
+	ErrTooManyProductImages            = errors.New("the product would have more images than allowed")
+	ErrTooManyUploads                  = errors.New("too many uploads, try again later")
+
+	// The OAuth errors use the error codes of RFC 6749, since clients rely on them
+	ErrOAuthInvalidRequest       = errors.New("invalid_request")
+	ErrOAuthInvalidClient        = errors.New("invalid_client")
+	ErrOAuthInvalidGrant         = errors.New("invalid_grant")
+	ErrOAuthUnauthorizedClient   = errors.New("unauthorized_client")
+	ErrOAuthUnsupportedGrantType = errors.New("unsupported_grant_type")
+	ErrOAuthUnsupportedResponse  = errors.New("unsupported_response_type")
+	ErrOAuthInvalidScope         = errors.New("invalid_scope")
+	ErrOAuthAccessDenied         = errors.New("access_denied")
 )
@@ -1,5 +1,13 @@
 package utils
 
+import "strings"
+
+// NormalizeEmail returns the form in which email addresses are stored and looked up, so the
+// same address cannot be registered twice with different casing.
+func NormalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
 func containsInt(s []int64, e int64) bool {
 	for _, a := range s {
 		if a == e {